@@ -0,0 +1,59 @@
+package ocifs
+
+import (
+	"context"
+	"path"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Op names a filesystem operation passed to an AccessPolicy.
+type Op string
+
+const (
+	OpLookup    Op = "lookup"
+	OpGetattr   Op = "getattr"
+	OpSetattr   Op = "setattr"
+	OpReaddir   Op = "readdir"
+	OpOpen      Op = "open"
+	OpRead      Op = "read"
+	OpWrite     Op = "write"
+	OpReadlink  Op = "readlink"
+	OpCreate    Op = "create"
+	OpMkdir     Op = "mkdir"
+	OpSymlink   Op = "symlink"
+	OpUnlink    Op = "unlink"
+	OpRmdir     Op = "rmdir"
+	OpRename    Op = "rename"
+	OpGetxattr  Op = "getxattr"
+	OpListxattr Op = "listxattr"
+	OpAccess    Op = "access"
+)
+
+// AccessPolicy decides whether caller may perform op on path, which is
+// absolute within the mount. Denied operations fail with EACCES.
+type AccessPolicy func(op Op, path string, caller fuse.Caller) bool
+
+// check returns EACCES if the policy denies op on p for the caller in ctx.
+// A nil policy allows everything.
+func (p AccessPolicy) check(ctx context.Context, op Op, path string) syscall.Errno {
+	if p == nil {
+		return fs.OK
+	}
+	caller, _ := fuse.FromContext(ctx)
+	if caller == nil {
+		caller = &fuse.Caller{}
+	}
+	if !p(op, path, *caller) {
+		return syscall.EACCES
+	}
+	return fs.OK
+}
+
+// nodePath returns the absolute path of n, or of its child name, within the
+// mount.
+func nodePath(n *fs.Inode, name string) string {
+	return path.Join("/", n.Path(nil), name)
+}
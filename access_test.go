@@ -0,0 +1,133 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestMountAccessPolicy(t *testing.T) {
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	pushTarImage(t, ref, []*tar.Header{
+		{Name: "secret", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dir/inner", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "file", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "readme", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "shared", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"secret": "s", "dir/inner": "i", "file": "f", "readme": "r", "shared": "shared"})
+
+	// the policy denies op on path, to callers with uid if not -1
+	var mu sync.Mutex
+	var denied struct {
+		op   Op
+		path string
+		uid  int
+	}
+	policy := func(op Op, path string, caller fuse.Caller) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return op != denied.op || path != denied.path || (denied.uid >= 0 && int(caller.Uid) != denied.uid)
+	}
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// other users must be able to reach the mount
+	base := t.TempDir()
+	for _, dir := range []string{filepath.Dir(base), base} {
+		if err := os.Chmod(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	im, err := ofs.Mount(ref.String(), MountWithTargetPath(base), MountWithAllowOther(), MountWithAccessPolicy(policy))
+	if errors.Is(err, ErrFUSEUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Unmount()
+	mnt := im.MountPoint()
+
+	catAsNobody := func(name string) ([]byte, error) {
+		cmd := exec.Command("cat", filepath.Join(mnt, name))
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+		return cmd.CombinedOutput()
+	}
+
+	tests := []struct {
+		name string
+		op   Op
+		path string
+		uid  int
+		do   func() error
+	}{
+		{"lookup", OpLookup, "/secret", -1, func() error {
+			_, err := os.Lstat(filepath.Join(mnt, "secret"))
+			return err
+		}},
+		{"readdir", OpReaddir, "/dir", -1, func() error {
+			_, err := os.ReadDir(filepath.Join(mnt, "dir"))
+			return err
+		}},
+		{"open", OpOpen, "/file", -1, func() error {
+			f, err := os.Open(filepath.Join(mnt, "file"))
+			if err == nil {
+				f.Close()
+			}
+			return err
+		}},
+		{"read", OpRead, "/readme", -1, func() error {
+			f, err := os.Open(filepath.Join(mnt, "readme"))
+			if err != nil {
+				t.Fatalf("open allowed by the policy: %v", err)
+			}
+			defer f.Close()
+			_, err = f.Read(make([]byte, 8))
+			return err
+		}},
+		{"read by uid", OpOpen, "/shared", 65534, func() error {
+			if os.Geteuid() != 0 {
+				t.Skip("needs root to act as another user")
+			}
+			// other users are denied, while the owner of the mount is not
+			if _, err := os.ReadFile(filepath.Join(mnt, "shared")); err != nil {
+				t.Fatalf("read by the mount owner: %v", err)
+			}
+			if out, err := catAsNobody("shared"); err == nil || !strings.Contains(string(out), "Permission denied") {
+				t.Fatalf("read by uid 65534: %s, %v, want EACCES", out, err)
+			}
+			if out, _ := catAsNobody("readme"); string(out) != "r" {
+				t.Fatalf("read of another file by uid 65534: %s", out)
+			}
+			return syscall.EACCES
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			denied.op, denied.path, denied.uid = tt.op, tt.path, tt.uid
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				denied.op = ""
+				mu.Unlock()
+			}()
+
+			if err := tt.do(); !errors.Is(err, syscall.EACCES) {
+				t.Errorf("%s of %s: %v, want EACCES", tt.op, tt.path, err)
+			}
+		})
+	}
+}
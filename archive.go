@@ -0,0 +1,145 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// ImportArchive stores the image in r, a tarball written by docker save or
+// an OCI image layout archived with tar, and unpacks its layers, without
+// contacting any registry. The archive must hold a single image. The
+// returned digest can be passed as the reference to Image or Mount.
+func (s *OCIFS) ImportArchive(r io.Reader) (v1.Hash, error) {
+	f, size, err := spool(r)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	defer f.Close()
+
+	docker, oci, err := archiveFormat(io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return v1.Hash{}, err
+	}
+
+	var img v1.Image
+	switch {
+	case docker:
+		img, err = tarball.Image(func() (io.ReadCloser, error) {
+			return io.NopCloser(io.NewSectionReader(f, 0, size)), nil
+		}, nil)
+	case oci:
+		dir, derr := os.MkdirTemp(s.workDir, "import-")
+		if derr != nil {
+			return v1.Hash{}, derr
+		}
+		defer os.RemoveAll(dir)
+		if err = untar(io.NewSectionReader(f, 0, size), dir); err == nil {
+			img, err = s.resolveLayout(context.Background(), dir)
+		}
+	default:
+		err = errors.New("archive has neither a docker manifest.json nor an OCI layout")
+	}
+	if err != nil {
+		return v1.Hash{}, err
+	}
+
+	h, err := s.storeImage("archive", "", img, nil, nil)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	return *h, nil
+}
+
+// spool copies r to a file that is unlinked right away, so archives that
+// are read more than once can be streamed. The space is freed once the file
+// is closed or garbage collected.
+func spool(r io.Reader) (*os.File, int64, error) {
+	f, err := os.CreateTemp("", "ocifs-archive-*.tar")
+	if err != nil {
+		return nil, 0, err
+	}
+	os.Remove(f.Name())
+	size, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+// archiveFormat reports whether the tar in r is a docker save archive or an
+// OCI layout. Archives of recent docker versions are both, and are read as
+// docker archives.
+func archiveFormat(r io.Reader) (docker, oci bool, err error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return docker, oci, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		switch cleanName(hdr.Name) {
+		case "manifest.json":
+			docker = true
+		case "index.json":
+			oci = true
+		}
+	}
+}
+
+// untar extracts the directories and regular files of the tar in r into
+// dir.
+func untar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := cleanName(hdr.Name)
+		if name == "" {
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = writeFile(target, tr)
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("extract %s: %w", name, err)
+		}
+	}
+}
+
+func writeFile(target string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestImportArchive(t *testing.T) {
+	img, err := random.Image(256, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgName, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var docker bytes.Buffer
+	tag, err := name.NewTag("example.com/app:dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tarball.Write(tag, img, &docker); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	lp, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lp.AppendImage(img); err != nil {
+		t.Fatal(err)
+	}
+	var oci bytes.Buffer
+	tw := tar.NewWriter(&oci)
+	if err := tw.AddFS(os.DirFS(dir)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, archive := range map[string]io.Reader{"docker": &docker, "oci": &oci} {
+		t.Run(name, func(t *testing.T) {
+			workDir := t.TempDir()
+			ofs, err := New(WithWorkDir(workDir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, err := ofs.ImportArchive(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ofs.Image(h.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := got.ConfigFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cfg.RootFS.DiffIDs) != 2 {
+				t.Errorf("got %d layers, want 2", len(cfg.RootFS.DiffIDs))
+			}
+			if _, err := ofs.lp.Blob(cfgName); err != nil {
+				t.Errorf("config not in store: %v", err)
+			}
+			if tmp, _ := filepath.Glob(filepath.Join(workDir, "import-*")); len(tmp) > 0 {
+				t.Errorf("import dirs left behind: %v", tmp)
+			}
+			if _, err := fs.Stat(got.FS(), "."); err != nil {
+				t.Error(err)
+			}
+			// imports have no reference to record
+			if refs, err := ofs.Refs(); err != nil || len(refs) != 0 {
+				t.Errorf("Refs() = %v, %v, want none", refs, err)
+			}
+		})
+	}
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ofs.ImportArchive(bytes.NewReader(nil)); err == nil {
+		t.Error("ImportArchive of an empty archive succeeded")
+	}
+}
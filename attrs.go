@@ -0,0 +1,76 @@
+package ocifs
+
+import (
+	"os"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// fixedAttrs are the owner and times every entry of the image reports.
+type fixedAttrs struct {
+	epoch    time.Time
+	uid, gid uint32
+}
+
+// MountWithNormalizedAttrs makes every entry of the image report uid and gid
+// as owner and epoch as its access, modification and change times, so that
+// tools reading the mount, such as build systems hashing their inputs, see
+// the same metadata however the image was built. Permissions are checked
+// against the reported owner. Bind directories keep the attributes of the
+// host.
+var MountWithNormalizedAttrs = func(epoch time.Time, uid, gid uint32) MountOption {
+	return func(im *ImageMount) {
+		im.fixedAttrs = &fixedAttrs{epoch: epoch, uid: uid, gid: gid}
+	}
+}
+
+// MountWithSourceDateEpoch clamps the modification times of the entries of
+// the image that are later than t down to t, as SOURCE_DATE_EPOCH does for
+// reproducible builds, so that rebuilding an image with fresh timestamps
+// does not invalidate the caches of build systems reading the mount. Earlier
+// times, and access and change times, are kept.
+var MountWithSourceDateEpoch = func(t time.Time) MountOption {
+	return func(im *ImageMount) {
+		im.dateEpoch = &t
+	}
+}
+
+// rootAttrs are the permissions and owner the root directory reports.
+type rootAttrs struct {
+	mode     os.FileMode
+	uid, gid uint32
+}
+
+// MountWithRootAttr makes the root directory of the mount report the
+// permissions of mode and uid and gid as owner, whatever the image has for
+// /, such as images whose root belongs to an unprivileged user and cannot
+// be traversed by others. It takes precedence over MountWithNormalizedAttrs
+// for the root. Permissions are checked against the reported attributes.
+var MountWithRootAttr = func(mode os.FileMode, uid, gid uint32) MountOption {
+	return func(im *ImageMount) {
+		im.rootAttrs = &rootAttrs{mode: mode.Perm(), uid: uid, gid: gid}
+	}
+}
+
+// rootAttr returns the attributes of the root directory.
+func (ofs *ociFS) rootAttr() fuse.Attr {
+	attr := ofs.dirAttr("/")
+	if r := ofs.rootAttrs; r != nil {
+		attr.Mode = attr.Mode&^07777 | uint32(r.mode)
+		attr.Uid, attr.Gid = r.uid, r.gid
+	}
+	return attr
+}
+
+// adjustAttr applies the attribute overrides of the mount to attr, the
+// attributes of an entry of the image.
+func (ofs *ociFS) adjustAttr(attr *fuse.Attr) {
+	if f := ofs.fixedAttrs; f != nil {
+		attr.Uid, attr.Gid = f.uid, f.gid
+		attr.SetTimes(&f.epoch, &f.epoch, &f.epoch)
+	}
+	if t := ofs.dateEpoch; t != nil && attr.ModTime().After(*t) {
+		attr.SetTimes(nil, t, nil)
+	}
+}
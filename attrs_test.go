@@ -0,0 +1,230 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// testRegistry starts an in-memory registry, closed when the test ends, and
+// returns its host. Each request is passed to intercept first, if not nil,
+// so tests can count or hold them, and is not served further if intercept
+// answered it, returning true.
+func testRegistry(t *testing.T, intercept func(w http.ResponseWriter, r *http.Request) bool) string {
+	t.Helper()
+	reg := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if intercept != nil && intercept(w, r) {
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// parseRef parses the image reference s.
+func parseRef(t *testing.T, s string) name.Reference {
+	t.Helper()
+	ref, err := name.ParseReference(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+// pushRandomImage pushes an image of layers random layers of size bytes
+// each as ref and returns it.
+func pushRandomImage(t *testing.T, ref name.Reference, size, layers int64) v1.Image {
+	t.Helper()
+	img, err := random.Image(size, layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// pushTarImage pushes an image of a single layer holding hdrs, with the
+// content of regular files taken from bodies, as ref.
+func pushTarImage(t *testing.T, ref name.Reference, hdrs []*tar.Header, bodies map[string]string) {
+	t.Helper()
+	img, err := mutate.AppendLayers(empty.Image, tarLayer(t, hdrs, bodies))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tarLayer returns a layer holding hdrs, with the content of regular files
+// taken from bodies.
+func tarLayer(t *testing.T, hdrs []*tar.Header, bodies map[string]string) v1.Layer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(bodies[hdr.Name]))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(bodies[hdr.Name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := tarball.LayerFromReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layer
+}
+
+func TestMountNormalizedAttrs(t *testing.T) {
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	pushRandomImage(t, ref, 256, 2)
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	im, err := ofs.Mount(ref.String(), MountWithTargetPath(t.TempDir()), MountWithNormalizedAttrs(epoch, 1000, 2000))
+	if errors.Is(err, ErrFUSEUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Unmount()
+
+	n := 0
+	err = filepath.WalkDir(im.MountPoint(), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if st.Uid != 1000 || st.Gid != 2000 {
+			t.Errorf("%s: owner %d:%d, want 1000:2000", p, st.Uid, st.Gid)
+		}
+		for what, ts := range map[string]syscall.Timespec{"atime": st.Atim, "mtime": st.Mtim, "ctime": st.Ctim} {
+			if got := time.Unix(ts.Unix()); !got.Equal(epoch) {
+				t.Errorf("%s: %s %v, want %v", p, what, got, epoch)
+			}
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 3 {
+		t.Errorf("walked %d entries, want the root and the files of both layers", n)
+	}
+}
+
+func TestMountSourceDateEpoch(t *testing.T) {
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	pushTarImage(t, ref, []*tar.Header{
+		{Name: "old", Typeflag: tar.TypeReg, Mode: 0644, ModTime: old, AccessTime: recent, ChangeTime: recent, Format: tar.FormatPAX},
+		{Name: "recent", Typeflag: tar.TypeReg, Mode: 0644, ModTime: recent, AccessTime: recent, ChangeTime: recent, Format: tar.FormatPAX},
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "recent", ModTime: recent},
+	}, nil)
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := ofs.Mount(ref.String(), MountWithTargetPath(t.TempDir()), MountWithSourceDateEpoch(epoch))
+	if errors.Is(err, ErrFUSEUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Unmount()
+
+	for p, want := range map[string]time.Time{"": epoch, "old": old, "recent": epoch, "link": epoch} {
+		fi, err := os.Lstat(filepath.Join(im.MountPoint(), p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(want) {
+			t.Errorf("%q: mtime %v, want %v", p, fi.ModTime().UTC(), want)
+		}
+	}
+	st, err := os.Stat(filepath.Join(im.MountPoint(), "recent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atime := st.Sys().(*syscall.Stat_t).Atim; atime.Sec != recent.Unix() {
+		t.Errorf("atime %v changed, want %v", time.Unix(atime.Unix()).UTC(), recent)
+	}
+}
+
+func TestMountRootAttr(t *testing.T) {
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	pushTarImage(t, ref, []*tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0700, Uid: 1000, Gid: 1000},
+		{Name: "file", Typeflag: tar.TypeReg, Mode: 0600, Uid: 1000, Gid: 1000},
+	}, nil)
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := ofs.Mount(ref.String(), MountWithTargetPath(t.TempDir()), MountWithRootAttr(0755, 0, 0))
+	if errors.Is(err, ErrFUSEUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Unmount()
+
+	for p, want := range map[string][3]uint32{"": {fuse.S_IFDIR | 0755, 0, 0}, "file": {fuse.S_IFREG | 0600, 1000, 1000}} {
+		fi, err := os.Lstat(filepath.Join(im.MountPoint(), p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if got := [3]uint32{st.Mode, st.Uid, st.Gid}; got != want {
+			t.Errorf("%q: mode and owner %o:%d:%d, want %o:%d:%d", p, got[0], got[1], got[2], want[0], want[1], want[2])
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package ocifs
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type auditRecord struct {
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`
+	Path    string    `json:"path"`
+	NewPath string    `json:"newPath,omitempty"`
+	Uid     uint32    `json:"uid"`
+	Gid     uint32    `json:"gid"`
+	Pid     uint32    `json:"pid"`
+	Result  string    `json:"result"`
+}
+
+// auditLog writes one JSON record per mutating operation.
+type auditLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newAuditLog(w io.Writer) *auditLog {
+	return &auditLog{enc: json.NewEncoder(w)}
+}
+
+func (a *auditLog) record(ctx context.Context, op, path, newPath string, errno syscall.Errno) {
+	if a == nil {
+		return
+	}
+
+	rec := auditRecord{
+		Time:    time.Now(),
+		Op:      op,
+		Path:    path,
+		NewPath: newPath,
+		Result:  "ok",
+	}
+	if errno != 0 {
+		rec.Result = errno.Error()
+	}
+	if caller, ok := fuse.FromContext(ctx); ok {
+		rec.Uid, rec.Gid, rec.Pid = caller.Uid, caller.Gid, caller.Pid
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.enc.Encode(&rec); err != nil {
+		slog.Error("write audit record", "op", op, "path", path, "error", err)
+	}
+}
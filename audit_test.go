@@ -0,0 +1,81 @@
+package ocifs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestMountAuditLog(t *testing.T) {
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	pushRandomImage(t, ref, 64, 1)
+
+	var buf bytes.Buffer
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := ofs.Mount(ref.String(), MountWithTargetPath(t.TempDir()), MountWithBindDir(t.TempDir(), "/data"), MountWithAuditLog(&buf),
+		MountWithAccessPolicy(func(op Op, path string, caller fuse.Caller) bool {
+			return op != OpCreate || path != "/data/denied"
+		}))
+	if errors.Is(err, ErrFUSEUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(im.MountPoint(), "data")
+
+	if err := os.WriteFile(filepath.Join(data, "a"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(data, "a"), filepath.Join(data, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(data, "b"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(data, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Create(filepath.Join(data, "denied")); err == nil {
+		t.Fatal("create denied by the policy succeeded")
+	}
+	if err := im.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+
+	type record struct {
+		op, path, newPath, result string
+	}
+	var got []record
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rec auditRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Uid != uint32(os.Getuid()) || rec.Gid != uint32(os.Getgid()) || rec.Pid == 0 || rec.Time.IsZero() {
+			t.Errorf("%s record: uid %d gid %d pid %d time %v, want the caller's", rec.Op, rec.Uid, rec.Gid, rec.Pid, rec.Time)
+		}
+		got = append(got, record{rec.Op, rec.Path, rec.NewPath, rec.Result})
+	}
+	want := []record{
+		{"create", "/data/a", "", "ok"},
+		{"write", "/data/a", "", "ok"},
+		{"rename", "/data/a", "/data/b", "ok"},
+		{"setattr", "/data/b", "", "ok"},
+		{"unlink", "/data/b", "", "ok"},
+		{"create", "/data/denied", "", "permission denied"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("records\n%v\nwant\n%v", got, want)
+	}
+}
@@ -0,0 +1,99 @@
+package ocifs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenBucket lets through up to rate bytes per second, with bursts of up
+// to rate bytes.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSec int64) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// burst returns the largest n wait accepts.
+func (b *tokenBucket) burst() int {
+	return max(int(b.rate), 1)
+}
+
+// wait blocks until n bytes may pass or ctx is done.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	delay := b.reserve(time.Now(), n)
+	if delay <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve takes n bytes worth of tokens at now and returns how long to wait
+// for them to be refilled.
+func (b *tokenBucket) reserve(now time.Time, n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+	// take the tokens now, going into debt, so concurrent callers queue up
+	// behind each other
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// limitedTransport throttles the response bodies of all requests made
+// through it to share one token bucket.
+type limitedTransport struct {
+	base   http.RoundTripper
+	bucket *tokenBucket
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, ctx: req.Context(), bucket: t.bucket}
+	return resp, nil
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	bucket *tokenBucket
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if len(p) > b.bucket.burst() {
+		p = p[:b.bucket.burst()]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := b.bucket.wait(b.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
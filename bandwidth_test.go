@@ -0,0 +1,64 @@
+package ocifs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	type read struct {
+		at    time.Duration
+		n     int
+		delay time.Duration
+	}
+	tests := []struct {
+		name  string
+		reads []read
+	}{
+		{"burst passes", []read{{0, 1000, 0}}},
+		{"concurrent readers queue behind each other", []read{{0, 1000, 0}, {0, 500, 500 * time.Millisecond}, {0, 500, time.Second}}},
+		{"debt is paid off over time", []read{{0, 1500, 500 * time.Millisecond}, {500 * time.Millisecond, 500, 500 * time.Millisecond}}},
+		{"tokens refill at the rate", []read{{0, 1000, 0}, {500 * time.Millisecond, 500, 0}, {500 * time.Millisecond, 100, 100 * time.Millisecond}}},
+		{"idle time refills one burst at most", []read{{0, 1000, 0}, {10 * time.Second, 1500, 500 * time.Millisecond}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			b := &tokenBucket{rate: 1000, tokens: 1000, last: start}
+			for i, r := range tt.reads {
+				if got := b.reserve(start.Add(r.at), r.n); got != r.delay {
+					t.Errorf("read %d of %d bytes at %v: delay %v, want %v", i, r.n, r.at, got, r.delay)
+				}
+			}
+		})
+	}
+}
+
+func TestLimitedBodyCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	bucket := newTokenBucket(1000)
+	body := &limitedBody{ReadCloser: io.NopCloser(bytes.NewReader(make([]byte, 5000))), ctx: ctx, bucket: bucket}
+
+	// the first burst is let through, and reads are cut to a burst
+	buf := make([]byte, 4096)
+	n, err := body.Read(buf)
+	if n != 1000 || err != nil {
+		t.Fatalf("first read = %d, %v, want 1000 bytes", n, err)
+	}
+
+	// the next one would wait for the tokens, but ctx is done
+	start := time.Now()
+	n, err = body.Read(buf)
+	if n != 1000 || !errors.Is(err, context.Canceled) {
+		t.Errorf("read after cancel = %d, %v, want 1000 bytes and context.Canceled", n, err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("read after cancel waited %v", d)
+	}
+}
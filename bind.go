@@ -0,0 +1,501 @@
+package ocifs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+type bindDir struct {
+	hostPath  string
+	mountPath string
+}
+
+// bindNode passes operations for a subtree of the mount straight through to
+// a host directory. Unlike fs.LoopbackNode, paths are resolved relative to
+// the bind root rather than the root of the mount.
+type bindNode struct {
+	fs.Inode
+	root     *bindNode
+	hostPath string
+	ofs      *ociFS
+}
+
+func newBindRoot(hostPath string, ofs *ociFS) *bindNode {
+	n := &bindNode{hostPath: hostPath, ofs: ofs}
+	n.root = n
+	return n
+}
+
+// fileOwner is the owner given to entries created in bind directories.
+type fileOwner struct {
+	uid, gid int
+}
+
+// created applies the owner of the mount, if any, to the entry at p just
+// created. Without one, a mount running as root gives the entry to the
+// caller, as the kernel would, so that other users own what they create.
+// The entry is removed if that fails.
+func (n *bindNode) created(ctx context.Context, p string, isDir bool) error {
+	owner := n.root.ofs.owner
+	if caller, ok := fuse.FromContext(ctx); ok && owner == nil && os.Geteuid() == 0 {
+		owner = &fileOwner{uid: int(caller.Uid), gid: int(caller.Gid)}
+	}
+	if owner == nil {
+		return nil
+	}
+	err := syscall.Lchown(p, owner.uid, owner.gid)
+	if err != nil {
+		if isDir {
+			syscall.Rmdir(p)
+		} else {
+			syscall.Unlink(p)
+		}
+	}
+	return err
+}
+
+// access checks that the caller may access the host entry at p with mask.
+// The daemon works on bind directories with its own privileges, so the
+// permissions of the callers, other users with MountWithAllowOther, are
+// checked against the host entries before acting for them.
+func (n *bindNode) access(ctx context.Context, p string, mask uint32) syscall.Errno {
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(p, &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	attr := fuse.Attr{}
+	attr.FromStat(&st)
+	return modePermissions(ctx, &attr, mask)
+}
+
+// mayRemove checks that the caller may remove or replace the entry name of
+// the directory: it needs write access to the directory and, when that is
+// sticky, to own the entry or the directory.
+func (n *bindNode) mayRemove(ctx context.Context, name string) syscall.Errno {
+	dir := syscall.Stat_t{}
+	if err := syscall.Lstat(n.path(), &dir); err != nil {
+		return fs.ToErrno(err)
+	}
+	attr := fuse.Attr{}
+	attr.FromStat(&dir)
+	if errno := modePermissions(ctx, &attr, unixWOK|unixXOK); errno != fs.OK {
+		return errno
+	}
+	caller, ok := fuse.FromContext(ctx)
+	if !ok || caller.Uid == 0 || dir.Mode&syscall.S_ISVTX == 0 || caller.Uid == dir.Uid {
+		return fs.OK
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(filepath.Join(n.path(), name), &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	if st.Uid != caller.Uid {
+		return syscall.EPERM
+	}
+	return fs.OK
+}
+
+// maySetattr checks that the caller may change the attributes in in: only
+// the owner may change the mode and the group, to one of its groups, only
+// root the owner, and the size and times need write access.
+func (n *bindNode) maySetattr(ctx context.Context, in *fuse.SetAttrIn) syscall.Errno {
+	caller, ok := fuse.FromContext(ctx)
+	if !ok || caller.Uid == 0 {
+		return fs.OK
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(n.path(), &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	owner := caller.Uid == st.Uid
+	if _, ok := in.GetMode(); ok && !owner {
+		return syscall.EPERM
+	}
+	if uid, ok := in.GetUID(); ok && uid != st.Uid {
+		return syscall.EPERM
+	}
+	if gid, ok := in.GetGID(); ok && gid != st.Gid && (!owner || caller.Gid != gid && !inGroup(caller.Pid, gid)) {
+		return syscall.EPERM
+	}
+	_, sok := in.GetSize()
+	_, mok := in.GetMTime()
+	_, aok := in.GetATime()
+	if sok || (mok || aok) && !owner {
+		attr := fuse.Attr{}
+		attr.FromStat(&st)
+		return modePermissions(ctx, &attr, unixWOK)
+	}
+	return fs.OK
+}
+
+// mountPath returns the path of the node, or of its child name, relative to
+// the root of the mount.
+func (n *bindNode) mountPath(name string) string {
+	return filepath.Join("/", n.Path(nil), name)
+}
+
+func (n *bindNode) path() string {
+	return filepath.Join(n.root.hostPath, n.Path(n.root.EmbeddedInode()))
+}
+
+func (n *bindNode) newChild(ctx context.Context, st *syscall.Stat_t) *fs.Inode {
+	return n.NewInode(ctx, &bindNode{root: n.root}, fs.StableAttr{
+		Mode: uint32(st.Mode),
+		Gen:  1,
+		Ino:  (uint64(st.Dev)<<32 | uint64(st.Dev)>>32) ^ st.Ino,
+	})
+}
+
+var _ = (fs.NodeLookuper)((*bindNode)(nil))
+
+func (n *bindNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if errno := n.root.ofs.policy.check(ctx, OpLookup, n.mountPath(name)); errno != fs.OK {
+		return nil, errno
+	}
+	if errno := n.access(ctx, n.path(), unixXOK); errno != fs.OK {
+		return nil, errno
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(filepath.Join(n.path(), name), &st); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	out.Attr.FromStat(&st)
+	return n.newChild(ctx, &st), fs.OK
+}
+
+var _ = (fs.NodeGetattrer)((*bindNode)(nil))
+
+func (n *bindNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if errno := n.root.ofs.policy.check(ctx, OpGetattr, n.mountPath("")); errno != fs.OK {
+		return errno
+	}
+	if fga, ok := fh.(fs.FileGetattrer); ok && fga != nil {
+		return fga.Getattr(ctx, out)
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(n.path(), &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	out.FromStat(&st)
+	return fs.OK
+}
+
+var _ = (fs.NodeSetattrer)((*bindNode)(nil))
+
+func (n *bindNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	errno := n.root.ofs.policy.check(ctx, OpSetattr, n.mountPath(""))
+	if errno == fs.OK {
+		errno = n.maySetattr(ctx, in)
+	}
+	if errno == fs.OK {
+		errno = n.setattr(ctx, fh, in, out)
+	}
+	n.root.ofs.audit.record(ctx, "setattr", n.mountPath(""), "", errno)
+	return errno
+}
+
+func (n *bindNode) setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if fsa, ok := fh.(fs.FileSetattrer); ok && fsa != nil {
+		return fsa.Setattr(ctx, in, out)
+	}
+
+	p := n.path()
+	if m, ok := in.GetMode(); ok {
+		if err := syscall.Chmod(p, m); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	uid, uok := in.GetUID()
+	gid, gok := in.GetGID()
+	if uok || gok {
+		suid, sgid := -1, -1
+		if uok {
+			suid = int(uid)
+		}
+		if gok {
+			sgid = int(gid)
+		}
+		if err := syscall.Lchown(p, suid, sgid); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	if sz, ok := in.GetSize(); ok {
+		if err := syscall.Truncate(p, int64(sz)); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	mtime, mok := in.GetMTime()
+	atime, aok := in.GetATime()
+	if mok || aok {
+		st := syscall.Stat_t{}
+		if err := syscall.Lstat(p, &st); err != nil {
+			return fs.ToErrno(err)
+		}
+		ts := []syscall.Timespec{st.Atim, st.Mtim}
+		if aok {
+			ts[0] = syscall.NsecToTimespec(atime.UnixNano())
+		}
+		if mok {
+			ts[1] = syscall.NsecToTimespec(mtime.UnixNano())
+		}
+		if err := syscall.UtimesNano(p, ts); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+
+	return n.Getattr(ctx, nil, out)
+}
+
+var _ = (fs.NodeReaddirer)((*bindNode)(nil))
+
+func (n *bindNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	if errno := n.root.ofs.policy.check(ctx, OpReaddir, n.mountPath("")); errno != fs.OK {
+		return nil, errno
+	}
+	if errno := n.access(ctx, n.path(), unixROK); errno != fs.OK {
+		return nil, errno
+	}
+	return fs.NewLoopbackDirStream(n.path())
+}
+
+var _ = (fs.NodeOpener)((*bindNode)(nil))
+
+func (n *bindNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if errno := n.root.ofs.policy.check(ctx, OpOpen, n.mountPath("")); errno != fs.OK {
+		return nil, 0, errno
+	}
+	if !n.root.ofs.handles.acquire() {
+		return nil, 0, syscall.EIO
+	}
+	fd, err := n.openHost(ctx, n.path(), flags&^syscall.O_APPEND)
+	if err != nil {
+		n.root.ofs.handles.release()
+		return nil, 0, fs.ToErrno(err)
+	}
+	return fs.NewLoopbackFile(fd), 0, fs.OK
+}
+
+var _ = (fs.NodeReleaser)((*bindNode)(nil))
+
+// Release closes the host file and lets a shutdown draining the handles of
+// the mount go on.
+func (n *bindNode) Release(ctx context.Context, fh fs.FileHandle) syscall.Errno {
+	defer n.root.ofs.handles.release()
+	if fr, ok := fh.(fs.FileReleaser); ok {
+		return fr.Release(ctx)
+	}
+	return fs.OK
+}
+
+var _ = (fs.NodeReader)((*bindNode)(nil))
+
+func (n *bindNode) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if errno := n.root.ofs.policy.check(ctx, OpRead, n.mountPath("")); errno != fs.OK {
+		return nil, errno
+	}
+	fr, ok := fh.(fs.FileReader)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	return fr.Read(ctx, dest, off)
+}
+
+var _ = (fs.NodeCreater)((*bindNode)(nil))
+
+func (n *bindNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	errno := n.root.ofs.policy.check(ctx, OpCreate, n.mountPath(name))
+	if errno == fs.OK {
+		errno = n.access(ctx, n.path(), unixWOK|unixXOK)
+	}
+	if errno != fs.OK {
+		n.root.ofs.audit.record(ctx, "create", n.mountPath(name), "", errno)
+		return nil, nil, 0, errno
+	}
+	if !n.root.ofs.handles.acquire() {
+		return nil, nil, 0, syscall.EIO
+	}
+	flags = flags &^ syscall.O_APPEND
+	p := filepath.Join(n.path(), name)
+	fd, err := syscall.Open(p, int(flags)|os.O_CREATE|os.O_EXCL, mode&^n.root.ofs.umask)
+	if err == nil {
+		if err = n.created(ctx, p, false); err != nil {
+			syscall.Close(fd)
+		}
+	} else if err == syscall.EEXIST && flags&syscall.O_EXCL == 0 {
+		// the entry appeared on the host after the kernel looked it up:
+		// it is opened as it is rather than taken over
+		fd, err = n.openHost(ctx, p, flags)
+	}
+	n.root.ofs.audit.record(ctx, "create", n.mountPath(name), "", fs.ToErrno(err))
+	if err != nil {
+		n.root.ofs.handles.release()
+		return nil, nil, 0, fs.ToErrno(err)
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		n.root.ofs.handles.release()
+		return nil, nil, 0, fs.ToErrno(err)
+	}
+	out.FromStat(&st)
+	return n.newChild(ctx, &st), fs.NewLoopbackFile(fd), 0, fs.OK
+}
+
+// openHost opens the existing host file at p for the caller, if its
+// permissions allow.
+func (n *bindNode) openHost(ctx context.Context, p string, flags uint32) (int, error) {
+	mask := openMask(flags)
+	if flags&syscall.O_TRUNC != 0 {
+		mask |= unixWOK
+	}
+	if errno := n.access(ctx, p, mask); errno != fs.OK {
+		return -1, errno
+	}
+	return syscall.Open(p, int(flags&^syscall.O_CREAT)|syscall.O_NOFOLLOW, 0)
+}
+
+var _ = (fs.NodeMkdirer)((*bindNode)(nil))
+
+func (n *bindNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	errno := n.root.ofs.policy.check(ctx, OpMkdir, n.mountPath(name))
+	if errno == fs.OK {
+		errno = n.access(ctx, n.path(), unixWOK|unixXOK)
+	}
+	if errno != fs.OK {
+		n.root.ofs.audit.record(ctx, "mkdir", n.mountPath(name), "", errno)
+		return nil, errno
+	}
+	p := filepath.Join(n.path(), name)
+	err := syscall.Mkdir(p, mode&^n.root.ofs.umask)
+	if err == nil {
+		err = n.created(ctx, p, true)
+	}
+	n.root.ofs.audit.record(ctx, "mkdir", n.mountPath(name), "", fs.ToErrno(err))
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(p, &st); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	out.Attr.FromStat(&st)
+	return n.newChild(ctx, &st), fs.OK
+}
+
+var _ = (fs.NodeSymlinker)((*bindNode)(nil))
+
+func (n *bindNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	errno := n.root.ofs.policy.check(ctx, OpSymlink, n.mountPath(name))
+	if errno == fs.OK {
+		errno = n.access(ctx, n.path(), unixWOK|unixXOK)
+	}
+	if errno != fs.OK {
+		n.root.ofs.audit.record(ctx, "symlink", n.mountPath(name), "", errno)
+		return nil, errno
+	}
+	p := filepath.Join(n.path(), name)
+	err := syscall.Symlink(target, p)
+	if err == nil {
+		err = n.created(ctx, p, false)
+	}
+	n.root.ofs.audit.record(ctx, "symlink", n.mountPath(name), "", fs.ToErrno(err))
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(p, &st); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	out.Attr.FromStat(&st)
+	return n.newChild(ctx, &st), fs.OK
+}
+
+var _ = (fs.NodeReadlinker)((*bindNode)(nil))
+
+func (n *bindNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if errno := n.root.ofs.policy.check(ctx, OpReadlink, n.mountPath("")); errno != fs.OK {
+		return nil, errno
+	}
+	target, err := os.Readlink(n.path())
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return []byte(target), fs.OK
+}
+
+var _ = (fs.NodeUnlinker)((*bindNode)(nil))
+
+func (n *bindNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	errno := n.root.ofs.policy.check(ctx, OpUnlink, n.mountPath(name))
+	if errno == fs.OK {
+		errno = n.mayRemove(ctx, name)
+	}
+	if errno == fs.OK {
+		errno = fs.ToErrno(syscall.Unlink(filepath.Join(n.path(), name)))
+	}
+	n.root.ofs.audit.record(ctx, "unlink", n.mountPath(name), "", errno)
+	return errno
+}
+
+var _ = (fs.NodeRmdirer)((*bindNode)(nil))
+
+func (n *bindNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	errno := n.root.ofs.policy.check(ctx, OpRmdir, n.mountPath(name))
+	if errno == fs.OK {
+		errno = n.mayRemove(ctx, name)
+	}
+	if errno == fs.OK {
+		errno = fs.ToErrno(syscall.Rmdir(filepath.Join(n.path(), name)))
+	}
+	n.root.ofs.audit.record(ctx, "rmdir", n.mountPath(name), "", errno)
+	return errno
+}
+
+var _ = (fs.NodeRenamer)((*bindNode)(nil))
+
+func (n *bindNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	np, ok := newParent.(*bindNode)
+	if !ok || np.root != n.root {
+		return syscall.EXDEV
+	}
+	errno := n.root.ofs.policy.check(ctx, OpRename, n.mountPath(name))
+	if errno == fs.OK {
+		errno = n.root.ofs.policy.check(ctx, OpRename, np.mountPath(newName))
+	}
+	if errno == fs.OK {
+		errno = n.mayRemove(ctx, name)
+	}
+	if errno == fs.OK {
+		errno = np.access(ctx, np.path(), unixWOK|unixXOK)
+	}
+	if _, err := os.Lstat(filepath.Join(np.path(), newName)); errno == fs.OK && err == nil {
+		errno = np.mayRemove(ctx, newName)
+	}
+	if errno == fs.OK {
+		errno = fs.ToErrno(unix.Renameat2(unix.AT_FDCWD, filepath.Join(n.path(), name), unix.AT_FDCWD, filepath.Join(np.path(), newName), uint(flags)))
+	}
+	n.root.ofs.audit.record(ctx, "rename", n.mountPath(name), np.mountPath(newName), errno)
+	return errno
+}
+
+var _ = (fs.NodeWriter)((*bindNode)(nil))
+
+func (n *bindNode) Write(ctx context.Context, fh fs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	fw, ok := fh.(fs.FileWriter)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+	if errno := n.root.ofs.policy.check(ctx, OpWrite, n.mountPath("")); errno != fs.OK {
+		n.root.ofs.audit.record(ctx, "write", n.mountPath(""), "", errno)
+		return 0, errno
+	}
+	written, errno := fw.Write(ctx, data, off)
+	n.root.ofs.audit.record(ctx, "write", n.mountPath(""), "", errno)
+	return written, errno
+}
@@ -0,0 +1,187 @@
+package ocifs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestMountBindDirPermissions(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to act as another user")
+	}
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	pushRandomImage(t, ref, 256, 1)
+
+	// other users must be able to reach the mount and the bind dir
+	base := t.TempDir()
+	for _, dir := range []string{filepath.Dir(base), base} {
+		if err := os.Chmod(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	host := filepath.Join(base, "host")
+	mnt := filepath.Join(base, "mnt")
+	for _, dir := range []string{host, mnt, filepath.Join(host, "shared")} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(host, "shared"), 0777|os.ModeSticky); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"owned", "shared/owned", "secret"} {
+		if err := os.WriteFile(filepath.Join(host, f), []byte("root"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(host, "secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := ofs.Mount(ref.String(), MountWithTargetPath(mnt), MountWithAllowOther(), MountWithBindDir(host, "/data"))
+	if errors.Is(err, ErrFUSEUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Unmount()
+
+	data := filepath.Join(mnt, "data")
+	for _, tc := range []struct {
+		script string
+		denied bool
+	}{
+		{"cat " + data + "/owned", false},
+		{"cat " + data + "/secret", true},
+		{"echo x > " + data + "/new", true},
+		{"echo x > " + data + "/owned", true},
+		{"rm -f " + data + "/owned", true},
+		{"mkdir " + data + "/dir", true},
+		{"chmod 666 " + data + "/owned", true},
+		{"mv " + data + "/owned " + data + "/shared/moved", true},
+		{"echo x > " + data + "/shared/mine", false},
+		{"rm -f " + data + "/shared/owned", true},
+		{"rm -f " + data + "/shared/mine", false},
+	} {
+		cmd := exec.Command("/bin/sh", "-c", tc.script)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+		out, err := cmd.CombinedOutput()
+		if denied := err != nil; denied != tc.denied {
+			t.Errorf("%s as nobody: denied %v, want %v: %s", tc.script, denied, tc.denied, out)
+		} else if denied && !strings.Contains(string(out), "ermission denied") && !strings.Contains(string(out), "not permitted") {
+			t.Errorf("%s as nobody failed with %s, want EACCES", tc.script, out)
+		}
+	}
+	for _, f := range []string{"owned", "shared/owned"} {
+		if b, err := os.ReadFile(filepath.Join(host, f)); err != nil || string(b) != "root" {
+			t.Errorf("host file %s: %q, %v, want it untouched", f, b, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(host, "new")); err == nil {
+		t.Error("file created in the bind dir by a user without write access")
+	}
+}
+
+func TestBindCreateExisting(t *testing.T) {
+	host := t.TempDir()
+	existing := filepath.Join(host, "existing")
+	if err := os.WriteFile(existing, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Lstat(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// taking the file over would give it to this owner
+	root := newBindRoot(host, &ociFS{owner: &fileOwner{uid: -2, gid: -2}, handles: &handleTracker{}})
+	fs.NewNodeFS(root, &fs.Options{})
+
+	// as when the kernel has a stale negative entry for the name
+	_, fh, _, errno := root.Create(context.Background(), "existing", syscall.O_WRONLY, 0600, &fuse.EntryOut{})
+	if errno != fs.OK {
+		t.Fatalf("create of existing file: %v", errno)
+	}
+	root.Release(context.Background(), fh)
+	after, err := os.Lstat(existing)
+	if err != nil {
+		t.Fatalf("existing file removed: %v", err)
+	}
+	uid, wantUID := after.Sys().(*syscall.Stat_t).Uid, before.Sys().(*syscall.Stat_t).Uid
+	if !os.SameFile(before, after) || after.Mode() != before.Mode() || uid != wantUID {
+		t.Errorf("existing file taken over: mode %v and owner %d, want %v and %d", after.Mode(), uid, before.Mode(), wantUID)
+	}
+	if b, _ := os.ReadFile(existing); string(b) != "keep" {
+		t.Errorf("content %q, want it kept", b)
+	}
+
+	if _, _, _, errno := root.Create(context.Background(), "existing", syscall.O_WRONLY|syscall.O_EXCL, 0600, &fuse.EntryOut{}); errno != syscall.EEXIST {
+		t.Errorf("exclusive create of existing file: %v, want EEXIST", errno)
+	}
+}
+
+func TestShutdownWaitsForBindHandles(t *testing.T) {
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	pushRandomImage(t, ref, 256, 1)
+
+	host := t.TempDir()
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := ofs.Mount(ref.String(), MountWithTargetPath(t.TempDir()), MountWithBindDir(host, "/data"))
+	if errors.Is(err, ErrFUSEUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Unmount()
+
+	f, err := os.Create(filepath.Join(im.MountPoint(), "data", "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("written"); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- im.Shutdown(context.Background()) }()
+	select {
+	case err := <-done:
+		f.Close()
+		t.Fatalf("Shutdown returned %v with a bind dir file open", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return once the file was closed")
+	}
+	if b, err := os.ReadFile(filepath.Join(host, "out")); err != nil || string(b) != "written" {
+		t.Errorf("host file = %q, %v, want the write kept", b, err)
+	}
+}
@@ -0,0 +1,155 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Checkout materializes the unified view of the image into dir, which must
+// not exist or be empty. Regular files are hardlinked to the unpacked layers
+// in the store rather than copied, falling back to a copy when dir is on
+// another filesystem. Linked files share their inode with the store, so they
+// must not be modified, and take the permission bits recorded in the image,
+// without setuid and setgid and always readable by their owner. Devices and
+// fifos are skipped.
+func (i *Image) Checkout(dir string) error {
+	if err := checkoutTarget(dir); err != nil {
+		return err
+	}
+
+	f := i.imageFS()
+	type dirTimes struct {
+		path  string
+		mode  os.FileMode
+		mtime time.Time
+	}
+	dirs := []dirTimes{}
+
+	var walkErr error
+	i.ut.TraverseAll(func(n *unifiedTreeNode, p string) bool {
+		hdr := n.Header()
+		target := filepath.Join(dir, filepath.FromSlash(p))
+		if hdr == nil {
+			// a directory no layer has an entry for
+			if err := os.MkdirAll(target, 0755); err != nil {
+				walkErr = err
+				return false
+			}
+			return true
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			walkErr = err
+			return false
+		}
+
+		var err error
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.Mkdir(target, 0755); errors.Is(err, os.ErrExist) {
+				err = nil
+			}
+			mode := os.FileMode(hdr.Mode) & os.ModePerm
+			if hdr.Mode&syscall.S_ISVTX != 0 {
+				mode |= os.ModeSticky
+			}
+			dirs = append(dirs, dirTimes{target, mode, hdr.ModTime})
+
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, target)
+
+		case tar.TypeReg, tar.TypeLink:
+			backing := n
+			if hdr.Typeflag == tar.TypeLink {
+				if backing, err = f.hardlinkTarget(n); err != nil {
+					slog.Debug("Missing link", "path", hdr.Linkname, "filepath", p)
+					return true
+				}
+			}
+			err = linkOrCopy(backing.Path(), target, backing.Header())
+
+		default:
+			slog.Debug("checkout: skipping special file", "path", p, "type", hdr.Typeflag)
+			return true
+		}
+
+		if err != nil {
+			walkErr = fmt.Errorf("checkout %s: %w", p, err)
+			return false
+		}
+		return true
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+
+	// directories last, children first, so read-only modes and mtimes are
+	// not undone by filling them
+	for j := len(dirs) - 1; j >= 0; j-- {
+		d := dirs[j]
+		if err := os.Chmod(d.path, d.mode|0700); err != nil {
+			return err
+		}
+		if err := os.Chtimes(d.path, d.mtime, d.mtime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkoutTarget creates dir, or checks that it is an empty directory.
+func checkoutTarget(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return os.MkdirAll(dir, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("checkout target %s is not empty", dir)
+	}
+	return nil
+}
+
+// linkOrCopy hardlinks src to dst, copying it if they are on different
+// filesystems, and applies the permission bits of hdr.
+func linkOrCopy(src, dst string, hdr *tar.Header) error {
+	err := os.Link(src, dst)
+	if errors.Is(err, syscall.EXDEV) {
+		err = copyFile(src, dst)
+	}
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(hdr.Mode)&os.ModePerm | 0400
+	if err := os.Chmod(dst, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, hdr.ModTime, hdr.ModTime)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/greatliontech/ocifs"
+	"github.com/spf13/cobra"
+)
+
+var checkoutCmd = &cobra.Command{
+	Use:   "checkout <ref> <dir>",
+	Short: "materializes an image into a directory without mounting it",
+	Long: "Pulls the image if needed and recreates its filesystem in dir, which must\n" +
+		"not exist or be empty. Files are hardlinks to the unpacked layers in the\n" +
+		"work directory, so no data is copied when both are on the same filesystem.\n" +
+		"The files are shared with the work directory and must not be modified.",
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: completeFirstRef,
+	RunE:              checkoutCmdRunE,
+}
+
+func checkoutCmdRunE(cmd *cobra.Command, args []string) error {
+	ofs, err := ocifs.New(append(storeOptions(), ocifs.WithEnableDefaultKeychain())...)
+	if err != nil {
+		return err
+	}
+
+	img, err := ofs.Image(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := img.Checkout(args[1]); err != nil {
+		return err
+	}
+	if jsonOutput() {
+		return writeJSON(cmd.OutOrStdout(), map[string]string{"image": args[0], "digest": img.Digest().String(), "dir": args[1]})
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/greatliontech/ocifs"
+	"github.com/spf13/cobra"
+)
+
+// completeRefs suggests the image references already pulled into the work
+// directory. It never contacts a registry, so completion stays instant.
+func completeRefs(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	ofs, err := ocifs.New(storeOptions()...)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	refs, err := ofs.Refs()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	matches := []string{}
+	for _, ref := range refs {
+		if strings.HasPrefix(ref, toComplete) {
+			matches = append(matches, ref)
+		}
+	}
+	return matches, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeFirstRef completes the image reference of commands taking it as
+// their first argument, leaving the rest to the shell.
+func completeFirstRef(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+	return completeRefs(cmd, args, toComplete)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/greatliontech/ocifs"
+	"github.com/spf13/cobra"
+)
+
+var envCmd = &cobra.Command{
+	Use:   "env <ref>",
+	Short: "prints the environment of an image",
+	Long: "Pulls the image if needed and prints the Env of its config as a file that\n" +
+		"shells can source, or as a JSON object with --output json.",
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeFirstRef,
+	RunE:              envCmdRunE,
+}
+
+func envCmdRunE(cmd *cobra.Command, args []string) error {
+	ofs, err := ocifs.New(append(storeOptions(), ocifs.WithEnableDefaultKeychain())...)
+	if err != nil {
+		return err
+	}
+	img, err := ofs.Image(args[0])
+	if err != nil {
+		return err
+	}
+
+	if !jsonOutput() {
+		return img.WriteEnv(cmd.OutOrStdout())
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return err
+	}
+	env := map[string]string{}
+	for _, kv := range cfg.Config.Env {
+		name, value, _ := strings.Cut(kv, "=")
+		env[name] = value
+	}
+	return writeJSON(cmd.OutOrStdout(), env)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/greatliontech/ocifs"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+var execCmd = &cobra.Command{
+	Use:   "exec <mountpoint> [-- command [args...]]",
+	Short: "runs a command in a mounted image",
+	Long: "Runs a command chrooted into an ocifs mount, in a private mount namespace\n" +
+		"with /proc and /dev of the host bound into it, as the user and in the\n" +
+		"working directory of the image, with its environment. The command defaults\n" +
+		"to the entrypoint and command of the image. This is meant for debugging\n" +
+		"images, not as a container runtime: there is no other isolation. It needs\n" +
+		"root, and mounts made with --allow-other for image users other than root.",
+	Args: cobra.MinimumNArgs(1),
+	RunE: execCmdRunE,
+
+	SilenceErrors: true,
+	SilenceUsage:  true,
+}
+
+type execCmdFlags struct {
+	User string
+}
+
+var execFlags = &execCmdFlags{}
+
+// exitStatus is the status the command run by exec exited with, for the
+// CLI to exit with too.
+type exitStatus int
+
+func (s exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(s))
+}
+
+func execCmdRunE(cmd *cobra.Command, args []string) error {
+	mountPoint, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	ofs, err := ocifs.New(storeOptions()...)
+	if err != nil {
+		return err
+	}
+	img, err := ofs.MountedImage(mountPoint)
+	if err != nil {
+		return err
+	}
+
+	// flags are not parsed after the mount point, which leaves the dash
+	// separating the command in args
+	command := args[1:]
+	if len(command) > 0 && command[0] == "--" {
+		command = command[1:]
+	}
+	var opts []ocifs.CommandOption
+	if len(command) > 0 {
+		opts = append(opts, ocifs.CommandWithEntrypoint(command...))
+	}
+	c, err := img.Command(opts...)
+	if err != nil {
+		return err
+	}
+	if execFlags.User != "" {
+		c.User = execFlags.User
+	}
+	cred, err := c.Credential(img.FS())
+	if err != nil {
+		return err
+	}
+	path, err := c.LookPath(img.FS())
+	if err != nil {
+		return err
+	}
+
+	// the thread stays locked, and so is never reused, once it has left the
+	// mount namespace of the process
+	runtime.LockOSThread()
+	if err := enterMountNamespace(mountPoint); err != nil {
+		return err
+	}
+
+	proc := &exec.Cmd{
+		Path:   path,
+		Args:   c.Args,
+		Env:    c.Env,
+		Dir:    c.WorkingDir,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		SysProcAttr: &syscall.SysProcAttr{
+			Chroot:     mountPoint,
+			Credential: cred,
+		},
+	}
+	if err := proc.Start(); err != nil {
+		if errors.Is(err, fs.ErrPermission) && cred.Uid != 0 {
+			return fmt.Errorf("%w: mounts are only accessible to other users with --allow-other", err)
+		}
+		return err
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range sigs {
+			proc.Process.Signal(sig)
+		}
+	}()
+
+	err = proc.Wait()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return exitStatus(128 + int(ws.Signal()))
+	}
+	return exitStatus(exitErr.ExitCode())
+}
+
+// enterMountNamespace moves the calling thread to a private mount namespace
+// and binds /proc and /dev of the host into the mount, where the image has
+// those directories.
+func enterMountNamespace(mountPoint string) error {
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		return fmt.Errorf("unshare mount namespace: %w", err)
+	}
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make mounts private: %w", err)
+	}
+	for _, dir := range []string{"/proc", "/dev"} {
+		target := filepath.Join(mountPoint, dir)
+		if fi, err := os.Lstat(target); err != nil || !fi.IsDir() {
+			slog.Warn("not binding into the mount", "dir", dir, "error", err)
+			continue
+		}
+		if err := unix.Mount(dir, target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind %s: %w", dir, err)
+		}
+	}
+	return nil
+}
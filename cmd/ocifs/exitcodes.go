@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/greatliontech/ocifs"
+)
+
+// Exit codes of the CLI, so scripts and service managers can tell failures
+// apart. Any other failure exits with exitFailure.
+const (
+	exitFailure         = 1
+	exitAuth            = 10
+	exitNotFound        = 11
+	exitMountPointBusy  = 12
+	exitFUSEUnavailable = 13
+	exitPolicyRejected  = 14
+)
+
+const exitCodesHelp = `Exit codes:
+  1   failure
+  10  registry authentication failed or access denied
+  11  image not found
+  12  mount point busy
+  13  FUSE unavailable
+  14  image rejected by policy`
+
+// exitCode returns the exit code for err.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, ocifs.ErrNotAdmitted), errors.Is(err, ocifs.ErrWindowsImage):
+		return exitPolicyRejected
+	case errors.Is(err, ocifs.ErrMountPointBusy):
+		return exitMountPointBusy
+	case errors.Is(err, ocifs.ErrFUSEUnavailable):
+		return exitFUSEUnavailable
+	}
+
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return exitFailure
+	}
+	switch terr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return exitAuth
+	case http.StatusNotFound:
+		return exitNotFound
+	}
+	for _, d := range terr.Errors {
+		switch d.Code {
+		case transport.UnauthorizedErrorCode, transport.DeniedErrorCode:
+			return exitAuth
+		case transport.ManifestUnknownErrorCode, transport.NameUnknownErrorCode:
+			return exitNotFound
+		}
+	}
+	return exitFailure
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/greatliontech/ocifs"
+	"github.com/spf13/cobra"
+)
+
+var importCmd = &cobra.Command{
+	Use:   "import [archive]",
+	Short: "stores an image from a docker save or OCI layout archive",
+	Long: "Stores the image in archive, or read from stdin when it is - or omitted,\n" +
+		"and prints its digest, which can be mounted with --image.",
+	Args: cobra.MaximumNArgs(1),
+	RunE: importCmdRunE,
+}
+
+func importCmdRunE(cmd *cobra.Command, args []string) error {
+	var r io.Reader = cmd.InOrStdin()
+	if len(args) > 0 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	ofs, err := ocifs.New(storeOptions()...)
+	if err != nil {
+		return err
+	}
+	h, err := ofs.ImportArchive(r)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		return writeJSON(cmd.OutOrStdout(), map[string]string{"digest": h.String()})
+	}
+	fmt.Fprintln(cmd.OutOrStdout(), h)
+	return nil
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/greatliontech/ocifs"
 	"github.com/spf13/cobra"
 )
@@ -15,14 +20,46 @@ import (
 var rootCmd = &cobra.Command{
 	Use:   "ocifs",
 	Short: "mounts an OCI image as a filesystem",
+	Long:  "Mounts an OCI image as a filesystem.\n\n" + exitCodesHelp,
 	RunE:  rootCmdRunE,
+
+	PersistentPreRunE: checkFlags,
 }
 
 type rootCmdFlags struct {
 	MountPoint string
 	ImageRef   string
 	WorkDir    string
+	LayoutDir  string
+	UnpackDir  string
+	MountDir   string
+	RateLimit  int64
+	Output     string
+	Windows    bool
+	Containerd string
+	Storage    string
+	Platform   string
+	IndexAnnot []string
+	NoForeign  bool
+	Timeout    time.Duration
+	UserAgent  string
+	Headers    []string
+	Addresses  []string
+	DNSServer  string
 	ExtraDirs  []string
+	BindDirs   []string
+	HealthAddr string
+	Remount    bool
+	Takeover   bool
+	CreateDir  bool
+	AllowOther bool
+	Verify     bool
+	NormAttrs  string
+	DateEpoch  int64
+	RootAttr   string
+	FUSEHelper string
+	FsName     string
+	DebugAddr  string
 }
 
 var rootFlags = &rootCmdFlags{}
@@ -31,38 +68,141 @@ func main() {
 	// bind command-line flags
 	rootCmd.Flags().StringVarP(&rootFlags.MountPoint, "mountpoint", "m", "", "Directory to mount OCI image")
 	rootCmd.MarkFlagRequired("mountpoint")
-	rootCmd.Flags().StringVarP(&rootFlags.ImageRef, "image", "i", "", "Image to mount")
+	rootCmd.Flags().StringVarP(&rootFlags.ImageRef, "image", "i", "", "Image to mount, a registry reference, oci:<layout>[:tag], docker-archive:<tar>[:ref], docker-daemon:<name> or containers-storage:<name>")
 	rootCmd.MarkFlagRequired("image")
-	rootCmd.Flags().StringVarP(&rootFlags.WorkDir, "workdir", "w", filepath.Join(os.TempDir(), "ocifs"), "Work directory")
-	extraDirs := rootCmd.Flags().StringSliceP("extra-dirs", "e", nil, "Extra directories to include in the mount")
-	if extraDirs != nil {
-		rootFlags.ExtraDirs = *extraDirs
-	}
+	rootCmd.RegisterFlagCompletionFunc("image", completeRefs)
+	rootCmd.PersistentFlags().StringVarP(&rootFlags.WorkDir, "workdir", "w", "", "Work directory (default "+ocifs.DefaultWorkDir()+")")
+	rootCmd.PersistentFlags().StringVar(&rootFlags.LayoutDir, "layout-dir", "", "OCI layout directory for blobs and refs (default <workdir> if --workdir is given, else "+ocifs.DefaultLayoutDir()+")")
+	rootCmd.PersistentFlags().StringVar(&rootFlags.UnpackDir, "unpack-dir", "", "Directory for unpacked layers (default <workdir>/unpacked)")
+	rootCmd.PersistentFlags().Int64Var(&rootFlags.RateLimit, "limit-rate", 0, "Maximum download rate from registries in bytes per second (0 for no limit)")
+	rootCmd.PersistentFlags().StringVarP(&rootFlags.Output, "output", "o", outputText, "Output format of commands, text or json")
+	rootCmd.PersistentFlags().BoolVar(&rootFlags.Windows, "windows-layers", false, "Allow images built for Windows, serving the filesystem of their layers for inspection")
+	rootCmd.PersistentFlags().StringVar(&rootFlags.Containerd, "containerd-root", "", "Copy layers already in the content store of the containerd with this state directory, such as "+ocifs.DefaultContainerdRoot+", instead of downloading them")
+	rootCmd.PersistentFlags().StringVar(&rootFlags.Storage, "containers-storage", ocifs.DefaultContainersStorage, "Graph root of the podman and buildah storage read for containers-storage: images")
+	rootCmd.PersistentFlags().StringVar(&rootFlags.Platform, "platform", "", "Platform to pick from image indexes, as os/arch[/variant] (default linux on the host architecture)")
+	rootCmd.PersistentFlags().StringSliceVar(&rootFlags.IndexAnnot, "index-annotation", nil, "Pick the image with this annotation from image indexes, as key=value")
+	rootCmd.PersistentFlags().BoolVar(&rootFlags.NoForeign, "ignore-foreign-layers", false, "Leave out foreign layers served from URLs outside the registry, such as Windows base layers")
+	rootCmd.PersistentFlags().DurationVar(&rootFlags.Timeout, "registry-timeout", 0, "Timeout for connecting to registries and waiting for their responses (0 for none)")
+	rootCmd.PersistentFlags().StringVar(&rootFlags.UserAgent, "user-agent", "", "User agent to identify as to registries")
+	rootCmd.PersistentFlags().StringArrayVar(&rootFlags.Headers, "registry-header", nil, "Header to send to a registry, as registry=Name: value")
+	rootCmd.PersistentFlags().StringArrayVar(&rootFlags.Addresses, "registry-address", nil, "Connect to a registry at fixed addresses instead of resolving it, as registry=addr[,addr...]")
+	rootCmd.PersistentFlags().StringVar(&rootFlags.DNSServer, "dns-server", "", "DNS server to resolve registries with instead of the system resolver")
+	rootCmd.PersistentFlags().StringVar(&rootFlags.MountDir, "mount-dir", "", "Directory for generated mount points (default <workdir>/mounts)")
+	rootCmd.Flags().StringSliceVarP(&rootFlags.ExtraDirs, "extra-dirs", "e", nil, "Extra directories to include in the mount")
+	rootCmd.Flags().StringSliceVarP(&rootFlags.BindDirs, "bind", "b", nil, "Host directories to pass through, as hostpath:mountpath")
+	rootCmd.Flags().StringVar(&rootFlags.DebugAddr, "debug-listen", "", "Address to serve pprof profiles and runtime stats on, at /debug/ (disabled by default)")
+	rootCmd.Flags().BoolVar(&rootFlags.Remount, "auto-remount", false, "Remount when the mount fails, checking its health every 10s")
+	rootCmd.Flags().BoolVar(&rootFlags.Takeover, "force-takeover", false, "Detach an ocifs mount left at the mount point, such as a stale one, instead of failing")
+	rootCmd.Flags().StringVar(&rootFlags.FUSEHelper, "fuse-helper", string(ocifs.FUSEHelperAuto), "How to mount: direct (mount(2), needs CAP_SYS_ADMIN), fusermount, or auto to try direct first")
+	rootCmd.Flags().StringVar(&rootFlags.FsName, "fs-name", "", "Source shown for the mount by findmnt (default <image>@<digest>)")
+	rootCmd.Flags().BoolVar(&rootFlags.CreateDir, "create-mountpoint", false, "Create the mount point and its parents if missing, removing them after unmounting")
+	rootCmd.Flags().BoolVar(&rootFlags.AllowOther, "allow-other", false, "Let users other than the one mounting access the mount, such as with exec")
+	rootCmd.Flags().BoolVar(&rootFlags.Verify, "verified-reads", false, "Check each file against the digest recorded when unpacking it on first open, failing with EIO when the store was modified")
+	rootCmd.Flags().StringVar(&rootFlags.NormAttrs, "normalize-attrs", "", "Report this owner and time for every entry of the image, as epoch:uid:gid with the time in seconds since the Unix epoch")
+	rootCmd.Flags().Int64Var(&rootFlags.DateEpoch, "source-date-epoch", 0, "Clamp modification times later than this time, in seconds since the Unix epoch, down to it")
+	rootCmd.Flags().StringVar(&rootFlags.RootAttr, "root-attr", "", "Report these permissions and owner for the root of the mount, as mode:uid:gid with the mode in octal")
+	rootCmd.Flags().StringVar(&rootFlags.HealthAddr, "health-listen", "", "Address to serve the health of the mount on, at /healthz")
+
+	serveHTTPCmd.Flags().StringVarP(&serveHTTPFlags.Listen, "listen", "l", ":8080", "Address to listen on")
+	rootCmd.AddCommand(serveHTTPCmd)
+
+	prefetchCmd.Flags().StringVarP(&prefetchFlags.File, "file", "f", "", "File listing one image reference per line")
+	prefetchCmd.MarkFlagRequired("file")
+	prefetchCmd.Flags().IntVarP(&prefetchFlags.Concurrency, "concurrency", "c", 4, "Number of images to pull in parallel")
+	rootCmd.AddCommand(prefetchCmd)
+
+	rootCmd.AddCommand(migrateCmd)
+	rootCmd.AddCommand(checkoutCmd)
+	rootCmd.AddCommand(importCmd)
+	rootCmd.AddCommand(sweepCmd)
+	rootCmd.AddCommand(envCmd)
+
+	execCmd.Flags().StringVarP(&execFlags.User, "user", "u", "", "User to run as instead of that of the image, as name, uid, name:group or uid:gid")
+	execCmd.Flags().SetInterspersed(false)
+	rootCmd.AddCommand(execCmd)
 
 	if err := rootCmd.Execute(); err != nil {
+		var status exitStatus
+		if errors.As(err, &status) {
+			os.Exit(int(status))
+		}
 		slog.Error("Failed to execute", "error", err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 }
 
 func rootCmdRunE(cmd *cobra.Command, args []string) error {
-	opts := []ocifs.Option{
-		ocifs.WithWorkDir(rootFlags.WorkDir),
-		ocifs.WithEnableDefaultKeychain(),
-	}
+	opts := append(storeOptions(), ocifs.WithEnableDefaultKeychain())
 	if len(rootFlags.ExtraDirs) > 0 {
 		opts = append(opts, ocifs.WithExtraDirs(rootFlags.ExtraDirs))
 	}
+	if rootFlags.Remount {
+		opts = append(opts, ocifs.WithAutoRemount(ocifs.RemountPolicy{Interval: 10 * time.Second}))
+	}
 
 	ofs, err := ocifs.New(opts...)
 	if err != nil {
 		return err
 	}
 
+	mountOpts := []ocifs.MountOption{
+		ocifs.MountWithTargetPath(rootFlags.MountPoint),
+	}
+	for _, b := range rootFlags.BindDirs {
+		hostPath, mountPath, ok := strings.Cut(b, ":")
+		if !ok {
+			return fmt.Errorf("invalid bind %q, expected hostpath:mountpath", b)
+		}
+		mountOpts = append(mountOpts, ocifs.MountWithBindDir(hostPath, mountPath))
+	}
+	if rootFlags.Takeover {
+		mountOpts = append(mountOpts, ocifs.MountWithTakeover())
+	}
+	if rootFlags.FUSEHelper != "" {
+		mountOpts = append(mountOpts, ocifs.MountWithFUSEHelper(ocifs.FUSEHelper(rootFlags.FUSEHelper)))
+	}
+	if rootFlags.FsName != "" {
+		mountOpts = append(mountOpts, ocifs.MountWithFsName(rootFlags.FsName))
+	}
+	if rootFlags.CreateDir {
+		mountOpts = append(mountOpts, ocifs.MountWithCreateMountpoint(0755))
+	}
+	if rootFlags.AllowOther {
+		mountOpts = append(mountOpts, ocifs.MountWithAllowOther())
+	}
+	if rootFlags.Verify {
+		mountOpts = append(mountOpts, ocifs.MountWithVerifiedReads())
+	}
+	if rootFlags.NormAttrs != "" {
+		epoch, uid, gid, err := parseNormalizedAttrs(rootFlags.NormAttrs)
+		if err != nil {
+			return err
+		}
+		mountOpts = append(mountOpts, ocifs.MountWithNormalizedAttrs(epoch, uid, gid))
+	}
+	if cmd.Flags().Changed("source-date-epoch") {
+		mountOpts = append(mountOpts, ocifs.MountWithSourceDateEpoch(time.Unix(rootFlags.DateEpoch, 0)))
+	}
+	if rootFlags.RootAttr != "" {
+		mode, uid, gid, err := parseRootAttr(rootFlags.RootAttr)
+		if err != nil {
+			return err
+		}
+		mountOpts = append(mountOpts, ocifs.MountWithRootAttr(mode, uid, gid))
+	}
+
 	// Mount the OCI image
-	im, err := ofs.Mount(rootFlags.ImageRef, ocifs.MountWithTargetPath(rootFlags.MountPoint))
+	im, err := ofs.Mount(rootFlags.ImageRef, mountOpts...)
 	if err != nil {
-		log.Fatalf("Failed to mount OciFS: %v", err)
+		return fmt.Errorf("mount %s: %w", rootFlags.ImageRef, err)
+	}
+	if report, err := im.Report(); err != nil {
+		slog.Warn("Failed to build mount report", "error", err)
+	} else if jsonOutput() {
+		writeJSON(os.Stdout, report)
+	} else {
+		slog.Info("Mounted", "image", report.ImageRef, "digest", report.Digest, "layers", report.Layers,
+			"downloaded", report.BytesDownloaded, "cached", report.BytesCached, "unpackTime", report.UnpackTime, "files", report.Files)
 	}
 
 	sigtermHandler := func() chan os.Signal {
@@ -81,8 +221,173 @@ func rootCmdRunE(cmd *cobra.Command, args []string) error {
 		}
 	}()
 
+	if rootFlags.HealthAddr != "" {
+		go serveHealth(rootFlags.HealthAddr, im)
+	}
+	if rootFlags.DebugAddr != "" {
+		go serveDebug(rootFlags.DebugAddr)
+	}
+
 	// Serve the filesystem until unmounted
 	im.Wait()
 
 	return nil
 }
+
+// parseNormalizedAttrs parses the epoch:uid:gid of --normalize-attrs.
+func parseNormalizedAttrs(s string) (time.Time, uint32, uint32, error) {
+	invalid := fmt.Errorf("invalid normalized attributes %q, expected epoch:uid:gid", s)
+	fields := strings.Split(s, ":")
+	if len(fields) != 3 {
+		return time.Time{}, 0, 0, invalid
+	}
+	epoch, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, 0, invalid
+	}
+	uid, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return time.Time{}, 0, 0, invalid
+	}
+	gid, err := strconv.ParseUint(fields[2], 10, 32)
+	if err != nil {
+		return time.Time{}, 0, 0, invalid
+	}
+	return time.Unix(epoch, 0), uint32(uid), uint32(gid), nil
+}
+
+// parseRootAttr parses the mode:uid:gid of --root-attr.
+func parseRootAttr(s string) (os.FileMode, uint32, uint32, error) {
+	invalid := fmt.Errorf("invalid root attributes %q, expected mode:uid:gid", s)
+	fields := strings.Split(s, ":")
+	if len(fields) != 3 {
+		return 0, 0, 0, invalid
+	}
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, 0, 0, invalid
+	}
+	uid, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return 0, 0, 0, invalid
+	}
+	gid, err := strconv.ParseUint(fields[2], 10, 32)
+	if err != nil {
+		return 0, 0, 0, invalid
+	}
+	return os.FileMode(mode), uint32(uid), uint32(gid), nil
+}
+
+// serveHealth answers /healthz with 200 while the mount is healthy and 503
+// otherwise, for liveness probes.
+func serveHealth(addr string, im *ocifs.ImageMount) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := im.Healthy(); err != nil {
+			slog.Warn("mount unhealthy", "error", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("Failed to serve health", "error", err)
+	}
+}
+
+// storeOptions returns the options locating the store and shaping registry
+// traffic, from the persistent flags shared by all commands.
+func storeOptions() []ocifs.Option {
+	var opts []ocifs.Option
+	if rootFlags.WorkDir != "" {
+		opts = append(opts, ocifs.WithWorkDir(rootFlags.WorkDir))
+	}
+	if rootFlags.LayoutDir != "" {
+		opts = append(opts, ocifs.WithLayoutDir(rootFlags.LayoutDir))
+	}
+	if rootFlags.UnpackDir != "" {
+		opts = append(opts, ocifs.WithUnpackDir(rootFlags.UnpackDir))
+	}
+	if rootFlags.MountDir != "" {
+		opts = append(opts, ocifs.WithMountDir(rootFlags.MountDir))
+	}
+	if rootFlags.RateLimit > 0 {
+		opts = append(opts, ocifs.WithBandwidthLimit(rootFlags.RateLimit))
+	}
+	if rootFlags.Windows {
+		opts = append(opts, ocifs.WithWindowsLayers())
+	}
+	if rootFlags.Storage != ocifs.DefaultContainersStorage {
+		opts = append(opts, ocifs.WithContainersStorage(rootFlags.Storage))
+	}
+	if rootFlags.Containerd != "" {
+		opts = append(opts, ocifs.WithContainerdContent(rootFlags.Containerd))
+	}
+	if rootFlags.Timeout > 0 {
+		opts = append(opts, ocifs.WithRegistryTimeout(rootFlags.Timeout))
+	}
+	if rootFlags.UserAgent != "" {
+		opts = append(opts, ocifs.WithUserAgent(rootFlags.UserAgent))
+	}
+	for _, h := range rootFlags.Headers {
+		registry, header, _ := strings.Cut(h, "=")
+		key, value, _ := strings.Cut(header, ":")
+		opts = append(opts, ocifs.WithRegistryHeaders(registry, http.Header{
+			http.CanonicalHeaderKey(strings.TrimSpace(key)): {strings.TrimSpace(value)},
+		}))
+	}
+	for _, a := range rootFlags.Addresses {
+		registry, addrs, _ := strings.Cut(a, "=")
+		opts = append(opts, ocifs.WithRegistryAddress(registry, strings.Split(addrs, ",")...))
+	}
+	if rootFlags.DNSServer != "" {
+		opts = append(opts, ocifs.WithDNSServer(rootFlags.DNSServer))
+	}
+	if rootFlags.NoForeign {
+		opts = append(opts, ocifs.WithIgnoreForeignLayers())
+	}
+	if platform != nil {
+		opts = append(opts, ocifs.WithPlatform(*platform))
+	}
+	for _, a := range rootFlags.IndexAnnot {
+		key, value, _ := strings.Cut(a, "=")
+		opts = append(opts, ocifs.WithIndexAnnotation(key, value))
+	}
+	return opts
+}
+
+// platform is the parsed --platform flag.
+var platform *v1.Platform
+
+// checkFlags validates the global flags before any command runs.
+func checkFlags(cmd *cobra.Command, args []string) error {
+	if err := checkOutput(cmd, args); err != nil {
+		return err
+	}
+	if rootFlags.Platform != "" {
+		p, err := v1.ParsePlatform(rootFlags.Platform)
+		if err != nil {
+			return fmt.Errorf("invalid platform %q: %w", rootFlags.Platform, err)
+		}
+		platform = p
+	}
+	for _, a := range rootFlags.IndexAnnot {
+		if !strings.Contains(a, "=") {
+			return fmt.Errorf("invalid index annotation %q, expected key=value", a)
+		}
+	}
+	for _, h := range rootFlags.Headers {
+		registry, header, _ := strings.Cut(h, "=")
+		key, _, ok := strings.Cut(header, ":")
+		if registry == "" || strings.TrimSpace(key) == "" || !ok {
+			return fmt.Errorf("invalid registry header %q, expected registry=Name: value", h)
+		}
+	}
+	for _, a := range rootFlags.Addresses {
+		registry, addrs, _ := strings.Cut(a, "=")
+		if registry == "" || addrs == "" {
+			return fmt.Errorf("invalid registry address %q, expected registry=addr[,addr...]", a)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/greatliontech/ocifs"
+	"github.com/spf13/cobra"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate [old-workdir]",
+	Short: "imports the images of another work directory into the current one",
+	Long: "Imports and unpacks the images of another work directory, by default the\n" +
+		"one older versions kept in the temp dir, into the current store.\n" +
+		"The old work directory is left as is and can be removed afterwards.",
+	Args: cobra.MaximumNArgs(1),
+	RunE: migrateCmdRunE,
+}
+
+func migrateCmdRunE(cmd *cobra.Command, args []string) error {
+	from := filepath.Join(os.TempDir(), "ocifs")
+	if len(args) > 0 {
+		from = args[0]
+	}
+
+	ofs, err := ocifs.New(storeOptions()...)
+	if err != nil {
+		return err
+	}
+
+	n, err := ofs.Migrate(from)
+	if err != nil {
+		return err
+	}
+	if jsonOutput() {
+		return writeJSON(cmd.OutOrStdout(), map[string]any{"migrated": n, "from": from, "to": ofs.LayoutDir()})
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "%d images migrated from %s to %s\n", n, from, ofs.LayoutDir())
+	return nil
+}
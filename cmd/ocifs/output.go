@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// checkOutput validates the --output flag before any command runs.
+func checkOutput(cmd *cobra.Command, args []string) error {
+	switch rootFlags.Output {
+	case outputText, outputJSON:
+		return nil
+	}
+	return fmt.Errorf("invalid output format %q, expected %s or %s", rootFlags.Output, outputText, outputJSON)
+}
+
+// jsonOutput reports whether commands should print JSON.
+func jsonOutput() bool {
+	return rootFlags.Output == outputJSON
+}
+
+// writeJSON prints v as indented JSON.
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/greatliontech/ocifs"
+	"github.com/spf13/cobra"
+)
+
+var prefetchCmd = &cobra.Command{
+	Use:   "prefetch",
+	Short: "pulls and unpacks a list of images into the work directory",
+	RunE:  prefetchCmdRunE,
+}
+
+type prefetchCmdFlags struct {
+	File        string
+	Concurrency int
+}
+
+var prefetchFlags = &prefetchCmdFlags{}
+
+type prefetchResult struct {
+	ref      string
+	digest   string
+	duration time.Duration
+	err      error
+}
+
+// prefetchJSON is how a prefetchResult is printed with --output json.
+type prefetchJSON struct {
+	Image      string `json:"image"`
+	Digest     string `json:"digest,omitempty"`
+	DurationMS int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+}
+
+func prefetchCmdRunE(cmd *cobra.Command, args []string) error {
+	refs, err := readImageList(prefetchFlags.File)
+	if err != nil {
+		return err
+	}
+
+	ofs, err := ocifs.New(append(storeOptions(), ocifs.WithEnableDefaultKeychain())...)
+	if err != nil {
+		return err
+	}
+
+	results := make([]prefetchResult, len(refs))
+	sem := make(chan struct{}, max(prefetchFlags.Concurrency, 1))
+	var wg sync.WaitGroup
+	for i, ref := range refs {
+		wg.Add(1)
+		go func(i int, ref string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			start := time.Now()
+			h, err := ofs.Pull(ref)
+			results[i] = prefetchResult{ref: ref, duration: time.Since(start), err: err}
+			if err != nil {
+				slog.Error("prefetch", "image", ref, "error", err)
+				return
+			}
+			results[i].digest = h.String()
+			slog.Info("prefetched", "image", ref, "digest", h, "duration", results[i].duration)
+		}(i, ref)
+	}
+	wg.Wait()
+
+	failed := 0
+	out := cmd.OutOrStdout()
+	if jsonOutput() {
+		jr := make([]prefetchJSON, len(results))
+		for i, r := range results {
+			jr[i] = prefetchJSON{Image: r.ref, Digest: r.digest, DurationMS: r.duration.Milliseconds()}
+			if r.err != nil {
+				failed++
+				jr[i].Error = r.err.Error()
+			}
+		}
+		if err := writeJSON(out, jr); err != nil {
+			return err
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d images failed to prefetch", failed, len(results))
+		}
+		return nil
+	}
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL\t%s\t%v\n", r.ref, r.err)
+			continue
+		}
+		fmt.Fprintf(out, "OK\t%s\t%s\t%s\n", r.ref, r.digest, r.duration.Round(time.Millisecond))
+	}
+	fmt.Fprintf(out, "%d images, %d prefetched, %d failed\n", len(results), len(results)-failed, failed)
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d images failed to prefetch", failed, len(results))
+	}
+	return nil
+}
+
+// readImageList reads one image reference per line. Blank lines and
+// everything after a '#' are ignored.
+func readImageList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	refs := []string{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		refs = append(refs, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return refs, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/greatliontech/ocifs"
+	"github.com/spf13/cobra"
+)
+
+var serveHTTPCmd = &cobra.Command{
+	Use:               "serve-http <image>",
+	Short:             "serves the content of an OCI image over HTTP",
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeFirstRef,
+	RunE:              serveHTTPCmdRunE,
+}
+
+type serveHTTPCmdFlags struct {
+	Listen string
+}
+
+var serveHTTPFlags = &serveHTTPCmdFlags{}
+
+func serveHTTPCmdRunE(cmd *cobra.Command, args []string) error {
+	ofs, err := ocifs.New(append(storeOptions(), ocifs.WithEnableDefaultKeychain())...)
+	if err != nil {
+		return err
+	}
+
+	img, err := ofs.Image(args[0])
+	if err != nil {
+		return err
+	}
+
+	slog.Info("serving image", "image", args[0], "digest", img.Digest(), "listen", serveHTTPFlags.Listen)
+
+	return http.ListenAndServe(serveHTTPFlags.Listen, newETagHandler(img.FS()))
+}
+
+// etagHandler serves files from fsys, tagging regular files with the digest
+// of their content so clients can revalidate with If-None-Match. Digests
+// are those recorded when layers were unpacked, or computed on first request
+// for files without one, and cached, image content never changes.
+type etagHandler struct {
+	fsys  fs.FS
+	next  http.Handler
+	mu    sync.Mutex
+	etags map[string]string
+}
+
+func newETagHandler(fsys fs.FS) *etagHandler {
+	return &etagHandler{
+		fsys:  fsys,
+		next:  http.FileServer(http.FS(fsys)),
+		etags: make(map[string]string),
+	}
+}
+
+func (h *etagHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if name == "" {
+			name = "."
+		}
+		if etag, ok := h.etag(name); ok {
+			w.Header().Set("ETag", etag)
+		}
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func (h *etagHandler) etag(name string) (string, bool) {
+	h.mu.Lock()
+	etag, ok := h.etags[name]
+	h.mu.Unlock()
+	if ok {
+		return etag, true
+	}
+
+	fi, err := fs.Stat(h.fsys, name)
+	if err != nil || !fi.Mode().IsRegular() {
+		return "", false
+	}
+
+	sum := ""
+	if hdr, ok := fi.Sys().(*tar.Header); ok {
+		sum = hdr.PAXRecords[ocifs.ContentDigestRecord]
+	}
+	if sum == "" {
+		if sum, err = hashFile(h.fsys, name); err != nil {
+			slog.Error("hash file", "path", name, "error", err)
+			return "", false
+		}
+	}
+	etag = `"sha256:` + sum + `"`
+
+	h.mu.Lock()
+	h.etags[name] = etag
+	h.mu.Unlock()
+
+	return etag, true
+}
+
+// hashFile returns the hex encoded sha256 of the content of name.
+func hashFile(fsys fs.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/greatliontech/ocifs"
+	"github.com/spf13/cobra"
+)
+
+var sweepCmd = &cobra.Command{
+	Use:   "sweep-mounts",
+	Short: "removes mount points left in the mount dir by ocifs processes that died",
+	Long: "Removes the empty directories of the mount dir that are no longer mounted,\n" +
+		"detaching stale ocifs mounts first, and prints them.",
+	Args: cobra.NoArgs,
+	RunE: sweepCmdRunE,
+}
+
+func sweepCmdRunE(cmd *cobra.Command, args []string) error {
+	ofs, err := ocifs.New(storeOptions()...)
+	if err != nil {
+		return err
+	}
+	removed, err := ofs.SweepMountDir()
+
+	if jsonOutput() {
+		if removed == nil {
+			removed = []string{}
+		}
+		if jerr := writeJSON(cmd.OutOrStdout(), map[string][]string{"removed": removed}); jerr != nil {
+			return jerr
+		}
+		return err
+	}
+	for _, p := range removed {
+		fmt.Fprintln(cmd.OutOrStdout(), p)
+	}
+	return err
+}
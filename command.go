@@ -0,0 +1,337 @@
+package ocifs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// ErrNoCommand is returned by Command when an image has neither an
+// entrypoint nor a command and none was given.
+var ErrNoCommand = errors.New("image has no command")
+
+// Command is what a container of an image runs, resolved from its config
+// as container runtimes do.
+type Command struct {
+	// Args is the entrypoint followed by the command.
+	Args []string
+	// Env holds the environment of the image, as NAME=value.
+	Env []string
+	// User is the user to run as, as name, uid, name:group or uid:gid.
+	// It is empty when the image does not set one.
+	User string
+	// WorkingDir is the directory to run in, / when the image does not set
+	// one.
+	WorkingDir string
+}
+
+type commandConfig struct {
+	args       []string
+	entrypoint []string
+	setEntry   bool
+	expand     bool
+	vars       map[string]string
+}
+
+// CommandOption changes how the command of an image is resolved.
+type CommandOption func(*commandConfig)
+
+// CommandWithArgs replaces the command of the image with args, as the
+// arguments after the image do with docker run.
+var CommandWithArgs = func(args ...string) CommandOption {
+	return func(c *commandConfig) {
+		c.args = args
+	}
+}
+
+// CommandWithEntrypoint replaces the entrypoint of the image. As with
+// docker run --entrypoint, the command of the image is dropped too; give
+// CommandWithArgs to pass arguments.
+var CommandWithEntrypoint = func(entrypoint ...string) CommandOption {
+	return func(c *commandConfig) {
+		c.entrypoint = entrypoint
+		c.setEntry = true
+	}
+}
+
+// CommandWithExpand substitutes $NAME and ${NAME} placeholders in the
+// arguments and working dir with the variables of the image environment,
+// overridden and extended by vars, which are also added to Env.
+// Placeholders of unknown variables are left as they are.
+var CommandWithExpand = func(vars map[string]string) CommandOption {
+	return func(c *commandConfig) {
+		c.expand = true
+		c.vars = vars
+	}
+}
+
+// Command resolves what a container of the image runs.
+func (i *Image) Command(opts ...CommandOption) (*Command, error) {
+	cfg, err := i.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	return resolveCommand(cfg, opts)
+}
+
+// Command resolves what a container of the mounted image runs, see
+// Image.Command.
+func (im *ImageMount) Command(opts ...CommandOption) (*Command, error) {
+	cfg, err := im.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	return resolveCommand(cfg, opts)
+}
+
+func resolveCommand(cfg *v1.ConfigFile, opts []CommandOption) (*Command, error) {
+	var c commandConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	entrypoint, args := cfg.Config.Entrypoint, cfg.Config.Cmd
+	if c.setEntry {
+		entrypoint, args = c.entrypoint, nil
+	}
+	if c.args != nil {
+		args = c.args
+	}
+
+	cmd := &Command{
+		Args:       append(append([]string{}, entrypoint...), args...),
+		Env:        append([]string{}, cfg.Config.Env...),
+		User:       cfg.Config.User,
+		WorkingDir: cfg.Config.WorkingDir,
+	}
+	if cmd.WorkingDir == "" {
+		cmd.WorkingDir = "/"
+	}
+	if len(cmd.Args) == 0 {
+		return nil, ErrNoCommand
+	}
+	if !c.expand {
+		return cmd, nil
+	}
+
+	vars := map[string]string{}
+	for _, kv := range cmd.Env {
+		if name, value, ok := strings.Cut(kv, "="); ok {
+			vars[name] = value
+		}
+	}
+	for name, value := range c.vars {
+		if _, ok := vars[name]; ok {
+			cmd.Env = setEnv(cmd.Env, name, value)
+		} else {
+			cmd.Env = append(cmd.Env, name+"="+value)
+		}
+		vars[name] = value
+	}
+	for j, a := range cmd.Args {
+		cmd.Args[j] = expandVars(a, vars)
+	}
+	cmd.WorkingDir = expandVars(cmd.WorkingDir, vars)
+	return cmd, nil
+}
+
+// setEnv replaces the value of name in env.
+func setEnv(env []string, name, value string) []string {
+	for j, kv := range env {
+		if strings.HasPrefix(kv, name+"=") {
+			env[j] = name + "=" + value
+		}
+	}
+	return env
+}
+
+// expandVars substitutes the $NAME and ${NAME} placeholders of the variables
+// in vars, leaving everything else, including other placeholders, as is.
+func expandVars(s string, vars map[string]string) string {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+
+		name, n := "", 0
+		if strings.HasPrefix(s, "${") {
+			if end := strings.IndexByte(s, '}'); end > 0 {
+				name, n = s[2:end], end+1
+			}
+		} else {
+			n = 1
+			for n < len(s) && (s[n] == '_' || s[n] >= 'a' && s[n] <= 'z' || s[n] >= 'A' && s[n] <= 'Z' || n > 1 && s[n] >= '0' && s[n] <= '9') {
+				n++
+			}
+			name = s[1:n]
+		}
+		if v, ok := vars[name]; ok && name != "" {
+			b.WriteString(v)
+			s = s[n:]
+			continue
+		}
+		b.WriteByte('$')
+		s = s[1:]
+	}
+}
+
+// defaultPath is the PATH container runtimes use when the image sets none.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// LookPath finds the program of the command in fsys, the file system of the
+// image, searching the PATH of its environment when the first argument has
+// no slash. The path returned is absolute within the image.
+func (c *Command) LookPath(fsys iofs.FS) (string, error) {
+	file := c.Args[0]
+	if strings.Contains(file, "/") {
+		p := path.Join(path.Join("/", c.WorkingDir), file)
+		if path.IsAbs(file) {
+			p = path.Clean(file)
+		}
+		return p, isExecutable(fsys, p)
+	}
+
+	search := defaultPath
+	for _, kv := range c.Env {
+		if v, ok := strings.CutPrefix(kv, "PATH="); ok {
+			search = v
+		}
+	}
+	for _, dir := range strings.Split(search, ":") {
+		if !path.IsAbs(dir) {
+			continue
+		}
+		p := path.Join(dir, file)
+		if isExecutable(fsys, p) == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%s: executable file not found in image $PATH", file)
+}
+
+func isExecutable(fsys iofs.FS, p string) error {
+	fi, err := iofs.Stat(fsys, strings.TrimPrefix(p, "/"))
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s: %w", p, syscall.EACCES)
+	}
+	return nil
+}
+
+// Credential resolves the user of the command against the /etc/passwd and
+// /etc/group files of fsys, the file system of the image, the way container
+// runtimes do: the primary group is that of the passwd entry unless a group
+// is given, and the supplementary groups are those listing the user. An
+// empty user is root. Numeric ids need no entry.
+func (c *Command) Credential(fsys iofs.FS) (*syscall.Credential, error) {
+	userName, groupName, hasGroup := strings.Cut(c.User, ":")
+	if userName == "" {
+		userName = "0"
+	}
+
+	cred := &syscall.Credential{}
+	passwd, err := readIDFile(fsys, "etc/passwd")
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, fields := range passwd {
+		if len(fields) < 4 || (fields[0] != userName && fields[2] != userName) {
+			continue
+		}
+		uid, uerr := strconv.ParseUint(fields[2], 10, 32)
+		gid, gerr := strconv.ParseUint(fields[3], 10, 32)
+		if uerr != nil || gerr != nil {
+			continue
+		}
+		cred.Uid, cred.Gid = uint32(uid), uint32(gid)
+		userName, found = fields[0], true
+		break
+	}
+	if !found {
+		uid, err := strconv.ParseUint(userName, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("user %q not found in /etc/passwd of the image", userName)
+		}
+		cred.Uid = uint32(uid)
+	}
+
+	groups, err := readIDFile(fsys, "etc/group")
+	if err != nil {
+		return nil, err
+	}
+	if hasGroup {
+		gid, err := lookupGroup(groups, groupName)
+		if err != nil {
+			return nil, err
+		}
+		cred.Gid = gid
+	}
+	for _, fields := range groups {
+		if !found || len(fields) < 4 {
+			continue
+		}
+		for _, member := range strings.Split(fields[3], ",") {
+			if member != userName {
+				continue
+			}
+			if gid, err := strconv.ParseUint(fields[2], 10, 32); err == nil {
+				cred.Groups = append(cred.Groups, uint32(gid))
+			}
+		}
+	}
+	return cred, nil
+}
+
+func lookupGroup(groups [][]string, name string) (uint32, error) {
+	for _, fields := range groups {
+		if len(fields) >= 3 && fields[0] == name {
+			if gid, err := strconv.ParseUint(fields[2], 10, 32); err == nil {
+				return uint32(gid), nil
+			}
+		}
+	}
+	gid, err := strconv.ParseUint(name, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("group %q not found in /etc/group of the image", name)
+	}
+	return uint32(gid), nil
+}
+
+// readIDFile reads the colon separated entries of a passwd or group file,
+// which images without users may not have.
+func readIDFile(fsys iofs.FS, name string) ([][]string, error) {
+	f, err := fsys.Open(name)
+	if errors.Is(err, iofs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries [][]string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, sc.Err()
+}
@@ -0,0 +1,158 @@
+package ocifs
+
+import (
+	"errors"
+	"io/fs"
+	"reflect"
+	"syscall"
+	"testing"
+	"testing/fstest"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestCommand(t *testing.T) {
+	cfg := &v1.ConfigFile{Config: v1.Config{
+		Entrypoint: []string{"/bin/server"},
+		Cmd:        []string{"--data", "$DATA", "--cost", "$5"},
+		Env:        []string{"PATH=/bin", "DATA=/var/lib/data"},
+		User:       "app:app",
+		WorkingDir: "${DATA}/work",
+	}}
+
+	tests := []struct {
+		name    string
+		opts    []CommandOption
+		args    []string
+		env     []string
+		workDir string
+	}{{
+		name:    "image",
+		args:    []string{"/bin/server", "--data", "$DATA", "--cost", "$5"},
+		env:     cfg.Config.Env,
+		workDir: "${DATA}/work",
+	}, {
+		name:    "args",
+		opts:    []CommandOption{CommandWithArgs("--help")},
+		args:    []string{"/bin/server", "--help"},
+		env:     cfg.Config.Env,
+		workDir: "${DATA}/work",
+	}, {
+		name:    "entrypoint",
+		opts:    []CommandOption{CommandWithEntrypoint("/bin/sh")},
+		args:    []string{"/bin/sh"},
+		env:     cfg.Config.Env,
+		workDir: "${DATA}/work",
+	}, {
+		name:    "expand",
+		opts:    []CommandOption{CommandWithExpand(nil)},
+		args:    []string{"/bin/server", "--data", "/var/lib/data", "--cost", "$5"},
+		env:     cfg.Config.Env,
+		workDir: "/var/lib/data/work",
+	}, {
+		name:    "expand vars",
+		opts:    []CommandOption{CommandWithExpand(map[string]string{"DATA": "/mnt", "5": "five"})},
+		args:    []string{"/bin/server", "--data", "/mnt", "--cost", "$5"},
+		env:     []string{"PATH=/bin", "DATA=/mnt", "5=five"},
+		workDir: "/mnt/work",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, err := resolveCommand(cfg, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cmd.Args, tt.args) {
+				t.Errorf("args %q, want %q", cmd.Args, tt.args)
+			}
+			if !reflect.DeepEqual(cmd.Env, tt.env) {
+				t.Errorf("env %q, want %q", cmd.Env, tt.env)
+			}
+			if cmd.WorkingDir != tt.workDir {
+				t.Errorf("working dir %q, want %q", cmd.WorkingDir, tt.workDir)
+			}
+			if cmd.User != "app:app" {
+				t.Errorf("user %q, want app:app", cmd.User)
+			}
+		})
+	}
+
+	if cfg.Config.Env[1] != "DATA=/var/lib/data" {
+		t.Errorf("image config modified: %q", cfg.Config.Env)
+	}
+	if _, err := resolveCommand(&v1.ConfigFile{}, nil); !errors.Is(err, ErrNoCommand) {
+		t.Errorf("got %v, want ErrNoCommand", err)
+	}
+	cmd, err := resolveCommand(&v1.ConfigFile{}, []CommandOption{CommandWithArgs("true")})
+	if err != nil || cmd.WorkingDir != "/" {
+		t.Errorf("got %+v, %v, want working dir /", cmd, err)
+	}
+}
+
+func TestCommandCredential(t *testing.T) {
+	fsys := fstest.MapFS{
+		"etc/passwd": {Data: []byte("root:x:0:0:root:/root:/bin/sh\n# comment\napp:x:1000:1001::/home/app:/bin/sh\n")},
+		"etc/group":  {Data: []byte("root:x:0:\napp:x:1001:\nstaff:x:50:app,other\nwheel:x:10:root\n")},
+	}
+
+	tests := []struct {
+		user string
+		want syscall.Credential
+	}{
+		{"", syscall.Credential{Groups: []uint32{10}}},
+		{"app", syscall.Credential{Uid: 1000, Gid: 1001, Groups: []uint32{50}}},
+		{"1000", syscall.Credential{Uid: 1000, Gid: 1001, Groups: []uint32{50}}},
+		{"app:root", syscall.Credential{Uid: 1000, Gid: 0, Groups: []uint32{50}}},
+		{"2000:2000", syscall.Credential{Uid: 2000, Gid: 2000}},
+	}
+	for _, tt := range tests {
+		cred, err := (&Command{User: tt.user}).Credential(fsys)
+		if err != nil {
+			t.Errorf("%q: %v", tt.user, err)
+			continue
+		}
+		if !reflect.DeepEqual(*cred, tt.want) {
+			t.Errorf("%q: got %+v, want %+v", tt.user, *cred, tt.want)
+		}
+	}
+	for _, user := range []string{"nobody", "app:nogroup"} {
+		if _, err := (&Command{User: user}).Credential(fsys); err == nil {
+			t.Errorf("%q: no error", user)
+		}
+	}
+}
+
+func TestCommandLookPath(t *testing.T) {
+	fsys := fstest.MapFS{
+		"bin/sh":        {Mode: 0755},
+		"usr/bin/data":  {Mode: 0644},
+		"opt/app/run":   {Mode: 0755},
+		"usr/local/bin": {Mode: fs.ModeDir | 0755},
+	}
+
+	tests := []struct {
+		args []string
+		env  []string
+		want string
+	}{
+		{[]string{"sh"}, nil, "/bin/sh"},
+		{[]string{"run"}, []string{"PATH=/usr/bin:/opt/app"}, "/opt/app/run"},
+		{[]string{"/bin/sh"}, nil, "/bin/sh"},
+		{[]string{"./run"}, nil, "/opt/app/run"},
+		{[]string{"data"}, nil, ""},
+		{[]string{"run"}, nil, ""},
+	}
+	for _, tt := range tests {
+		cmd := &Command{Args: tt.args, Env: tt.env, WorkingDir: "/opt/app"}
+		got, err := cmd.LookPath(fsys)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%q: found %s", tt.args, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %q, %v, want %q", tt.args, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package ocifs
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// DefaultContainerdRoot is where containerd keeps its state on most hosts.
+const DefaultContainerdRoot = "/var/lib/containerd"
+
+// WithContainerdContent copies the layers of pulled images from the content
+// store of the containerd whose state is under root, usually
+// DefaultContainerdRoot, when it already has them, rather than downloading
+// them again. Manifests and configs are still read from the image source.
+// The content store is trusted to hold the blobs its file names say.
+var WithContainerdContent = func(root string) Option {
+	return func(o *OCIFS) {
+		o.containerdRoot = root
+	}
+}
+
+// containerdBlobs returns the blob directory of containerd's content store.
+func containerdBlobs(root string) string {
+	return filepath.Join(root, "io.containerd.content.v1.content", "blobs")
+}
+
+// contentStoreImage serves the layers of an image from containerd's content
+// store when they are there.
+type contentStoreImage struct {
+	v1.Image
+	blobs string
+}
+
+func (i *contentStoreImage) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for j, l := range layers {
+		layers[j] = i.local(l)
+	}
+	return layers, nil
+}
+
+func (i *contentStoreImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := i.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.local(l), nil
+}
+
+// local returns l reading its compressed content from the content store, or
+// l itself when the blob is missing there.
+func (i *contentStoreImage) local(l v1.Layer) v1.Layer {
+	h, err := l.Digest()
+	if err != nil {
+		return l
+	}
+	size, err := l.Size()
+	if err != nil {
+		return l
+	}
+	p := filepath.Join(i.blobs, h.Algorithm, h.Hex)
+	if fi, err := os.Stat(p); err != nil || fi.Size() != size {
+		return l
+	}
+	slog.Debug("layer from containerd content store", "digest", h)
+	return &contentStoreLayer{Layer: l, path: p}
+}
+
+type contentStoreLayer struct {
+	v1.Layer
+	path string
+}
+
+func (l *contentStoreLayer) Compressed() (io.ReadCloser, error) {
+	return os.Open(l.path)
+}
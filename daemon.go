@@ -0,0 +1,93 @@
+package ocifs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// DefaultDockerHost is the socket of the local docker daemon, used when
+// DOCKER_HOST is not set.
+const DefaultDockerHost = "unix:///var/run/docker.sock"
+
+// WithDockerHost exports images for docker-daemon: references from the
+// docker daemon at host, given as unix:///path or tcp://host:port, rather
+// than from DOCKER_HOST or DefaultDockerHost.
+var WithDockerHost = func(host string) Option {
+	return func(o *OCIFS) {
+		o.sources[SchemeDockerDaemon] = &dockerDaemon{host: host}
+	}
+}
+
+// dockerDaemon resolves image names or IDs to images exported from a docker
+// daemon through its API, as docker save does, so images that were built
+// locally and never pushed can be mounted.
+type dockerDaemon struct {
+	host string
+}
+
+func (d *dockerDaemon) Resolve(ctx context.Context, ref string) (v1.Image, error) {
+	host := d.host
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = DefaultDockerHost
+	}
+	client, base, err := dockerClient(host)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/images/"+url.PathEscape(ref)+"/get", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("export %s from docker: %s: %s", ref, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	f, size, err := spool(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return tarball.Image(func() (io.ReadCloser, error) {
+		return io.NopCloser(io.NewSectionReader(f, 0, size)), nil
+	}, nil)
+}
+
+// dockerClient returns a client for the daemon at host and the base URL of
+// its API.
+func dockerClient(host string) (*http.Client, string, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, "", err
+	}
+	switch u.Scheme {
+	case "unix":
+		sock := u.Path
+		dialer := &net.Dialer{}
+		return &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", sock)
+			},
+		}}, "http://docker", nil
+	case "tcp":
+		return &http.Client{}, "http://" + u.Host, nil
+	}
+	return nil, "", fmt.Errorf("unsupported docker host %s", host)
+}
@@ -0,0 +1,69 @@
+package ocifs
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestDockerDaemon(t *testing.T) {
+	img, err := random.Image(256, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := name.NewTag("example.com/app:dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/images/example.com%2Fapp:dev/get" {
+			http.Error(w, "No such image", http.StatusNotFound)
+			return
+		}
+		if err := tarball.Write(tag, img, w); err != nil {
+			t.Error(err)
+		}
+	}))
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	ofs, err := New(WithWorkDir(t.TempDir()), WithDockerHost("unix://"+sock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ofs.Image("docker-daemon:example.com/app:dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := got.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.RootFS.DiffIDs) != 2 {
+		t.Errorf("got %d layers, want 2", len(cfg.RootFS.DiffIDs))
+	}
+	if _, err := ofs.lp.Blob(want); err != nil {
+		t.Errorf("config %s not in store: %v", want, err)
+	}
+
+	if _, err := ofs.Image("docker-daemon:example.com/missing:dev"); err == nil {
+		t.Error("Image of a missing image succeeded")
+	}
+}
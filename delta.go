@@ -0,0 +1,100 @@
+package ocifs
+
+import (
+	"context"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Delta describes how the layers of two images relate.
+type Delta struct {
+	// Shared layers are in both images.
+	Shared []v1.Descriptor
+	// Added layers are only in the second image.
+	Added []v1.Descriptor
+	// Removed layers are only in the first image.
+	Removed []v1.Descriptor
+	// Download lists the layers of the second image that are not in the
+	// store yet, which is what pulling it would fetch.
+	Download []v1.Descriptor
+}
+
+// SharedBytes returns the compressed size of the shared layers.
+func (d *Delta) SharedBytes() int64 {
+	return sumSizes(d.Shared)
+}
+
+// DownloadBytes returns the compressed size of the layers to download.
+func (d *Delta) DownloadBytes() int64 {
+	return sumSizes(d.Download)
+}
+
+func sumSizes(descs []v1.Descriptor) int64 {
+	var n int64
+	for _, d := range descs {
+		n += d.Size
+	}
+	return n
+}
+
+// Delta compares the layers of the images fromRef and toRef. Only their
+// manifests are fetched, so it can tell what pulling toRef would cost
+// before doing it. Layers are compared by digest.
+func (o *OCIFS) Delta(fromRef, toRef string) (*Delta, error) {
+	from, err := o.manifest(fromRef)
+	if err != nil {
+		return nil, err
+	}
+	to, err := o.manifest(toRef)
+	if err != nil {
+		return nil, err
+	}
+
+	inFrom := make(map[v1.Hash]bool, len(from.Layers))
+	for _, l := range from.Layers {
+		inFrom[l.Digest] = true
+	}
+	inTo := make(map[v1.Hash]bool, len(to.Layers))
+	for _, l := range to.Layers {
+		inTo[l.Digest] = true
+	}
+
+	d := &Delta{}
+	for _, l := range to.Layers {
+		if inFrom[l.Digest] {
+			d.Shared = append(d.Shared, l)
+		} else {
+			d.Added = append(d.Added, l)
+		}
+		if !o.hasBlob(l.Digest) {
+			d.Download = append(d.Download, l)
+		}
+	}
+	for _, l := range from.Layers {
+		if !inTo[l.Digest] {
+			d.Removed = append(d.Removed, l)
+		}
+	}
+
+	return d, nil
+}
+
+// manifest fetches the manifest of imgRef, resolved as pulls resolve it.
+func (o *OCIFS) manifest(imgRef string) (*v1.Manifest, error) {
+	src, ref := o.source(imgRef)
+	img, err := src.Resolve(context.Background(), ref)
+	if err != nil {
+		return nil, err
+	}
+	return img.Manifest()
+}
+
+// hasBlob reports whether the blob h is already in the store.
+func (o *OCIFS) hasBlob(h v1.Hash) bool {
+	rc, err := o.lp.Blob(h)
+	if err != nil {
+		return false
+	}
+	rc.Close()
+	return true
+}
@@ -0,0 +1,110 @@
+package ocifs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// WithRegistryAddress connects to registry, a host such as
+// registry.example.com or localhost:5000, at addrs instead of the addresses
+// DNS returns for it. Addresses without a port keep the port of the
+// registry, and they are tried in order until one connects. TLS still
+// verifies the certificate against the registry name.
+var WithRegistryAddress = func(registry string, addrs ...string) Option {
+	return func(o *OCIFS) {
+		if r, err := name.NewRegistry(registry); err == nil {
+			registry = r.RegistryStr()
+		}
+		if o.pinned == nil {
+			o.pinned = make(map[string][]string)
+		}
+		o.pinned[registry] = append(o.pinned[registry], addrs...)
+	}
+}
+
+// WithDNSServer resolves registry hosts by querying the DNS server at addr,
+// as host or host:port, instead of using the resolver of the system, for
+// split DNS setups where the system does not know the registry.
+var WithDNSServer = func(addr string) Option {
+	return func(o *OCIFS) {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		o.dnsServer = addr
+	}
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// pinnedDial wraps dial to connect to the pinned addresses of a host, or to
+// those the DNS server returns, instead of letting dial resolve it.
+func (o *OCIFS) pinnedDial(dial dialFunc) dialFunc {
+	var resolver *net.Resolver
+	if o.dnsServer != "" {
+		server := o.dnsServer
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return dial(ctx, network, addr)
+		}
+		addrs, ok := o.pinned[addr]
+		if !ok {
+			addrs, ok = o.pinned[host]
+		}
+		if !ok && resolver != nil && net.ParseIP(host) == nil {
+			if addrs, err = resolver.LookupHost(ctx, host); err != nil {
+				return nil, err
+			}
+			ok = true
+		}
+		if !ok {
+			return dial(ctx, network, addr)
+		}
+		return dialEach(ctx, dial, network, port, addrs)
+	}
+}
+
+// dialEach dials addrs in order, giving each an equal share of the time left
+// in ctx, and returns the first connection made. They are not raced, so
+// list the address family to prefer first.
+func dialEach(ctx context.Context, dial dialFunc, network, port string, addrs []string) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses to dial")
+	}
+	var errs []error
+	for i, a := range addrs {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			a = net.JoinHostPort(strings.Trim(a, "[]"), port)
+		}
+		dctx := ctx
+		if deadline, ok := ctx.Deadline(); ok {
+			var cancel context.CancelFunc
+			dctx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(addrs)-i))
+			defer cancel()
+		}
+		conn, err := dial(dctx, network, a)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("dial %s: %w", strings.Join(addrs, ", "), errors.Join(errs...))
+}
@@ -0,0 +1,30 @@
+package ocifs
+
+import (
+	"testing"
+)
+
+func TestRegistryAddress(t *testing.T) {
+	addr := testRegistry(t, nil)
+
+	ref := parseRef(t, addr+"/app:v1")
+	img := pushRandomImage(t, ref, 64, 1)
+
+	// Nothing listens on port 1, so the pull only works if the pin is used.
+	const pinned = "registry.localhost:1"
+	ofs, err := New(WithWorkDir(t.TempDir()), WithRegistryAddress(pinned, "127.0.0.1:1", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ofs.Pull(pinned + "/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != want {
+		t.Errorf("pulled %s, want %s", h, want)
+	}
+}
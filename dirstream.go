@@ -0,0 +1,69 @@
+package ocifs
+
+import (
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// dirSnapshot is the listing of a directory of the image, built on its first
+// Readdir. The children of image directories do not change once the mount is
+// set up, so every handle pages through the same entries: an entry keeps its
+// offset when a handle rewinds or seeks back, which makes the bridge ask for
+// a new stream, and listing a huge directory again allocates nothing.
+type dirSnapshot struct {
+	once    sync.Once
+	entries []fuse.DirEntry
+}
+
+// stream returns a stream of the children of n, the directory of s.
+func (s *dirSnapshot) stream(n *fs.Inode) fs.DirStream {
+	s.once.Do(func() {
+		s.entries = childEntries(n)
+	})
+	return &snapshotDirStream{entries: s.entries}
+}
+
+// childEntries lists the children of n sorted by name, as the bridge would
+// for nodes without a Readdir method.
+func childEntries(n *fs.Inode) []fuse.DirEntry {
+	children := n.Children()
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]fuse.DirEntry, 0, len(names))
+	for _, name := range names {
+		ch := children[name]
+		entries = append(entries, fuse.DirEntry{
+			Name: name,
+			Mode: ch.Mode(),
+			Ino:  ch.StableAttr().Ino,
+		})
+	}
+	return entries
+}
+
+// snapshotDirStream pages through the entries of a dirSnapshot, which it
+// shares with the other handles of the directory.
+type snapshotDirStream struct {
+	entries []fuse.DirEntry
+	next    int
+}
+
+func (s *snapshotDirStream) HasNext() bool {
+	return s.next < len(s.entries)
+}
+
+func (s *snapshotDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	e := s.entries[s.next]
+	s.next++
+	return e, fs.OK
+}
+
+func (s *snapshotDirStream) Close() {}
@@ -0,0 +1,112 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// dirent is an entry of a directory as returned by getdents64, with the
+// offset to seek to for the entries after it.
+type dirent struct {
+	name string
+	off  int64
+}
+
+// readDirents lists the directory fd from its current offset with a small
+// buffer, so the listing takes many calls.
+func readDirents(t *testing.T, fd int) []dirent {
+	t.Helper()
+	var ents []dirent
+	buf := make([]byte, 512)
+	for {
+		n, err := unix.Getdents(fd, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			return ents
+		}
+		for b := buf[:n]; len(b) > 0; {
+			reclen := binary.NativeEndian.Uint16(b[16:18])
+			name, _, _ := strings.Cut(string(b[19:reclen]), "\x00")
+			if name != "." && name != ".." {
+				ents = append(ents, dirent{name: name, off: int64(binary.NativeEndian.Uint64(b[8:16]))})
+			}
+			b = b[reclen:]
+		}
+	}
+}
+
+func TestReaddirOffsets(t *testing.T) {
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	const files = 2000
+	hdrs := []*tar.Header{{Name: "big/", Typeflag: tar.TypeDir, Mode: 0755}}
+	for i := 0; i < files; i++ {
+		hdrs = append(hdrs, &tar.Header{Name: fmt.Sprintf("big/file-%04d-%s", i, strings.Repeat("x", 40)), Typeflag: tar.TypeReg, Mode: 0644})
+	}
+	pushTarImage(t, ref, hdrs, nil)
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := ofs.Mount(ref.String(), MountWithTargetPath(t.TempDir()))
+	if errors.Is(err, ErrFUSEUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Unmount()
+
+	dir, err := os.Open(filepath.Join(im.MountPoint(), "big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	fd := int(dir.Fd())
+
+	all := readDirents(t, fd)
+	if len(all) != files {
+		t.Fatalf("listed %d entries, want %d", len(all), files)
+	}
+	seen := map[string]bool{}
+	for _, e := range all {
+		if seen[e.name] {
+			t.Fatalf("%s listed twice", e.name)
+		}
+		seen[e.name] = true
+	}
+
+	// seeking back to the offset of an entry continues right after it
+	for _, i := range []int{files / 2, 10, files - 1} {
+		if _, err := unix.Seek(fd, all[i].off, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		rest := readDirents(t, fd)
+		if len(rest) != files-i-1 || (len(rest) > 0 && rest[0] != all[i+1]) {
+			t.Errorf("after seeking to entry %d: %d entries, want the %d after it", i, len(rest), files-i-1)
+		}
+	}
+	// and so does another handle
+	other, err := os.Open(dir.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	again := readDirents(t, int(other.Fd()))
+	for i := range again {
+		if again[i] != all[i] {
+			t.Fatalf("second handle lists %v at %d, first %v", again[i], i, all[i])
+		}
+	}
+}
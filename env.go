@@ -0,0 +1,72 @@
+package ocifs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// WriteEnv writes the environment of the image config to w as a file that
+// shells can source, with one export per variable and the values single
+// quoted. Variables whose names the shell cannot export are left out with a
+// comment, as are entries without a value.
+func (i *Image) WriteEnv(w io.Writer) error {
+	cfg, err := i.ConfigFile()
+	if err != nil {
+		return err
+	}
+	return writeEnv(w, cfg.Config.Env)
+}
+
+// WriteEnvFile writes the environment of the mounted image to path, in the
+// format of Image.WriteEnv, so that services started against the mount can
+// source it.
+func (im *ImageMount) WriteEnvFile(path string) error {
+	cfg, err := im.ConfigFile()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = writeEnv(f, cfg.Config.Env)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func writeEnv(w io.Writer, env []string) error {
+	bw := bufio.NewWriter(w)
+	for _, kv := range env {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || !isShellName(name) {
+			fmt.Fprintf(bw, "# skipped %q\n", kv)
+			continue
+		}
+		fmt.Fprintf(bw, "export %s=%s\n", name, shellQuote(value))
+	}
+	return bw.Flush()
+}
+
+// isShellName reports whether name can be assigned to in a POSIX shell.
+func isShellName(name string) bool {
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		return false
+	}
+	for _, c := range name {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// shellQuote quotes s for a POSIX shell, closing the quotes around each
+// single quote in it.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,43 @@
+package ocifs
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteEnv(t *testing.T) {
+	env := []string{
+		"PATH=/usr/local/bin:/usr/bin",
+		"QUOTED=it's a \"test\" $HOME `id`",
+		"EMPTY=",
+		"dotted.name=skipped",
+		"NOVALUE",
+	}
+	var b strings.Builder
+	if err := writeEnv(&b, env); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(b.String(), "# skipped"); n != 2 {
+		t.Errorf("%d entries skipped, want 2:\n%s", n, b.String())
+	}
+
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err)
+	}
+	file := filepath.Join(t.TempDir(), "env")
+	if err := os.WriteFile(file, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(sh, "-c", `. "$0" && printf '%s\n' "$PATH" "$QUOTED" "[$EMPTY]"`, file).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "/usr/local/bin:/usr/bin\nit's a \"test\" $HOME `id`\n[]\n"
+	if string(out) != want {
+		t.Errorf("sourced env:\n%s\nwant:\n%s", out, want)
+	}
+}
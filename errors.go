@@ -0,0 +1,47 @@
+package ocifs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+var (
+	// ErrNotAdmitted is returned when a label policy or the admission hook
+	// rejects an image.
+	ErrNotAdmitted = errors.New("not admitted")
+	// ErrMountPointBusy is returned when something is already mounted at
+	// the mount point.
+	ErrMountPointBusy = errors.New("mount point busy")
+	// ErrFUSEUnavailable is returned when mounting fails because the kernel
+	// does not offer FUSE to this process.
+	ErrFUSEUnavailable = errors.New("fuse unavailable")
+	// ErrForeignLayer is returned when a foreign layer cannot be fetched
+	// from the registry or its URLs, or was ignored when it was pulled.
+	ErrForeignLayer = errors.New("foreign layer unavailable")
+)
+
+// isMountPoint reports whether p is the root of a mount, that is on another
+// device than its parent.
+func isMountPoint(p string) (bool, error) {
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(p, &st); err != nil {
+		return false, err
+	}
+	if err := syscall.Stat(filepath.Dir(p), &parent); err != nil {
+		return false, err
+	}
+	return st.Dev != parent.Dev, nil
+}
+
+// fuseAvailable reports whether /dev/fuse can be opened, which mounting
+// needs, directly or through fusermount.
+func fuseAvailable() bool {
+	f, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
@@ -0,0 +1,53 @@
+package ocifs
+
+import (
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+type EventType string
+
+const (
+	EventPullStarted   EventType = "PullStarted"
+	EventPullCompleted EventType = "PullCompleted"
+	EventLayerUnpacked EventType = "LayerUnpacked"
+	EventMounted       EventType = "Mounted"
+	EventUnmounted     EventType = "Unmounted"
+	EventRemounted     EventType = "Remounted"
+	EventError         EventType = "Error"
+)
+
+// Event describes a step in the lifecycle of a pull or a mount. Fields that
+// do not apply to a given event type are left at their zero value.
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	ImageRef   string
+	Digest     v1.Hash
+	Layer      v1.Hash
+	MountPoint string
+	Err        error
+}
+
+// WithEventHandler calls handler with the events of pulls and mounts as they
+// happen. It is called synchronously from the goroutines doing the work,
+// pull and MountAll workers as well as FUSE request handlers, so it must be
+// safe for concurrent use and must not block: a slow handler stalls pulls
+// and file system requests. Handlers with slow work to do should hand the
+// events to a goroutine of their own.
+var WithEventHandler = func(handler func(Event)) Option {
+	return func(o *OCIFS) {
+		o.eventHandler = handler
+	}
+}
+
+func (o *OCIFS) emit(ev Event) {
+	if o.eventHandler == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	o.eventHandler(ev)
+}
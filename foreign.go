@@ -0,0 +1,125 @@
+package ocifs
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// WithIgnoreForeignLayers leaves out foreign layers, the non-distributable
+// layers of Windows base images and some vendor images that are served
+// from their own URLs rather than the registry. They are neither
+// downloaded nor unpacked, so their files are missing from mounts.
+var WithIgnoreForeignLayers = func() Option {
+	return func(o *OCIFS) {
+		o.ignoreForeign = true
+	}
+}
+
+// isForeign reports whether layers of media type mt are foreign.
+func isForeign(mt types.MediaType) bool {
+	switch mt {
+	case types.DockerForeignLayer, types.OCIRestrictedLayer, types.OCIUncompressedRestrictedLayer:
+		return true
+	}
+	return false
+}
+
+// foreignLayers wraps an image being stored, so that its foreign layers are
+// left out, or fail with ErrForeignLayer when their URLs cannot be fetched.
+// The registry itself is tried first, and the content of all URLs is
+// checked against the digest of the layer.
+type foreignLayers struct {
+	v1.Image
+	ignore bool
+}
+
+func (i *foreignLayers) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]v1.Layer, 0, len(layers))
+	for _, l := range layers {
+		mt, err := l.MediaType()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !isForeign(mt):
+			out = append(out, l)
+		case i.ignore:
+			h, _ := l.Digest()
+			slog.Debug("ignoring foreign layer", "digest", h)
+		default:
+			out = append(out, &foreignLayer{Layer: l})
+		}
+	}
+	return out, nil
+}
+
+type foreignLayer struct {
+	v1.Layer
+}
+
+func (l *foreignLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		h, _ := l.Digest()
+		return nil, fmt.Errorf("%w %s: %w", ErrForeignLayer, h, err)
+	}
+	return rc, nil
+}
+
+// fetchForeign writes the foreign layers of img missing from the store, left
+// out by an earlier pull that ignored them.
+func (s *OCIFS) fetchForeign(img *foreignLayers, progress *pullProgress) error {
+	if img.ignore {
+		return nil
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	for _, l := range layers {
+		if _, ok := l.(*foreignLayer); !ok {
+			continue
+		}
+		h, err := l.Digest()
+		if err != nil {
+			return err
+		}
+		if s.hasBlob(h) {
+			continue
+		}
+		rc, err := l.Compressed()
+		if err != nil {
+			return err
+		}
+		if err := s.lp.WriteBlob(h, progress.counting(rc)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// missingForeign reports whether foreign layers of the stored img were left
+// out by an earlier pull, while they are no longer ignored.
+func (s *OCIFS) missingForeign(img v1.Image) bool {
+	if s.ignoreForeign {
+		return false
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return true
+	}
+	for _, l := range m.Layers {
+		if isForeign(l.MediaType) && !s.hasBlob(l.Digest) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package ocifs
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestForeignLayers(t *testing.T) {
+	host := testRegistry(t, nil)
+
+	foreign, err := random.Layer(128, types.DockerForeignLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := foreign.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := true
+	blobs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc, err := foreign.Compressed()
+		if !serve || err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer rc.Close()
+		io.Copy(w, rc)
+	}))
+	defer blobs.Close()
+
+	own, err := random.Layer(128, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.Append(empty.Image,
+		mutate.Addendum{Layer: foreign, MediaType: types.DockerForeignLayer, URLs: []string{blobs.URL + "/base.tar.gz"}},
+		mutate.Addendum{Layer: own},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := parseRef(t, host+"/windows/app:v1")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ofs.Image(ref.String()); err != nil {
+		t.Fatalf("pull with foreign layer served: %v", err)
+	}
+	if !ofs.hasBlob(h) {
+		t.Error("foreign layer not in store")
+	}
+
+	serve = false
+	ofs, err = New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ofs.Image(ref.String()); !errors.Is(err, ErrForeignLayer) {
+		t.Errorf("pull with foreign layer missing: %v, want ErrForeignLayer", err)
+	}
+
+	workDir := t.TempDir()
+	ofs, err = New(WithWorkDir(workDir), WithIgnoreForeignLayers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ofs.Image(ref.String()); err != nil {
+		t.Fatalf("pull ignoring foreign layers: %v", err)
+	}
+	if ofs.hasBlob(h) {
+		t.Error("ignored foreign layer in store")
+	}
+
+	// pulling it again without ignoring them fetches the skipped layer
+	serve = true
+	ofs, err = New(WithWorkDir(workDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ofs.Image(ref.String()); err != nil {
+		t.Errorf("pull of image pulled ignoring foreign layers: %v", err)
+	}
+	if !ofs.hasBlob(h) {
+		t.Error("foreign layer not fetched on second pull")
+	}
+}
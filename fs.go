@@ -4,39 +4,176 @@ import (
 	"archive/tar"
 	"context"
 	"io"
-	"log"
 	"log/slog"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
 )
 
 type ociFS struct {
 	fs.Inode
-	ut        *unifiedTree
-	extraDirs []string
+	ut         *unifiedTree
+	extraDirs  []ExtraDir
+	bindDirs   []bindDir
+	handles    *handleTracker
+	created    time.Time
+	readahead  int64
+	directIO   bool
+	layers     map[string]v1.Hash
+	audit      *auditLog
+	policy     AccessPolicy
+	transforms []transform
+	// selinuxContext, when set, labels every node in place of the labels
+	// recorded in the layers
+	selinuxContext string
+	worldReadable  bool
+	// umask and owner apply to entries created in bind directories
+	umask uint32
+	owner *fileOwner
+	logs  *logSampler
+	// verifier checks file content before it is served, if enabled
+	verifier *contentVerifier
+	// listing is the snapshot of the root directory
+	listing dirSnapshot
+	// fixedAttrs, when set, replaces the owner and times of every entry,
+	// and dateEpoch clamps their modification times
+	fixedAttrs *fixedAttrs
+	dateEpoch  *time.Time
+	// rootAttrs, when set, overrides the permissions and owner of the root
+	rootAttrs *rootAttrs
 }
 
-func (o *OCIFS) initFS(h *v1.Hash, extraDirs []string) (fs.InodeEmbedder, error) {
-	layers, err := o.getUnpackedLayers(h)
+// handleTracker counts open file handles so that a shutdown can stop new
+// opens and wait for the existing ones to be released.
+type handleTracker struct {
+	mu       sync.Mutex
+	draining bool
+	open     int
+	// drained is closed once draining and no handle is open
+	drained chan struct{}
+}
+
+func (t *handleTracker) acquire() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.open++
+	return true
+}
+
+func (t *handleTracker) release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.open--
+	if t.draining && t.open == 0 {
+		close(t.drained)
+	}
+}
+
+// closing reports whether drain was called.
+func (t *handleTracker) closing() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// drain stops new handles from being acquired and waits until all
+// outstanding handles have been released or ctx is done.
+func (t *handleTracker) drain(ctx context.Context) error {
+	t.mu.Lock()
+	if !t.draining {
+		t.draining = true
+		t.drained = make(chan struct{})
+		if t.open == 0 {
+			close(t.drained)
+		}
+	}
+	drained := t.drained
+	t.mu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (o *OCIFS) initFS(im *ImageMount) (*ociFS, error) {
+	if im.sharedTree {
+		ut, digests, err := o.acquireTree(im.h)
+		if err != nil {
+			return nil, err
+		}
+		return o.newOciFS(im, ut, digests), nil
+	}
+
+	ut, digests, err := o.buildTree(im.h, im.normalize)
 	if err != nil {
 		return nil, err
 	}
 
-	ut := newUnifiedTree()
-	for _, l := range layers {
-		ut.AddLayer(l.Path(), l.Files())
+	for _, d := range im.lowerDirs {
+		files, err := hostDirHeaders(d)
+		if err != nil {
+			return nil, err
+		}
+		ut.AddLayer(d, files)
 	}
 
+	if len(im.masked) > 0 {
+		dir, files, err := o.maskLayer(ut, im.masked)
+		if err != nil {
+			return nil, err
+		}
+		im.maskDir = dir
+		ut.AddLayer(dir, files)
+	}
+
+	if len(im.hidden) > 0 {
+		ut.AddLayer("", hideLayer(ut, im.hidden))
+	}
+
+	return o.newOciFS(im, ut, digests), nil
+}
+
+func (o *OCIFS) newOciFS(im *ImageMount, ut *unifiedTree, digests map[string]v1.Hash) *ociFS {
+	var verifier *contentVerifier
+	if im.verifyReads {
+		verifier = newContentVerifier()
+	}
 	return &ociFS{
-		ut:        ut,
-		extraDirs: extraDirs,
-	}, nil
+		ut:             ut,
+		extraDirs:      im.extraDirs,
+		bindDirs:       im.bindDirs,
+		handles:        &handleTracker{},
+		created:        time.Now(),
+		readahead:      im.readahead,
+		directIO:       im.directIO,
+		layers:         digests,
+		audit:          im.audit,
+		policy:         im.policy,
+		transforms:     im.transforms,
+		selinuxContext: im.selinuxContext,
+		worldReadable:  im.worldReadable,
+		umask:          im.umask,
+		owner:          im.owner,
+		logs:           o.logs,
+		verifier:       verifier,
+		fixedAttrs:     im.fixedAttrs,
+		dateEpoch:      im.dateEpoch,
+		rootAttrs:      im.rootAttrs,
+	}
 }
 
 // headerToFileInfo fills a fuse.Attr struct from a tar.Header.
@@ -51,71 +188,76 @@ func headerToFileInfo(out *fuse.Attr, h *tar.Header) {
 var _ = (fs.NodeOnAdder)((*ociFS)(nil))
 
 func (ofs *ociFS) OnAdd(ctx context.Context) {
-	ofs.ut.Traverse(func(utn *unifiedTreeNode, f string) bool {
+	ofs.ut.TraverseAll(func(utn *unifiedTreeNode, f string) bool {
 		dir, base := path.Split(f)
 
-		p := &ofs.Inode
-		for _, part := range strings.Split(dir, "/") {
-			if len(part) == 0 {
-				continue
-			}
-			ch := p.GetChild(part)
-			if ch == nil {
-				ch = p.NewPersistentInode(ctx, &fs.Inode{}, fs.StableAttr{Mode: fuse.S_IFDIR})
-				p.AddChild(part, ch, true)
-			}
-			p = ch
-		}
+		p := ofs.mkdirAll(ctx, dir)
 
 		hdr := utn.Header()
+		if hdr == nil {
+			ofs.mkdirAll(ctx, f)
+			return true
+		}
 
 		attr := fuse.Attr{}
 		headerToFileInfo(&attr, hdr)
+		ofs.adjustAttr(&attr)
 
 		switch hdr.Typeflag {
 
+		case tar.TypeDir:
+			ofs.mkdirAll(ctx, f)
+
 		case tar.TypeSymlink:
-			l := &fs.MemSymlink{
-				Data: []byte(hdr.Linkname),
-			}
+			l := &ociSymlink{ofs: ofs, label: ofs.selinuxLabel(hdr)}
+			l.Data = []byte(hdr.Linkname)
 			l.Attr = attr
 			p.AddChild(base, p.NewPersistentInode(ctx, l, fs.StableAttr{Mode: syscall.S_IFLNK}), false)
 
 		// for hardlinks we create an inode pointing to the link file in it's layer whith it's size
 		case tar.TypeLink:
-			linkEntry, ok := ofs.ut.Get(hdr.Linkname)
+			linkEntry, ok := ofs.ut.LinkTarget(utn)
 			if !ok {
 				slog.Debug("Missing link", "path", hdr.Linkname, "filepath", utn.Path())
 				return true
 			}
 			attr.Size = uint64(linkEntry.Header().Size)
+			digest, fromLayer := linkEntry.contentDigest()
 			ch := p.NewPersistentInode(ctx, &ociFile{
-				path:     hdr.Linkname,
-				attr:     attr,
-				fullPath: linkEntry.Path(),
+				path:      f,
+				attr:      attr,
+				fullPath:  linkEntry.Path(),
+				digest:    digest,
+				fromLayer: fromLayer,
+				ofs:       ofs,
+				transform: ofs.transformFor(f),
+				label:     ofs.selinuxLabel(linkEntry.Header()),
 			}, fs.StableAttr{})
 			p.AddChild(base, ch, true)
 
 		case tar.TypeChar:
-			rf := &fs.MemRegularFile{}
-			rf.Attr = attr
+			rf := &ociSpecial{ofs: ofs, attr: attr, label: ofs.selinuxLabel(hdr)}
 			p.AddChild(base, p.NewPersistentInode(ctx, rf, fs.StableAttr{Mode: syscall.S_IFCHR}), false)
 
 		case tar.TypeBlock:
-			rf := &fs.MemRegularFile{}
-			rf.Attr = attr
+			rf := &ociSpecial{ofs: ofs, attr: attr, label: ofs.selinuxLabel(hdr)}
 			p.AddChild(base, p.NewPersistentInode(ctx, rf, fs.StableAttr{Mode: syscall.S_IFBLK}), false)
 
 		case tar.TypeFifo:
-			rf := &fs.MemRegularFile{}
-			rf.Attr = attr
+			rf := &ociSpecial{ofs: ofs, attr: attr, label: ofs.selinuxLabel(hdr)}
 			p.AddChild(base, p.NewPersistentInode(ctx, rf, fs.StableAttr{Mode: syscall.S_IFIFO}), false)
 
 		case tar.TypeReg:
+			digest, fromLayer := utn.contentDigest()
 			ch := p.NewPersistentInode(ctx, &ociFile{
-				path:     f,
-				attr:     attr,
-				fullPath: utn.Path(),
+				path:      f,
+				attr:      attr,
+				fullPath:  utn.Path(),
+				digest:    digest,
+				fromLayer: fromLayer,
+				ofs:       ofs,
+				transform: ofs.transformFor(f),
+				label:     ofs.selinuxLabel(hdr),
 			}, fs.StableAttr{})
 			p.AddChild(base, ch, true)
 		default:
@@ -126,51 +268,458 @@ func (ofs *ociFS) OnAdd(ctx context.Context) {
 	})
 
 	for _, d := range ofs.extraDirs {
-		p := &ofs.Inode
-		for _, part := range strings.Split(d, "/") {
-			if len(part) == 0 {
-				continue
-			}
-			ch := p.GetChild(part)
-			if ch == nil {
-				ch = p.NewPersistentInode(ctx, &fs.Inode{}, fs.StableAttr{Mode: fuse.S_IFDIR})
-				p.AddChild(part, ch, true)
-			}
-			p = ch
+		dir := ofs.mkdirAll(ctx, d.Path)
+		od, ok := dir.Operations().(*ociDir)
+		if !ok || d.Mode == 0 {
+			continue
+		}
+		od.attr.Mode = d.Mode
+		od.attr.Uid = d.Uid
+		od.attr.Gid = d.Gid
+	}
+
+	for _, b := range ofs.bindDirs {
+		dir, base := path.Split(strings.Trim(b.mountPath, "/"))
+		if base == "" {
+			slog.Error("Cannot bind over the mount root", "hostPath", b.hostPath)
+			continue
+		}
+		p := ofs.mkdirAll(ctx, dir)
+		p.RmChild(base)
+		p.AddChild(base, p.NewPersistentInode(ctx, newBindRoot(b.hostPath, ofs), fs.StableAttr{Mode: fuse.S_IFDIR}), true)
+	}
+}
+
+// transformFor returns the transformed content for the file at p, or nil if
+// no transform matches it.
+func (ofs *ociFS) transformFor(p string) *transformedContent {
+	fns := transformsFor(ofs.transforms, path.Join("/", p))
+	if len(fns) == 0 {
+		return nil
+	}
+	return &transformedContent{fns: fns}
+}
+
+// inodeAt returns the inode at p if it exists in the tree.
+func (ofs *ociFS) inodeAt(p string) *fs.Inode {
+	n := &ofs.Inode
+	for _, part := range strings.Split(p, "/") {
+		if len(part) == 0 {
+			continue
+		}
+		if ofs.ut.normalize != nil {
+			part = ofs.ut.normalize(part)
+		}
+		if n = n.GetChild(part); n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// mkdirAll returns the directory inode for dir, creating it and any missing
+// parents. Directories take their attributes from the tar header of the
+// topmost layer that has one.
+func (ofs *ociFS) mkdirAll(ctx context.Context, dir string) *fs.Inode {
+	p := &ofs.Inode
+	cur := ""
+	for _, part := range strings.Split(dir, "/") {
+		if len(part) == 0 {
+			continue
+		}
+		cur = path.Join(cur, part)
+		ch := p.GetChild(part)
+		if ch == nil {
+			ch = p.NewPersistentInode(ctx, &ociDir{
+				ofs:   ofs,
+				attr:  ofs.dirAttr(cur),
+				label: ofs.selinuxLabel(ofs.dirHeader(cur)),
+			}, fs.StableAttr{Mode: fuse.S_IFDIR})
+			p.AddChild(part, ch, true)
+		}
+		p = ch
+	}
+	return p
+}
+
+// dirHeader returns the tar header of the directory at p, or nil if no layer
+// has one.
+func (ofs *ociFS) dirHeader(p string) *tar.Header {
+	if n, ok := ofs.ut.Get(p); ok && n.Header() != nil && n.Header().Typeflag == tar.TypeDir {
+		return n.Header()
+	}
+	return nil
+}
+
+func (ofs *ociFS) dirAttr(p string) fuse.Attr {
+	attr := fuse.Attr{}
+	if hdr := ofs.dirHeader(p); hdr != nil {
+		headerToFileInfo(&attr, hdr)
+	} else {
+		attr.Mode = 0755
+		attr.SetTimes(&ofs.created, &ofs.created, &ofs.created)
+	}
+	ofs.adjustAttr(&attr)
+	return attr
+}
+
+var _ = (fs.NodeGetattrer)((*ociFS)(nil))
+
+func (ofs *ociFS) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if errno := ofs.policy.check(ctx, OpGetattr, "/"); errno != fs.OK {
+		return errno
+	}
+	out.Attr = ofs.rootAttr()
+	return fs.OK
+}
+
+var _ = (fs.NodeAccesser)((*ociFS)(nil))
+
+func (ofs *ociFS) Access(ctx context.Context, mask uint32) syscall.Errno {
+	if errno := ofs.policy.check(ctx, OpAccess, "/"); errno != fs.OK {
+		return errno
+	}
+	attr := ofs.rootAttr()
+	return ofs.checkPermissions(ctx, &attr, mask)
+}
+
+var _ = (fs.NodeLookuper)((*ociFS)(nil))
+
+func (ofs *ociFS) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	attr := ofs.rootAttr()
+	return ofs.lookupChild(ctx, &ofs.Inode, &attr, name, out)
+}
+
+var _ = (fs.NodeGetxattrer)((*ociFS)(nil))
+
+func (ofs *ociFS) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if errno := ofs.policy.check(ctx, OpGetxattr, "/"); errno != fs.OK {
+		return 0, errno
+	}
+	return getxattrLabel(ofs.selinuxLabel(ofs.dirHeader("/")), attr, dest)
+}
+
+var _ = (fs.NodeListxattrer)((*ociFS)(nil))
+
+func (ofs *ociFS) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	if errno := ofs.policy.check(ctx, OpListxattr, "/"); errno != fs.OK {
+		return 0, errno
+	}
+	return listxattrLabel(ofs.selinuxLabel(ofs.dirHeader("/")), dest)
+}
+
+var _ = (fs.NodeReaddirer)((*ociFS)(nil))
+
+func (ofs *ociFS) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	if errno := ofs.policy.check(ctx, OpReaddir, "/"); errno != fs.OK {
+		return nil, errno
+	}
+	attr := ofs.rootAttr()
+	if errno := ofs.checkPermissions(ctx, &attr, unixROK); errno != fs.OK {
+		return nil, errno
+	}
+	return ofs.listing.stream(&ofs.Inode), fs.OK
+}
+
+type ociDir struct {
+	fs.Inode
+	ofs     *ociFS
+	attr    fuse.Attr
+	label   string
+	listing dirSnapshot
+}
+
+var _ = (fs.NodeLookuper)((*ociDir)(nil))
+
+func (d *ociDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return d.ofs.lookupChild(ctx, &d.Inode, &d.attr, name, out)
+}
+
+var _ = (fs.NodeReaddirer)((*ociDir)(nil))
+
+func (d *ociDir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	if errno := d.ofs.policy.check(ctx, OpReaddir, nodePath(&d.Inode, "")); errno != fs.OK {
+		return nil, errno
+	}
+	if errno := d.ofs.checkPermissions(ctx, &d.attr, unixROK); errno != fs.OK {
+		return nil, errno
+	}
+	return d.listing.stream(&d.Inode), fs.OK
+}
+
+// lookupChild finds name among the children of parent, normalizing it first
+// if the mount was configured with a unicode normalization form. The caller
+// needs search permission on parent, whose attributes are parentAttr.
+func (ofs *ociFS) lookupChild(ctx context.Context, parent *fs.Inode, parentAttr *fuse.Attr, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if ofs.ut.normalize != nil {
+		name = ofs.ut.normalize(name)
+	}
+
+	if errno := ofs.policy.check(ctx, OpLookup, nodePath(parent, name)); errno != fs.OK {
+		return nil, errno
+	}
+	if errno := ofs.checkPermissions(ctx, parentAttr, unixXOK); errno != fs.OK {
+		return nil, errno
+	}
+
+	ch := parent.GetChild(name)
+	if ch == nil {
+		return nil, syscall.ENOENT
+	}
+
+	if ga, ok := ch.Operations().(fs.NodeGetattrer); ok {
+		var a fuse.AttrOut
+		if errno := ga.Getattr(ctx, nil, &a); errno == fs.OK {
+			out.Attr = a.Attr
 		}
 	}
+
+	return ch, fs.OK
+}
+
+var _ = (fs.NodeGetattrer)((*ociDir)(nil))
+
+func (d *ociDir) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if errno := d.ofs.policy.check(ctx, OpGetattr, nodePath(&d.Inode, "")); errno != fs.OK {
+		return errno
+	}
+	out.Attr = d.attr
+	return fs.OK
+}
+
+var _ = (fs.NodeAccesser)((*ociDir)(nil))
+
+func (d *ociDir) Access(ctx context.Context, mask uint32) syscall.Errno {
+	if errno := d.ofs.policy.check(ctx, OpAccess, nodePath(&d.Inode, "")); errno != fs.OK {
+		return errno
+	}
+	return d.ofs.checkPermissions(ctx, &d.attr, mask)
+}
+
+var _ = (fs.NodeGetxattrer)((*ociDir)(nil))
+
+func (d *ociDir) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if errno := d.ofs.policy.check(ctx, OpGetxattr, nodePath(&d.Inode, "")); errno != fs.OK {
+		return 0, errno
+	}
+	return getxattrLabel(d.label, attr, dest)
+}
+
+var _ = (fs.NodeListxattrer)((*ociDir)(nil))
+
+func (d *ociDir) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	if errno := d.ofs.policy.check(ctx, OpListxattr, nodePath(&d.Inode, "")); errno != fs.OK {
+		return 0, errno
+	}
+	return listxattrLabel(d.label, dest)
+}
+
+type ociSymlink struct {
+	fs.MemSymlink
+	ofs   *ociFS
+	label string
+}
+
+var _ = (fs.NodeReadlinker)((*ociSymlink)(nil))
+
+func (l *ociSymlink) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if errno := l.ofs.policy.check(ctx, OpReadlink, nodePath(l.EmbeddedInode(), "")); errno != fs.OK {
+		return nil, errno
+	}
+	return l.MemSymlink.Readlink(ctx)
+}
+
+var _ = (fs.NodeGetattrer)((*ociSymlink)(nil))
+
+func (l *ociSymlink) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if errno := l.ofs.policy.check(ctx, OpGetattr, nodePath(l.EmbeddedInode(), "")); errno != fs.OK {
+		return errno
+	}
+	return l.MemSymlink.Getattr(ctx, fh, out)
+}
+
+var _ = (fs.NodeGetxattrer)((*ociSymlink)(nil))
+
+func (l *ociSymlink) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if errno := l.ofs.policy.check(ctx, OpGetxattr, nodePath(l.EmbeddedInode(), "")); errno != fs.OK {
+		return 0, errno
+	}
+	return getxattrLabel(l.label, attr, dest)
+}
+
+var _ = (fs.NodeListxattrer)((*ociSymlink)(nil))
+
+func (l *ociSymlink) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	if errno := l.ofs.policy.check(ctx, OpListxattr, nodePath(l.EmbeddedInode(), "")); errno != fs.OK {
+		return 0, errno
+	}
+	return listxattrLabel(l.label, dest)
+}
+
+// ociSpecial is a device or fifo. The kernel opens these itself, so only
+// their attributes are served.
+type ociSpecial struct {
+	fs.Inode
+	ofs   *ociFS
+	attr  fuse.Attr
+	label string
+}
+
+var _ = (fs.NodeGetattrer)((*ociSpecial)(nil))
+
+func (s *ociSpecial) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if errno := s.ofs.policy.check(ctx, OpGetattr, nodePath(&s.Inode, "")); errno != fs.OK {
+		return errno
+	}
+	out.Attr = s.attr
+	return fs.OK
+}
+
+var _ = (fs.NodeAccesser)((*ociSpecial)(nil))
+
+func (s *ociSpecial) Access(ctx context.Context, mask uint32) syscall.Errno {
+	if errno := s.ofs.policy.check(ctx, OpAccess, nodePath(&s.Inode, "")); errno != fs.OK {
+		return errno
+	}
+	return s.ofs.checkPermissions(ctx, &s.attr, mask)
+}
+
+var _ = (fs.NodeGetxattrer)((*ociSpecial)(nil))
+
+func (s *ociSpecial) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if errno := s.ofs.policy.check(ctx, OpGetxattr, nodePath(&s.Inode, "")); errno != fs.OK {
+		return 0, errno
+	}
+	return getxattrLabel(s.label, attr, dest)
+}
+
+var _ = (fs.NodeListxattrer)((*ociSpecial)(nil))
+
+func (s *ociSpecial) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	if errno := s.ofs.policy.check(ctx, OpListxattr, nodePath(&s.Inode, "")); errno != fs.OK {
+		return 0, errno
+	}
+	return listxattrLabel(s.label, dest)
 }
 
 type ociFile struct {
 	fs.Inode
-	path     string
-	fullPath string
-	attr     fuse.Attr
+	ofs       *ociFS
+	path      string
+	fullPath  string
+	digest    string
+	fromLayer bool
+	attr      fuse.Attr
+	transform *transformedContent
+	label     string
 }
 
 var _ = (fs.NodeOpener)((*ociFile)(nil))
 
 func (of *ociFile) Open(ctx context.Context, openFlags uint32) (fs.FileHandle, uint32, syscall.Errno) {
-	slog.Debug("Open", "path", of.path, "flags", openFlags, "layerPath", of.fullPath, "size", of.attr.Size)
+	of.ofs.logs.debug(OpOpen, "Open", "path", of.path, "flags", openFlags, "layerPath", of.fullPath, "size", of.attr.Size)
+
+	if errno := of.ofs.policy.check(ctx, OpOpen, nodePath(&of.Inode, "")); errno != fs.OK {
+		return nil, 0, errno
+	}
+	if errno := of.ofs.checkPermissions(ctx, &of.attr, openMask(openFlags)); errno != fs.OK {
+		return nil, 0, errno
+	}
+
+	if errno := of.ofs.verifier.verify(of); errno != fs.OK {
+		return nil, 0, errno
+	}
+
+	if !of.ofs.handles.acquire() {
+		of.ofs.logs.debug(OpOpen, "Open refused, shutting down", "path", of.path)
+		return nil, 0, syscall.EIO
+	}
+
+	if of.transform != nil {
+		data, err := of.transform.load(of.fullPath)
+		if err != nil {
+			of.ofs.handles.release()
+			slog.Error("Error transforming file", "path", of.path, "error", err)
+			return nil, 0, syscall.EIO
+		}
+		// the content is already held in memory, so it is not cached a
+		// second time by the page cache
+		return &transformedHandle{data: data}, fuse.FOPEN_DIRECT_IO, fs.OK
+	}
 
 	f, err := os.Open(of.fullPath)
 	if err != nil {
-		log.Printf("Error opening file: %v", err)
+		of.ofs.handles.release()
+		slog.Error("Error opening file", "path", of.path, "error", err)
 		return nil, 0, syscall.EIO
 	}
 
-	return &ociFileHandle{f: f, size: of.attr.Size}, fuse.FOPEN_KEEP_CACHE, fs.OK
+	fuseFlags := uint32(fuse.FOPEN_KEEP_CACHE)
+	if of.ofs.directIO {
+		fuseFlags = fuse.FOPEN_DIRECT_IO
+	}
+
+	return &ociFileHandle{f: f, size: of.attr.Size}, fuseFlags, fs.OK
 }
 
 type ociFileHandle struct {
 	f    *os.File
 	size uint64
+
+	mu    sync.Mutex
+	next  int64 // offset right after the previous read
+	raEnd int64 // end of the range already handed to the kernel for readahead
+}
+
+// readahead detects sequential reads and asks the kernel to load the next
+// window of the backing file into the page cache before it is requested.
+func (h *ociFileHandle) readahead(off int64, n int, window int64) {
+	if window <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	end := off + int64(n)
+	sequential := off == h.next
+	h.next = end
+	if !sequential {
+		h.raEnd = end
+		return
+	}
+	if h.raEnd-end > window/2 {
+		return
+	}
+
+	start := max(h.raEnd, end)
+	h.raEnd = min(end+window, int64(h.size))
+	if h.raEnd <= start {
+		return
+	}
+
+	// FADV_WILLNEED only starts the I/O, it does not wait for it
+	if err := unix.Fadvise(int(h.f.Fd()), start, h.raEnd-start, unix.FADV_WILLNEED); err != nil {
+		slog.Debug("readahead", "offset", start, "length", h.raEnd-start, "error", err)
+	}
 }
 
 var _ = (fs.NodeReader)((*ociFile)(nil))
 
 func (gf *ociFile) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
-	slog.Debug("Read", "path", gf.path, "offset", off, "lendest", len(dest))
+	gf.ofs.logs.debug(OpRead, "Read", "path", gf.path, "offset", off, "lendest", len(dest))
+
+	if errno := gf.ofs.policy.check(ctx, OpRead, nodePath(&gf.Inode, "")); errno != fs.OK {
+		return nil, errno
+	}
+
+	if th, ok := fh.(*transformedHandle); ok {
+		if off >= int64(len(th.data)) {
+			return fuse.ReadResultData(nil), fs.OK
+		}
+		end := min(off+int64(len(dest)), int64(len(th.data)))
+		return fuse.ReadResultData(th.data[off:end]), fs.OK
+	}
 
 	ofh, ok := fh.(*ociFileHandle)
 	if !ok {
@@ -184,28 +733,82 @@ func (gf *ociFile) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off
 		return nil, syscall.EIO
 	}
 
-	slog.Debug("Read", "path", gf.path, "offset", off, "n", n)
+	gf.ofs.logs.debug(OpRead, "Read", "path", gf.path, "offset", off, "n", n)
+
+	ofh.readahead(off, n, gf.ofs.readahead)
 
-	return fuse.ReadResultData(dest), fs.OK
+	return fuse.ReadResultData(dest[:n]), fs.OK
 }
 
 var _ = (fs.NodeGetattrer)((*ociFile)(nil))
 
 func (f *ociFile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if errno := f.ofs.policy.check(ctx, OpGetattr, nodePath(&f.Inode, "")); errno != fs.OK {
+		return errno
+	}
 	out.Attr = f.attr
+	if f.transform != nil {
+		// the size of the transformed content, not that of the image's
+		data, err := f.transform.load(f.fullPath)
+		if err != nil {
+			slog.Error("Error transforming file", "path", f.path, "error", err)
+			return syscall.EIO
+		}
+		out.Attr.Size = uint64(len(data))
+	}
+	return fs.OK
+}
+
+var _ = (fs.NodeAccesser)((*ociFile)(nil))
+
+func (f *ociFile) Access(ctx context.Context, mask uint32) syscall.Errno {
+	if errno := f.ofs.policy.check(ctx, OpAccess, nodePath(&f.Inode, "")); errno != fs.OK {
+		return errno
+	}
+	return f.ofs.checkPermissions(ctx, &f.attr, mask)
+}
+
+var _ = (fs.NodeGetxattrer)((*ociFile)(nil))
+
+func (f *ociFile) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if errno := f.ofs.policy.check(ctx, OpGetxattr, nodePath(&f.Inode, "")); errno != fs.OK {
+		return 0, errno
+	}
+	return getxattrLabel(f.label, attr, dest)
+}
+
+var _ = (fs.NodeListxattrer)((*ociFile)(nil))
+
+func (f *ociFile) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	if errno := f.ofs.policy.check(ctx, OpListxattr, nodePath(&f.Inode, "")); errno != fs.OK {
+		return 0, errno
+	}
+	return listxattrLabel(f.label, dest)
+}
+
+var _ = (fs.NodeFsyncer)((*ociFile)(nil))
+
+// Fsync succeeds without doing anything: layer content is never modified
+// through the mount, so there is nothing to write back.
+func (f *ociFile) Fsync(ctx context.Context, fh fs.FileHandle, flags uint32) syscall.Errno {
 	return fs.OK
 }
 
 var _ = (fs.NodeReleaser)((*ociFile)(nil))
 
 func (f *ociFile) Release(ctx context.Context, fh fs.FileHandle) syscall.Errno {
-	slog.Debug("Release", "path", f.path)
+	f.ofs.logs.debug(OpOpen, "Release", "path", f.path)
+	if _, ok := fh.(*transformedHandle); ok {
+		f.ofs.handles.release()
+		return fs.OK
+	}
 	ofh, ok := fh.(*ociFileHandle)
 	if !ok {
 		slog.Error("Error getting file handle", "path", f.path)
 		return syscall.EIO
 	}
 	err := ofh.f.Close()
+	f.ofs.handles.release()
 	if err != nil {
 		slog.Error("Error closing file", "path", f.path, "error", err)
 		return syscall.EIO
@@ -0,0 +1,98 @@
+package ocifs
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// FUSEHelper is how a mount is set up with the kernel.
+type FUSEHelper string
+
+const (
+	// FUSEHelperAuto calls mount(2) directly, which needs CAP_SYS_ADMIN,
+	// and falls back to fusermount when that fails.
+	FUSEHelperAuto FUSEHelper = "auto"
+	// FUSEHelperDirect only calls mount(2) directly.
+	FUSEHelperDirect FUSEHelper = "direct"
+	// FUSEHelperFusermount only mounts through the setuid fusermount3 or
+	// fusermount helper, as unprivileged users do.
+	FUSEHelperFusermount FUSEHelper = "fusermount"
+)
+
+// MountWithFUSEHelper picks how the mount is set up with the kernel. The
+// default is FUSEHelperAuto.
+var MountWithFUSEHelper = func(helper FUSEHelper) MountOption {
+	return func(im *ImageMount) {
+		im.helper = helper
+	}
+}
+
+// FUSEHelper returns how the mount was set up with the kernel, either
+// FUSEHelperDirect or FUSEHelperFusermount.
+func (im *ImageMount) FUSEHelper() FUSEHelper {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	return im.used
+}
+
+func (h FUSEHelper) valid() bool {
+	switch h {
+	case "", FUSEHelperAuto, FUSEHelperDirect, FUSEHelperFusermount:
+		return true
+	}
+	return false
+}
+
+// newServer mounts fs at mountPoint with helper, returning the helper that
+// succeeded. When none does, the error says what each of them failed with,
+// and wraps ErrFUSEUnavailable when it is because FUSE cannot be used at all
+// by this process.
+func newServer(fs fuse.RawFileSystem, mountPoint string, opts fuse.MountOptions, helper FUSEHelper) (*fuse.Server, FUSEHelper, error) {
+	var errs []error
+	if helper != FUSEHelperFusermount {
+		opts.DirectMount, opts.DirectMountStrict = false, true
+		srv, err := fuse.NewServer(fs, mountPoint, &opts)
+		if err == nil {
+			return srv, FUSEHelperDirect, nil
+		}
+		errs = append(errs, fmt.Errorf("direct mount: %w", err))
+		if helper == FUSEHelperDirect {
+			return nil, "", mountError(errs)
+		}
+	}
+
+	if !fusermountInstalled() {
+		errs = append(errs, fmt.Errorf("%w: neither fusermount3 nor fusermount is installed", ErrFUSEUnavailable))
+		return nil, "", errors.Join(errs...)
+	}
+	opts.DirectMount, opts.DirectMountStrict = false, false
+	srv, err := fuse.NewServer(fs, mountPoint, &opts)
+	if err == nil {
+		return srv, FUSEHelperFusermount, nil
+	}
+	errs = append(errs, fmt.Errorf("fusermount: %w", err))
+	return nil, "", mountError(errs)
+}
+
+// mountError joins the errors of the helpers tried, marking them with
+// ErrFUSEUnavailable if /dev/fuse cannot be opened.
+func mountError(errs []error) error {
+	if !fuseAvailable() {
+		return fmt.Errorf("%w: cannot open /dev/fuse: %w", ErrFUSEUnavailable, errors.Join(errs...))
+	}
+	return errors.Join(errs...)
+}
+
+// fusermountInstalled reports whether a fusermount helper can be found where
+// go-fuse looks for it.
+func fusermountInstalled() bool {
+	for _, bin := range []string{"fusermount3", "fusermount", "/bin/fusermount3", "/bin/fusermount"} {
+		if _, err := exec.LookPath(bin); err == nil {
+			return true
+		}
+	}
+	return false
+}
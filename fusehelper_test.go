@@ -0,0 +1,38 @@
+package ocifs
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFUSEHelper(t *testing.T) {
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	pushRandomImage(t, ref, 64, 1)
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ofs.Mount(ref.String(), MountWithTargetPath(t.TempDir()), MountWithFUSEHelper("sudo")); err == nil {
+		t.Error("mount with an unknown helper succeeded")
+	}
+
+	for _, helper := range []FUSEHelper{FUSEHelperAuto, FUSEHelperDirect, FUSEHelperFusermount} {
+		im, err := ofs.Mount(ref.String(), MountWithTargetPath(t.TempDir()), MountWithFUSEHelper(helper))
+		if err != nil {
+			if helper == FUSEHelperFusermount && !fusermountInstalled() && !errors.Is(err, ErrFUSEUnavailable) {
+				t.Errorf("mount without fusermount installed: got %v, want ErrFUSEUnavailable", err)
+			}
+			t.Logf("%s: %v", helper, err)
+			continue
+		}
+		used := im.FUSEHelper()
+		im.Unmount()
+		if used != FUSEHelperDirect && used != FUSEHelperFusermount {
+			t.Errorf("%s: mount used %q", helper, used)
+		}
+		if helper != FUSEHelperAuto && used != helper {
+			t.Errorf("%s: mount used %s", helper, used)
+		}
+	}
+}
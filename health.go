@@ -0,0 +1,67 @@
+package ocifs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// healthTimeout bounds how long Healthy waits for the mount to answer.
+const healthTimeout = 5 * time.Second
+
+// Healthy checks that the mount still answers requests: the mount point must
+// be a FUSE filesystem whose root can be listed and looked up. A wedged mount
+// fails after a few seconds, though the check itself stays blocked in the
+// kernel until the mount recovers or is detached.
+func (im *ImageMount) Healthy() error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- im.checkHealth()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(healthTimeout):
+		return fmt.Errorf("mount %s did not answer within %s", im.mountPoint, healthTimeout)
+	}
+}
+
+func (im *ImageMount) checkHealth() error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(im.mountPoint, &st); err != nil {
+		return fmt.Errorf("statfs %s: %w", im.mountPoint, err)
+	}
+	if st.Type != unix.FUSE_SUPER_MAGIC {
+		return fmt.Errorf("%s is no longer mounted", im.mountPoint)
+	}
+
+	names, err := readDirNames(im.mountPoint, 1)
+	if err == nil && len(names) > 0 {
+		_, err = os.Lstat(filepath.Join(im.mountPoint, names[0]))
+	}
+	// a denial by the access policy is still an answer
+	if err != nil && !errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("read %s: %w", im.mountPoint, err)
+	}
+	return nil
+}
+
+func readDirNames(dir string, n int) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(n)
+	if err == io.EOF {
+		err = nil
+	}
+	return names, err
+}
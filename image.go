@@ -0,0 +1,360 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// maxSymlinkDepth is how many symlinks are followed while resolving a single
+// path by default, like the kernel's MAXSYMLINKS.
+const maxSymlinkDepth = 40
+
+var errSymlinkLoop = errors.New("too many levels of symbolic links")
+
+// Image is a pulled and unpacked image that can be inspected without
+// mounting it.
+type Image struct {
+	ofs *OCIFS
+	h   v1.Hash
+	ut  *unifiedTree
+}
+
+// Image pulls imgRef if needed and returns its unified view.
+func (o *OCIFS) Image(imgRef string) (*Image, error) {
+	h, err := o.pullImage(context.Background(), imgRef, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ut, _, err := o.buildTree(*h, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Image{ofs: o, h: *h, ut: ut}, nil
+}
+
+func (i *Image) Digest() v1.Hash {
+	return i.h
+}
+
+func (i *Image) ConfigFile() (*v1.ConfigFile, error) {
+	img, err := i.ofs.lp.Image(i.h)
+	if err != nil {
+		return nil, err
+	}
+
+	return img.ConfigFile()
+}
+
+// FS returns the unified view of the image as a read-only io/fs.FS. Symlinks
+// are followed within the image, absolute targets resolving from its root.
+func (i *Image) FS() iofs.FS {
+	return i.imageFS()
+}
+
+func (i *Image) imageFS() *imageFS {
+	return &imageFS{ut: i.ut, maxDepth: i.ofs.symlinkDepth}
+}
+
+type imageFS struct {
+	ut *unifiedTree
+	// maxDepth caps how many links are followed resolving a path, or
+	// maxSymlinkDepth if zero
+	maxDepth int
+}
+
+func (f *imageFS) depth() int {
+	if f.maxDepth > 0 {
+		return f.maxDepth
+	}
+	return maxSymlinkDepth
+}
+
+var (
+	_ iofs.FS        = (*imageFS)(nil)
+	_ iofs.StatFS    = (*imageFS)(nil)
+	_ iofs.ReadDirFS = (*imageFS)(nil)
+)
+
+func (f *imageFS) Open(name string) (iofs.File, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: iofs.ErrInvalid}
+	}
+
+	n, err := f.resolve(name, true)
+	if err != nil {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: err}
+	}
+	info, err := f.fileInfo(n, path.Base(name))
+	if err != nil {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if info.IsDir() {
+		return &imageDir{fs: f, node: n, info: info}, nil
+	}
+	if !info.Mode().IsRegular() {
+		return &imageFile{info: info}, nil
+	}
+
+	backing := n
+	if n.header.Typeflag == tar.TypeLink {
+		if backing, err = f.hardlinkTarget(n); err != nil {
+			return nil, &iofs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	fh, err := os.Open(backing.Path())
+	if err != nil {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &imageFile{f: fh, info: info}, nil
+}
+
+func (f *imageFS) Stat(name string) (iofs.FileInfo, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: "stat", Path: name, Err: iofs.ErrInvalid}
+	}
+
+	n, err := f.resolve(name, true)
+	if err != nil {
+		return nil, &iofs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	info, err := f.fileInfo(n, path.Base(name))
+	if err != nil {
+		return nil, &iofs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+func (f *imageFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: iofs.ErrInvalid}
+	}
+
+	n, err := f.resolve(name, true)
+	if err != nil {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if n.header != nil && n.header.Typeflag != tar.TypeDir {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := f.entries(n)
+	if err != nil {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// resolve walks name through the tree, following symlinks in intermediate
+// components, and in the last one if follow is set.
+func (f *imageFS) resolve(name string, follow bool) (*unifiedTreeNode, error) {
+	return f.walk(name, follow, 0)
+}
+
+func (f *imageFS) walk(name string, follow bool, depth int) (*unifiedTreeNode, error) {
+	node := f.ut.root
+	if name == "." || name == "" {
+		return node, nil
+	}
+
+	parts := strings.Split(name, "/")
+	cur := ""
+	for i, part := range parts {
+		p := path.Join(cur, part)
+		n, ok := f.ut.Get(p)
+		if !ok {
+			return nil, iofs.ErrNotExist
+		}
+
+		last := i == len(parts)-1
+		if n.header != nil && n.header.Typeflag == tar.TypeSymlink && (!last || follow) {
+			if depth >= f.depth() {
+				return nil, errSymlinkLoop
+			}
+			target := n.header.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join("/", cur, target)
+			}
+			rest := path.Join(append([]string{path.Clean(target)}, parts[i+1:]...)...)
+			return f.walk(strings.TrimPrefix(rest, "/"), follow, depth+1)
+		}
+
+		if !last && n.header != nil && n.header.Typeflag != tar.TypeDir {
+			return nil, iofs.ErrNotExist
+		}
+
+		cur, node = p, n
+	}
+
+	return node, nil
+}
+
+// hardlinkTarget returns the node holding the content of a hardlink,
+// following chains of hardlinks up to the depth cap.
+func (f *imageFS) hardlinkTarget(n *unifiedTreeNode) (*unifiedTreeNode, error) {
+	for i := 0; i < f.depth(); i++ {
+		if n.header == nil || n.header.Typeflag != tar.TypeLink {
+			return n, nil
+		}
+		next, ok := f.ut.LinkTarget(n)
+		if !ok {
+			return nil, iofs.ErrNotExist
+		}
+		n = next
+	}
+	return nil, errSymlinkLoop
+}
+
+func (f *imageFS) fileInfo(n *unifiedTreeNode, name string) (iofs.FileInfo, error) {
+	if n.header == nil {
+		return &imageFileInfo{name: name, mode: iofs.ModeDir | 0755}, nil
+	}
+
+	hdr, sys := *n.header, n.header
+	if hdr.Typeflag == tar.TypeLink {
+		target, err := f.hardlinkTarget(n)
+		if err != nil {
+			return nil, err
+		}
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = target.header.Size
+		// the header describing the content, with its recorded digest
+		sys = target.header
+	}
+	fi := hdr.FileInfo()
+
+	return &imageFileInfo{
+		name:    name,
+		size:    fi.Size(),
+		mode:    fi.Mode(),
+		modTime: fi.ModTime(),
+		sys:     sys,
+	}, nil
+}
+
+func (f *imageFS) entries(n *unifiedTreeNode) ([]iofs.DirEntry, error) {
+	entries := make([]iofs.DirEntry, 0, len(n.children))
+	for name, child := range n.children {
+		if child.isWhiteout {
+			continue
+		}
+		info, err := f.fileInfo(child, name)
+		if err != nil {
+			// dangling hardlinks are not served
+			continue
+		}
+		entries = append(entries, iofs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+type imageFileInfo struct {
+	name    string
+	size    int64
+	mode    iofs.FileMode
+	modTime time.Time
+	sys     any
+}
+
+func (i *imageFileInfo) Name() string        { return i.name }
+func (i *imageFileInfo) Size() int64         { return i.size }
+func (i *imageFileInfo) Mode() iofs.FileMode { return i.mode }
+func (i *imageFileInfo) ModTime() time.Time  { return i.modTime }
+func (i *imageFileInfo) IsDir() bool         { return i.mode.IsDir() }
+func (i *imageFileInfo) Sys() any            { return i.sys }
+
+// imageFile is an open regular file, or an empty stand-in for special files
+// such as devices and fifos, which have no content in a layer.
+type imageFile struct {
+	f    *os.File
+	info iofs.FileInfo
+}
+
+func (f *imageFile) Stat() (iofs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *imageFile) Read(b []byte) (int, error) {
+	if f.f == nil {
+		return 0, io.EOF
+	}
+	return f.f.Read(b)
+}
+
+func (f *imageFile) ReadAt(b []byte, off int64) (int, error) {
+	if f.f == nil {
+		return 0, io.EOF
+	}
+	return f.f.ReadAt(b, off)
+}
+
+func (f *imageFile) Seek(offset int64, whence int) (int64, error) {
+	if f.f == nil {
+		return 0, nil
+	}
+	return f.f.Seek(offset, whence)
+}
+
+func (f *imageFile) Close() error {
+	if f.f == nil {
+		return nil
+	}
+	return f.f.Close()
+}
+
+type imageDir struct {
+	fs      *imageFS
+	node    *unifiedTreeNode
+	info    iofs.FileInfo
+	entries []iofs.DirEntry
+	read    bool
+}
+
+func (d *imageDir) Stat() (iofs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *imageDir) Read([]byte) (int, error) {
+	return 0, &iofs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *imageDir) Close() error {
+	return nil
+}
+
+func (d *imageDir) ReadDir(count int) ([]iofs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fs.entries(d.node)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	count = min(count, len(d.entries))
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
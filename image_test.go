@@ -0,0 +1,255 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// writeTestLayer writes the content of the regular files in files below
+// a new temporary directory and returns it, as unpackLayer would.
+func writeTestLayer(t *testing.T, files []*tar.Header, content map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, h := range files {
+		p := filepath.Join(dir, h.Name)
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatal(err)
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, []byte(content[h.Name]), 0644); err != nil {
+				t.Fatal(err)
+			}
+			h.Size = int64(len(content[h.Name]))
+		}
+	}
+	return dir
+}
+
+func TestImageFS(t *testing.T) {
+	now := time.Now()
+	content := map[string]string{
+		"etc/hosts":      "127.0.0.1 localhost\n",
+		"etc/passwd":     "root:x:0:0\n",
+		"usr/bin/tool":   "#!/bin/sh\n",
+		"usr/lib/a.so":   "elf",
+		"etc/motd":       "welcome\n",
+		"usr/bin/tool.2": "v2",
+	}
+
+	l1 := []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: now},
+		{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644, ModTime: now},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, ModTime: now},
+		{Name: "usr/bin/tool", Typeflag: tar.TypeReg, Mode: 0755, ModTime: now},
+		{Name: "usr/lib/a.so", Typeflag: tar.TypeReg, Mode: 0644, ModTime: now},
+	}
+	l2 := []*tar.Header{
+		{Name: "etc/.wh.passwd", Typeflag: tar.TypeReg, Mode: 0644, ModTime: now},
+		{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0644, ModTime: now},
+		{Name: "etc/issue", Typeflag: tar.TypeLink, Linkname: "etc/motd", Mode: 0644, ModTime: now},
+		{Name: "usr/bin/tool.2", Typeflag: tar.TypeReg, Mode: 0755, ModTime: now},
+		{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: "usr/lib", Mode: 0777, ModTime: now},
+		{Name: "usr/bin/current", Typeflag: tar.TypeSymlink, Linkname: "/usr/bin/tool.2", Mode: 0777, ModTime: now},
+	}
+
+	ut := newUnifiedTree()
+	ut.AddLayer(writeTestLayer(t, l1, content), l1)
+	ut.AddLayer(writeTestLayer(t, l2, content), l2)
+	fsys := &imageFS{ut: ut}
+
+	if err := fstest.TestFS(fsys,
+		"etc/hosts", "etc/motd", "etc/issue",
+		"usr/bin/tool", "usr/bin/tool.2", "usr/bin/current", "usr/lib/a.so",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Stat(fsys, "etc/passwd"); !os.IsNotExist(err) {
+		t.Errorf("whited out file: got err %v, want not exist", err)
+	}
+
+	data, err := fs.ReadFile(fsys, "etc/issue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content["etc/motd"] {
+		t.Errorf("hardlink content = %q, want %q", data, content["etc/motd"])
+	}
+
+	data, err = fs.ReadFile(fsys, "usr/bin/current")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content["usr/bin/tool.2"] {
+		t.Errorf("symlink content = %q, want %q", data, content["usr/bin/tool.2"])
+	}
+
+	data, err = fs.ReadFile(fsys, "lib/a.so")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content["usr/lib/a.so"] {
+		t.Errorf("content through symlinked dir = %q, want %q", data, content["usr/lib/a.so"])
+	}
+}
+
+func TestImageFSSymlinkLoop(t *testing.T) {
+	ut := newUnifiedTree()
+	ut.AddLayer(t.TempDir(), []*tar.Header{
+		{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "b"},
+		{Name: "b", Typeflag: tar.TypeSymlink, Linkname: "/a"},
+	})
+	fsys := &imageFS{ut: ut}
+
+	if _, err := fsys.Open("a"); err == nil {
+		t.Fatal("expected an error opening a symlink loop")
+	}
+}
+
+func TestImageFSSymlinkDepth(t *testing.T) {
+	files := []*tar.Header{
+		{Name: "target", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "l1", Typeflag: tar.TypeSymlink, Linkname: "target"},
+		{Name: "l2", Typeflag: tar.TypeSymlink, Linkname: "l1"},
+		{Name: "l3", Typeflag: tar.TypeSymlink, Linkname: "l2"},
+		{Name: "h1", Typeflag: tar.TypeLink, Linkname: "h2"},
+		{Name: "h2", Typeflag: tar.TypeLink, Linkname: "h1"},
+	}
+	ut := newUnifiedTree()
+	ut.AddLayer(writeTestLayer(t, files, map[string]string{"target": "data"}), files)
+
+	tests := []struct {
+		maxDepth int
+		name     string
+		wantErr  error
+	}{
+		{0, "l3", nil},
+		{3, "l3", nil},
+		{2, "l3", errSymlinkLoop},
+		{2, "l2", nil},
+		{0, "h1", errSymlinkLoop},
+	}
+	for _, tt := range tests {
+		fsys := &imageFS{ut: ut, maxDepth: tt.maxDepth}
+		_, err := fs.ReadFile(fsys, tt.name)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("depth %d, read %s: got err %v, want %v", tt.maxDepth, tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestImageFSHardlinkLayers(t *testing.T) {
+	type layer struct {
+		files   []*tar.Header
+		content map[string]string
+	}
+	reg := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+	}
+	link := func(name, target string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeLink, Linkname: target, Mode: 0644}
+	}
+
+	tests := []struct {
+		name   string
+		layers []layer
+		want   map[string]string
+		absent []string
+	}{
+		{
+			name: "target whited out",
+			layers: []layer{
+				{[]*tar.Header{reg("bin/busybox"), link("bin/sh", "bin/busybox")}, map[string]string{"bin/busybox": "bb"}},
+				{[]*tar.Header{reg("bin/.wh.busybox")}, nil},
+			},
+			want:   map[string]string{"bin/sh": "bb"},
+			absent: []string{"bin/busybox"},
+		},
+		{
+			name: "target replaced",
+			layers: []layer{
+				{[]*tar.Header{reg("bin/busybox"), link("bin/sh", "bin/busybox")}, map[string]string{"bin/busybox": "v1"}},
+				{[]*tar.Header{reg("bin/busybox")}, map[string]string{"bin/busybox": "v2"}},
+			},
+			want: map[string]string{"bin/sh": "v1", "bin/busybox": "v2"},
+		},
+		{
+			name: "chain with target whited out",
+			layers: []layer{
+				{[]*tar.Header{reg("a"), link("b", "a"), link("c", "b")}, map[string]string{"a": "data"}},
+				{[]*tar.Header{reg(".wh.a"), reg(".wh.b")}, nil},
+			},
+			want:   map[string]string{"c": "data"},
+			absent: []string{"a", "b"},
+		},
+		{
+			name: "target dir made opaque",
+			layers: []layer{
+				{[]*tar.Header{reg("lib/libc.so"), link("usr/libc.so", "lib/libc.so")}, map[string]string{"lib/libc.so": "libc"}},
+				{[]*tar.Header{reg("lib/.wh..wh..opq")}, nil},
+			},
+			want:   map[string]string{"usr/libc.so": "libc"},
+			absent: []string{"lib/libc.so"},
+		},
+		{
+			name: "link added after target replaced",
+			layers: []layer{
+				{[]*tar.Header{reg("bin/busybox")}, map[string]string{"bin/busybox": "v1"}},
+				{[]*tar.Header{reg("bin/busybox"), link("bin/sh", "bin/busybox")}, map[string]string{"bin/busybox": "v2"}},
+			},
+			want: map[string]string{"bin/sh": "v2", "bin/busybox": "v2"},
+		},
+		{
+			name: "link replaced by file",
+			layers: []layer{
+				{[]*tar.Header{reg("bin/busybox"), link("bin/sh", "bin/busybox")}, map[string]string{"bin/busybox": "bb"}},
+				{[]*tar.Header{reg("bin/sh")}, map[string]string{"bin/sh": "dash"}},
+			},
+			want: map[string]string{"bin/sh": "dash", "bin/busybox": "bb"},
+		},
+		{
+			name: "target never existed",
+			layers: []layer{
+				{[]*tar.Header{link("bin/sh", "bin/busybox")}, nil},
+			},
+			absent: []string{"bin/sh"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ut := newUnifiedTree()
+			for _, l := range tt.layers {
+				ut.AddLayer(writeTestLayer(t, l.files, l.content), l.files)
+			}
+			fsys := &imageFS{ut: ut}
+
+			for name, want := range tt.want {
+				data, err := fs.ReadFile(fsys, name)
+				if err != nil {
+					t.Errorf("read %s: %v", name, err)
+					continue
+				}
+				if string(data) != want {
+					t.Errorf("%s = %q, want %q", name, data, want)
+				}
+			}
+			for _, name := range tt.absent {
+				if _, err := fs.ReadFile(fsys, name); err == nil {
+					t.Errorf("%s is readable, want it absent", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package ocifs
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// WithPlatform picks the image built for platform when a reference resolves
+// to an index. The default is linux on the architecture of the host.
+var WithPlatform = func(platform v1.Platform) Option {
+	return func(o *OCIFS) {
+		o.platform = platform
+	}
+}
+
+// WithIndexAnnotation picks, when a reference resolves to an index, the
+// image whose descriptor has the annotation key set to value. An image
+// picked by annotation does not need to match the platform. It can be given
+// more than once to require several annotations.
+var WithIndexAnnotation = func(key, value string) Option {
+	return func(o *OCIFS) {
+		if o.indexAnnots == nil {
+			o.indexAnnots = make(map[string]string)
+		}
+		o.indexAnnots[key] = value
+	}
+}
+
+// defaultPlatform is linux on the architecture of the host.
+func defaultPlatform() v1.Platform {
+	return v1.Platform{OS: "linux", Architecture: runtime.GOARCH}
+}
+
+// selectImage picks the image to use from idx, see selectManifest.
+func (s *OCIFS) selectImage(idx v1.ImageIndex) (v1.Image, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	desc, err := s.selectManifest(im)
+	if err != nil {
+		return nil, err
+	}
+	return idx.Image(desc.Digest)
+}
+
+// selectManifest picks the image to use from an index. Attestations, such
+// as the provenance buildkit adds to indexes, are never picked. With
+// annotations set, the image matching them is used when there is a single
+// one; otherwise the first image matching the platform among them is.
+func (s *OCIFS) selectManifest(im *v1.IndexManifest) (v1.Descriptor, error) {
+	var candidates []v1.Descriptor
+	for _, desc := range im.Manifests {
+		if !desc.MediaType.IsImage() || isAttestation(desc) || !hasAnnotations(desc, s.indexAnnots) {
+			continue
+		}
+		candidates = append(candidates, desc)
+	}
+	if len(s.indexAnnots) > 0 && len(candidates) == 1 {
+		return candidates[0], nil
+	}
+
+	var available []string
+	for _, desc := range candidates {
+		if desc.Platform == nil {
+			continue
+		}
+		if desc.Platform.Satisfies(s.platform) {
+			return desc, nil
+		}
+		available = append(available, desc.Platform.String())
+	}
+	return v1.Descriptor{}, fmt.Errorf("no image for %s in index, it has %s", s.platform, strings.Join(available, ", "))
+}
+
+// isAttestation reports whether desc is an attestation manifest rather than
+// an image, as buildkit marks them.
+func isAttestation(desc v1.Descriptor) bool {
+	if desc.Annotations["vnd.docker.reference.type"] == "attestation-manifest" {
+		return true
+	}
+	return desc.Platform != nil && desc.Platform.OS == "unknown" && desc.Platform.Architecture == "unknown"
+}
+
+func hasAnnotations(desc v1.Descriptor, want map[string]string) bool {
+	for k, v := range want {
+		if desc.Annotations[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+package ocifs
+
+import (
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestSelectImage(t *testing.T) {
+	type entry struct {
+		platform    *v1.Platform
+		annotations map[string]string
+	}
+	entries := map[string]entry{
+		"attestation": {&v1.Platform{OS: "unknown", Architecture: "unknown"}, map[string]string{"vnd.docker.reference.type": "attestation-manifest"}},
+		"amd64":       {&v1.Platform{OS: "linux", Architecture: "amd64"}, nil},
+		"arm64":       {&v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, nil},
+		"debug":       {&v1.Platform{OS: "linux", Architecture: "amd64"}, map[string]string{"org.example.flavor": "debug"}},
+		"wasm":        {nil, map[string]string{"org.example.flavor": "wasm"}},
+	}
+
+	idx := v1.ImageIndex(empty.Index)
+	digests := map[v1.Hash]string{}
+	// the attestation comes first, so picking the first manifest is wrong
+	for _, name := range []string{"attestation", "amd64", "arm64", "debug", "wasm"} {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		digests[h] = name
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: entries[name].platform, Annotations: entries[name].annotations},
+		})
+	}
+
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"skips attestation", []Option{WithPlatform(v1.Platform{OS: "linux", Architecture: "amd64"})}, "amd64"},
+		{"platform", []Option{WithPlatform(v1.Platform{OS: "linux", Architecture: "arm64"})}, "arm64"},
+		{"annotation", []Option{WithIndexAnnotation("org.example.flavor", "debug")}, "debug"},
+		{"annotation without platform", []Option{WithIndexAnnotation("org.example.flavor", "wasm")}, "wasm"},
+		{"no match", []Option{WithPlatform(v1.Platform{OS: "linux", Architecture: "s390x"})}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ofs, err := New(append([]Option{WithWorkDir(t.TempDir())}, tt.opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := ofs.selectImage(idx)
+			if tt.want == "" {
+				if err == nil {
+					t.Error("selectImage succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, err := img.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := digests[h]; got != tt.want {
+				t.Errorf("selectImage picked %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package ocifs
+
+import (
+	"fmt"
+	"path"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+type labelPolicy struct {
+	label   string
+	allowed []string
+}
+
+// checkLabels returns an error naming the first policy the labels in cfg do
+// not satisfy.
+func checkLabels(policies []labelPolicy, cfg *v1.ConfigFile) error {
+	for _, p := range policies {
+		value, ok := cfg.Config.Labels[p.label]
+		if !ok {
+			return fmt.Errorf("missing label %s", p.label)
+		}
+		if !labelAllowed(value, p.allowed) {
+			return fmt.Errorf("label %s=%q is not allowed", p.label, value)
+		}
+	}
+	return nil
+}
+
+func labelAllowed(value string, allowed []string) bool {
+	for _, pattern := range allowed {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package ocifs
+
+import (
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestCheckLabels(t *testing.T) {
+	const licenses = "org.opencontainers.image.licenses"
+	policies := []labelPolicy{{label: licenses, allowed: []string{"MIT", "Apache-*"}}}
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		ok     bool
+	}{
+		{"exact match", map[string]string{licenses: "MIT"}, true},
+		{"pattern match", map[string]string{licenses: "Apache-2.0"}, true},
+		{"not allowed", map[string]string{licenses: "GPL-3.0"}, false},
+		{"missing label", map[string]string{"other": "MIT"}, false},
+		{"no labels", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &v1.ConfigFile{Config: v1.Config{Labels: tt.labels}}
+			err := checkLabels(policies, cfg)
+			if (err == nil) != tt.ok {
+				t.Errorf("checkLabels() error = %v, want ok = %v", err, tt.ok)
+			}
+		})
+	}
+
+	if err := checkLabels(nil, &v1.ConfigFile{}); err != nil {
+		t.Errorf("checkLabels() without policies = %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package ocifs
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// WithLogSampling caps the debug lines logged for op, such as OpRead or
+// OpOpen, at perSecond across all mounts, so debug logging stays usable under
+// load. The next line logged after some were dropped reports how many.
+// Release of files is sampled with OpOpen. Ops without a limit are all logged.
+var WithLogSampling = func(op Op, perSecond int) Option {
+	return func(o *OCIFS) {
+		if o.logLimits == nil {
+			o.logLimits = make(map[Op]int)
+		}
+		o.logLimits[op] = perSecond
+	}
+}
+
+// logSampler rate limits debug logging per op.
+type logSampler struct {
+	limits  map[Op]int
+	mu      sync.Mutex
+	windows map[Op]*logWindow
+}
+
+// logWindow counts the lines of an op logged and dropped in the current
+// second.
+type logWindow struct {
+	start   time.Time
+	logged  int
+	dropped int
+}
+
+func newLogSampler(limits map[Op]int) *logSampler {
+	return &logSampler{limits: limits, windows: make(map[Op]*logWindow)}
+}
+
+// debug logs msg at debug level, unless op is over its limit. It is safe to
+// call on a nil sampler, which logs everything.
+func (s *logSampler) debug(op Op, msg string, args ...any) {
+	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	if s == nil {
+		slog.Debug(msg, args...)
+		return
+	}
+	limit, ok := s.limits[op]
+	if !ok {
+		slog.Debug(msg, args...)
+		return
+	}
+
+	s.mu.Lock()
+	w := s.windows[op]
+	now := time.Now()
+	if w == nil || now.Sub(w.start) >= time.Second {
+		if w == nil {
+			w = &logWindow{}
+			s.windows[op] = w
+		}
+		w.start, w.logged = now, 0
+	}
+	if w.logged >= limit {
+		w.dropped++
+		s.mu.Unlock()
+		return
+	}
+	w.logged++
+	dropped := w.dropped
+	w.dropped = 0
+	s.mu.Unlock()
+
+	if dropped > 0 {
+		args = append(args, "dropped", dropped)
+	}
+	slog.Debug(msg, args...)
+}
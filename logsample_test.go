@@ -0,0 +1,37 @@
+package ocifs
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogSampler(t *testing.T) {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer slog.SetDefault(prev)
+
+	s := newLogSampler(map[Op]int{OpRead: 3})
+	for i := 0; i < 100; i++ {
+		s.debug(OpRead, "Read")
+		s.debug(OpOpen, "Open")
+	}
+
+	out := buf.String()
+	if n := strings.Count(out, "msg=Read"); n != 3 {
+		t.Errorf("logged %d reads, want 3", n)
+	}
+	if n := strings.Count(out, "msg=Open"); n != 100 {
+		t.Errorf("logged %d opens, want all 100", n)
+	}
+
+	// a new window reports what the previous one dropped
+	s.windows[OpRead].start = s.windows[OpRead].start.Add(-2e9)
+	buf.Reset()
+	s.debug(OpRead, "Read")
+	if !strings.Contains(buf.String(), "dropped=97") {
+		t.Errorf("got %q, want it to report 97 dropped lines", buf.String())
+	}
+}
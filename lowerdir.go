@@ -0,0 +1,59 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// hostDirHeaders walks a host directory and returns tar headers for its
+// entries, so it can be added to a unifiedTree like an unpacked layer.
+func hostDirHeaders(root string) ([]*tar.Header, error) {
+	idx := []*tar.Header{}
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			slog.Debug("skipping lower dir entry", "path", p, "error", err)
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+
+		idx = append(idx, hdr)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return idx, nil
+}
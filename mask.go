@@ -0,0 +1,97 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// hideLayer returns whiteout headers removing paths, and hardlinks to them,
+// from the tree. Paths that are not in the tree are skipped.
+func hideLayer(ut *unifiedTree, paths []string) []*tar.Header {
+	hdrs := []*tar.Header{}
+	for _, p := range paths {
+		p = strings.Trim(path.Clean("/"+p), "/")
+		if p == "" {
+			continue
+		}
+		if _, ok := ut.Get(p); !ok {
+			continue
+		}
+		for _, hp := range append(ut.linksTo(p), p) {
+			dir, base := path.Split(hp)
+			hdrs = append(hdrs, &tar.Header{
+				Name:     path.Join(dir, ".wh."+base),
+				Typeflag: tar.TypeReg,
+			})
+		}
+	}
+	return hdrs
+}
+
+// maskLayer writes the replacement content of masked files to a new
+// directory under the work dir and returns it with headers for its files, so
+// they can be added to the tree like an unpacked layer. Masked files keep the
+// ownership and mode of the regular file they replace, and hardlinks to them
+// are masked too.
+func (o *OCIFS) maskLayer(ut *unifiedTree, masked map[string][]byte) (string, []*tar.Header, error) {
+	masksDir := filepath.Join(o.workDir, "masks")
+	if err := os.MkdirAll(masksDir, 0755); err != nil {
+		return "", nil, err
+	}
+	dir, err := os.MkdirTemp(masksDir, "")
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	hdrs := []*tar.Header{}
+	for p, data := range masked {
+		p = strings.Trim(path.Clean("/"+p), "/")
+		if p == "" {
+			continue
+		}
+
+		hdr := &tar.Header{
+			Name:       p,
+			Typeflag:   tar.TypeReg,
+			Mode:       0644,
+			Size:       int64(len(data)),
+			ModTime:    now,
+			AccessTime: now,
+			ChangeTime: now,
+		}
+		if n, ok := ut.Get(p); ok && n.Header() != nil && n.Header().Typeflag == tar.TypeReg {
+			hdr.Mode = n.Header().Mode
+			hdr.Uid = n.Header().Uid
+			hdr.Gid = n.Header().Gid
+		}
+
+		hostPath := filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(hostPath), 0755); err != nil {
+			os.RemoveAll(dir)
+			return "", nil, err
+		}
+		if err := os.WriteFile(hostPath, data, 0644); err != nil {
+			os.RemoveAll(dir)
+			return "", nil, err
+		}
+		hdrs = append(hdrs, hdr)
+		for _, l := range ut.linksTo(p) {
+			hdrs = append(hdrs, &tar.Header{
+				Name:     l,
+				Typeflag: tar.TypeLink,
+				Linkname: p,
+				Mode:     hdr.Mode,
+				Uid:      hdr.Uid,
+				Gid:      hdr.Gid,
+				ModTime:  now,
+			})
+		}
+	}
+
+	return dir, hdrs, nil
+}
@@ -0,0 +1,74 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+)
+
+func TestMountMaskedHardlinks(t *testing.T) {
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	pushTarImage(t, ref, []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0640, Uid: 0, Gid: 42},
+		{Name: "etc/shadow-", Typeflag: tar.TypeLink, Linkname: "etc/shadow"},
+		{Name: "etc/secret", Typeflag: tar.TypeReg, Mode: 0600},
+		{Name: "etc/secret.bak", Typeflag: tar.TypeLink, Linkname: "etc/secret"},
+	}, map[string]string{"etc/shadow": "root:hash:", "etc/secret": "token"})
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := ofs.Mount(ref.String(), MountWithTargetPath(t.TempDir()),
+		MountWithMaskedFiles(map[string][]byte{"/etc/shadow": []byte("root:*:")}),
+		MountWithHiddenPaths([]string{"/etc/secret"}))
+	if errors.Is(err, ErrFUSEUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Unmount()
+	etc := filepath.Join(im.MountPoint(), "etc")
+
+	// both names of the masked file serve the replacement with the
+	// original mode and owner
+	for _, name := range []string{"shadow", "shadow-"} {
+		p := filepath.Join(etc, name)
+		data, err := os.ReadFile(p)
+		if err != nil || string(data) != "root:*:" {
+			t.Errorf("%s: content %q, %v, want the replacement", name, data, err)
+		}
+		fi, err := os.Lstat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if fi.Mode() != 0640 || st.Uid != 0 || st.Gid != 42 {
+			t.Errorf("%s: mode %v owner %d:%d, want -rw-r----- 0:42", name, fi.Mode(), st.Uid, st.Gid)
+		}
+	}
+
+	// both names of the hidden file are gone
+	entries, err := os.ReadDir(etc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := []string{"shadow", "shadow-"}; !slices.Equal(names, want) {
+		t.Errorf("entries %v, want %v", names, want)
+	}
+	for _, name := range []string{"secret", "secret.bak"} {
+		if _, err := os.Lstat(filepath.Join(etc, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: %v, want it hidden", name, err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package ocifs
+
+import (
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// HelmChartContentMediaType is the layer media type of a Helm chart pushed
+// to an OCI registry.
+const HelmChartContentMediaType types.MediaType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+
+// Media types of WebAssembly artifacts: the CNCF wasm OCI format and the
+// older layer types of wasm-to-oci and crun.
+const (
+	WasmConfigMediaType        types.MediaType = "application/vnd.wasm.config.v0+json"
+	WasmLayerMediaType         types.MediaType = "application/wasm"
+	WasmContentLayerMediaType  types.MediaType = "application/vnd.wasm.content.layer.v1+wasm"
+	WasmModuleContentMediaType types.MediaType = "application/vnd.module.wasm.content.layer.v1+wasm"
+)
+
+const annotationTitle = "org.opencontainers.image.title"
+
+// layerFormat describes how the content of a layer media type is unpacked.
+type layerFormat struct {
+	// strip is the number of leading path components removed from the
+	// names of the entries of the tar.
+	strip int
+	// raw layers are not tars but a single file, served at the root under
+	// the layer's title annotation, or name if it has none.
+	raw  bool
+	name string
+	// windows layers hold their filesystem below Files/, see windowsName
+	windows bool
+	// open returns the tar to unpack, rather than the uncompressed layer,
+	// for media types added with WithLayerMediaType
+	open func(v1.Layer) (io.ReadCloser, error)
+}
+
+// WithLayerMediaType unpacks layers of media type mt from the tar stream
+// open returns for them, such as after decrypting or converting the layer.
+// It also overrides how built in media types are unpacked.
+var WithLayerMediaType = func(mt types.MediaType, open func(l v1.Layer) (io.ReadCloser, error)) Option {
+	return func(o *OCIFS) {
+		if o.layerFormats == nil {
+			o.layerFormats = make(map[types.MediaType]layerFormat)
+		}
+		o.layerFormats[mt] = layerFormat{open: open}
+	}
+}
+
+var layerFormats = map[types.MediaType]layerFormat{
+	"":                                   {},
+	types.OCILayer:                       {},
+	types.OCILayerZStd:                   {},
+	types.OCIUncompressedLayer:           {},
+	types.OCIRestrictedLayer:             {},
+	types.OCIUncompressedRestrictedLayer: {},
+	types.DockerLayer:                    {},
+	types.DockerUncompressedLayer:        {},
+	types.DockerForeignLayer:             {},
+	// chart tars hold a single directory named after the chart, serve its
+	// content at the root instead
+	HelmChartContentMediaType:  {strip: 1},
+	WasmLayerMediaType:         {raw: true, name: "module.wasm"},
+	WasmContentLayerMediaType:  {raw: true, name: "module.wasm"},
+	WasmModuleContentMediaType: {raw: true, name: "module.wasm"},
+}
+
+// configFormats lists the config media types whose config blob is served as
+// a file next to the layers.
+var configFormats = map[types.MediaType]layerFormat{
+	WasmConfigMediaType: {raw: true, name: "config.json"},
+}
+
+// fsLayer is a layer holding filesystem content, with what is needed to
+// unpack it.
+type fsLayer struct {
+	v1.Layer
+	format layerFormat
+	title  string
+}
+
+// fileName returns the name a raw layer is served under.
+func (l fsLayer) fileName() string {
+	if l.title != "" {
+		if name := path.Base(path.Clean("/" + l.title)); name != "/" {
+			return name
+		}
+	}
+	return l.format.name
+}
+
+// content returns what is unpacked for the layer.
+func (l fsLayer) content() (io.ReadCloser, error) {
+	if l.format.open != nil {
+		return l.format.open(l.Layer)
+	}
+	return l.Uncompressed()
+}
+
+// fsLayers returns the layers of img that hold filesystem content, skipping
+// others such as provenance files attached to Helm charts, and foreign
+// layers when they are ignored. Configs of artifact types that are served as
+// files come last, as a layer of their own.
+func (s *OCIFS) fsLayers(img v1.Image) ([]fsLayer, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	windows, err := isWindowsImage(img)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]fsLayer, 0, len(layers)+1)
+	for i, l := range layers {
+		mt, err := l.MediaType()
+		if err != nil {
+			return nil, err
+		}
+		if s.ignoreForeign && isForeign(mt) {
+			continue
+		}
+		format, ok := s.layerFormats[mt]
+		if !ok {
+			format, ok = layerFormats[mt]
+		}
+		if !ok {
+			slog.Debug("skipping layer", "mediaType", mt)
+			continue
+		}
+		format.windows = windows
+		fl := fsLayer{Layer: l, format: format}
+		if i < len(m.Layers) {
+			fl.title = m.Layers[i].Annotations[annotationTitle]
+		}
+		out = append(out, fl)
+	}
+
+	if format, ok := configFormats[m.Config.MediaType]; ok {
+		raw, err := img.RawConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, fsLayer{Layer: static.NewLayer(raw, m.Config.MediaType), format: format})
+	}
+
+	return out, nil
+}
+
+// stripComponents removes the first n components of the slash separated
+// name. It returns false if nothing is left.
+func stripComponents(name string, n int) (string, bool) {
+	if n == 0 {
+		return name, true
+	}
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	if len(parts) <= n {
+		return "", false
+	}
+	stripped := strings.Join(parts[n:], "/")
+	if strings.HasSuffix(name, "/") {
+		stripped += "/"
+	}
+	return stripped, true
+}
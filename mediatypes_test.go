@@ -0,0 +1,78 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestLayerMediaType(t *testing.T) {
+	const mt types.MediaType = "application/vnd.example.layer.v1.tar+xor"
+	xor := func(b []byte) []byte {
+		out := make([]byte, len(b))
+		for i := range b {
+			out[i] = b[i] ^ 0xff
+		}
+		return out
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "etc/secret", Typeflag: tar.TypeReg, Mode: 0644, Size: 6}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("hidden")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.AppendLayers(empty.Image, static.NewLayer(xor(buf.Bytes()), mt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	lp, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lp.AppendImage(img); err != nil {
+		t.Fatal(err)
+	}
+
+	ofs, err := New(WithWorkDir(t.TempDir()), WithLayerMediaType(mt, func(l v1.Layer) (io.ReadCloser, error) {
+		rc, err := l.Compressed()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(xor(data))), nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ofs.Image("oci:" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := fs.ReadFile(got.FS(), "etc/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hidden" {
+		t.Errorf("etc/secret = %q, want %q", data, "hidden")
+	}
+}
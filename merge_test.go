@@ -0,0 +1,275 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func regHdr(name string) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+}
+
+func dirHdr(name string) *tar.Header {
+	return &tar.Header{Name: name + "/", Typeflag: tar.TypeDir, Mode: 0755}
+}
+
+func symlinkHdr(name, target string) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target, Mode: 0777}
+}
+
+func hardlinkHdr(name, target string) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeLink, Linkname: target, Mode: 0644}
+}
+
+// mergeCases are layer stacks, lowest first, with every path visible once
+// they are merged.
+var mergeCases = []struct {
+	name    string
+	layers  [][]*tar.Header
+	visible []string
+}{{
+	name: "file whiteout",
+	layers: [][]*tar.Header{
+		{dirHdr("a"), regHdr("a/x"), regHdr("a/y")},
+		{regHdr("a/.wh.x")},
+	},
+	visible: []string{"a", "a/y"},
+}, {
+	name: "directory whiteout",
+	layers: [][]*tar.Header{
+		{dirHdr("a"), regHdr("a/x"), dirHdr("a/d"), regHdr("a/d/y"), regHdr("b")},
+		{regHdr(".wh.a")},
+	},
+	visible: []string{"b"},
+}, {
+	name: "recreated after whiteout",
+	layers: [][]*tar.Header{
+		{dirHdr("a"), regHdr("a/x")},
+		{regHdr(".wh.a")},
+		{dirHdr("a"), regHdr("a/z")},
+	},
+	visible: []string{"a", "a/z"},
+}, {
+	name: "opaque directory",
+	layers: [][]*tar.Header{
+		{dirHdr("a"), regHdr("a/x"), dirHdr("a/d"), regHdr("a/d/y")},
+		{dirHdr("a"), regHdr("a/.wh..wh..opq"), regHdr("a/n")},
+	},
+	visible: []string{"a", "a/n"},
+}, {
+	name: "opaque directory after its entries",
+	layers: [][]*tar.Header{
+		{dirHdr("a"), regHdr("a/x"), dirHdr("a/d"), regHdr("a/d/y")},
+		{dirHdr("a"), dirHdr("a/d"), regHdr("a/d/z"), regHdr("a/.wh..wh..opq")},
+	},
+	visible: []string{"a", "a/d", "a/d/z"},
+}, {
+	name: "opaque directory in a whited out parent",
+	layers: [][]*tar.Header{
+		{dirHdr("a"), dirHdr("a/b"), regHdr("a/b/x")},
+		{regHdr(".wh.a")},
+		{dirHdr("a"), dirHdr("a/b"), regHdr("a/b/.wh..wh..opq")},
+	},
+	visible: []string{"a", "a/b"},
+}, {
+	name: "file replacing a directory",
+	layers: [][]*tar.Header{
+		{dirHdr("a"), regHdr("a/x"), dirHdr("a/d"), regHdr("a/d/y")},
+		{regHdr("a")},
+	},
+	visible: []string{"a"},
+}, {
+	name: "symlink replacing a directory",
+	layers: [][]*tar.Header{
+		{dirHdr("a"), regHdr("a/x"), dirHdr("b"), regHdr("b/y")},
+		{symlinkHdr("a", "b")},
+	},
+	visible: []string{"a", "b", "b/y"},
+}, {
+	name: "directory replacing a file",
+	layers: [][]*tar.Header{
+		{regHdr("a"), regHdr("b")},
+		{regHdr("a/x")},
+	},
+	visible: []string{"a", "a/x", "b"},
+}, {
+	name: "whiteout of an entry of the same layer",
+	layers: [][]*tar.Header{
+		{dirHdr("a"), regHdr("a/x")},
+		{regHdr("a/y"), regHdr("a/.wh.y")},
+	},
+	visible: []string{"a", "a/x", "a/y"},
+}, {
+	name: "whiteout of a directory holding entries of the same layer",
+	layers: [][]*tar.Header{
+		{dirHdr("a"), regHdr("a/x"), dirHdr("a/d"), regHdr("a/d/y")},
+		{regHdr("a/z"), regHdr(".wh.a")},
+	},
+	visible: []string{"a", "a/z"},
+}, {
+	name: "hardlink to a whited out file",
+	layers: [][]*tar.Header{
+		{regHdr("f")},
+		{hardlinkHdr("g", "f")},
+		{regHdr(".wh.f")},
+	},
+	visible: []string{"g"},
+}, {
+	name: "whiteout of a missing entry",
+	layers: [][]*tar.Header{
+		{regHdr("a")},
+		{regHdr(".wh.b"), regHdr("c/.wh.d")},
+	},
+	visible: []string{"a", "c"},
+}}
+
+// mentioned returns every path named in layers, and their parents, except
+// whiteouts.
+func mentioned(layers [][]*tar.Header) []string {
+	seen := map[string]bool{}
+	for _, hdrs := range layers {
+		for _, hdr := range hdrs {
+			for p := strings.Trim(hdr.Name, "/"); p != "." && p != ""; p = path.Dir(p) {
+				if !strings.HasPrefix(path.Base(p), ".wh.") {
+					seen[p] = true
+				}
+			}
+		}
+	}
+	var paths []string
+	for p := range seen {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestUnifiedTreeMerge(t *testing.T) {
+	for _, tc := range mergeCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tree := newUnifiedTree()
+			for i, hdrs := range tc.layers {
+				tree.AddLayer(fmt.Sprintf("/layer%d", i), hdrs)
+			}
+
+			visible := map[string]bool{}
+			for _, p := range tc.visible {
+				visible[p] = true
+			}
+			for _, p := range mentioned(tc.layers) {
+				if _, ok := tree.Get(p); ok != visible[p] {
+					t.Errorf("Get(%q) found %v, want %v", p, ok, visible[p])
+				}
+				if _, ok := tree.Whiteout(p); ok && visible[p] {
+					t.Errorf("Whiteout(%q) reported a visible path", p)
+				}
+			}
+			tree.Traverse(func(n *unifiedTreeNode, p string) bool {
+				if p = strings.Trim(p, "/"); p != "" && !visible[p] {
+					t.Errorf("Traverse visited hidden %q", p)
+				}
+				return true
+			})
+		})
+	}
+}
+
+// TestMountMerge checks that listing the mount, looking its entries up and
+// walking Image.FS agree on every merge case.
+func TestMountMerge(t *testing.T) {
+	host := testRegistry(t, nil)
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range mergeCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := name.ParseReference(fmt.Sprintf("%s/merge%d:v1", host, i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var layers []v1.Layer
+			for _, hdrs := range tc.layers {
+				layers = append(layers, tarLayer(t, hdrs, nil))
+			}
+			img, err := mutate.AppendLayers(empty.Image, layers...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := remote.Write(ref, img); err != nil {
+				t.Fatal(err)
+			}
+
+			im, err := ofs.Mount(ref.String(), MountWithTargetPath(t.TempDir()))
+			if errors.Is(err, ErrFUSEUnavailable) {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer im.Unmount()
+
+			var listed []string
+			err = filepath.WalkDir(im.MountPoint(), func(p string, d iofs.DirEntry, err error) error {
+				if err != nil || p == im.MountPoint() {
+					return err
+				}
+				rel, _ := filepath.Rel(im.MountPoint(), p)
+				listed = append(listed, filepath.ToSlash(rel))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(listed, tc.visible) {
+				t.Errorf("mount lists %q, want %q", listed, tc.visible)
+			}
+
+			visible := map[string]bool{}
+			for _, p := range tc.visible {
+				visible[p] = true
+			}
+			for _, p := range mentioned(tc.layers) {
+				_, err := os.Lstat(filepath.Join(im.MountPoint(), p))
+				if found := err == nil; found != visible[p] {
+					t.Errorf("lookup of %q found %v, want %v: %v", p, found, visible[p], err)
+				}
+			}
+
+			image, err := ofs.Image(ref.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var walked []string
+			err = iofs.WalkDir(image.FS(), ".", func(p string, d iofs.DirEntry, err error) error {
+				if err != nil || p == "." {
+					return err
+				}
+				walked = append(walked, p)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(walked, tc.visible) {
+				t.Errorf("Image.FS lists %q, want %q", walked, tc.visible)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// randomLayers generates a stack of layers of files, directories, symlinks,
+// whiteouts and opaque markers over a few names, so that entries often
+// collide across layers.
+func randomLayers(r *rand.Rand) [][]*tar.Header {
+	names := []string{"a", "b", "c"}
+	randPath := func() string {
+		parts := make([]string, 1+r.Intn(3))
+		for i := range parts {
+			parts[i] = names[r.Intn(len(names))]
+		}
+		return strings.Join(parts, "/")
+	}
+
+	layers := make([][]*tar.Header, 1+r.Intn(4))
+	for i := range layers {
+		for j := 1 + r.Intn(8); j > 0; j-- {
+			p := randPath()
+			dir, base := path.Split(p)
+			var hdr *tar.Header
+			switch n := r.Intn(10); {
+			case n < 4:
+				hdr = regHdr(p)
+			case n < 6:
+				hdr = dirHdr(p)
+			case n < 7:
+				hdr = symlinkHdr(p, names[r.Intn(len(names))])
+			case n < 9:
+				hdr = regHdr(dir + ".wh." + base)
+			default:
+				hdr = regHdr(dir + ".wh..wh..opq")
+			}
+			layers[i] = append(layers[i], hdr)
+		}
+	}
+	return layers
+}
+
+// mergeModel applies layers as an image extractor following the OCI image
+// spec would, independently of unifiedTree, and returns the type of every
+// resulting path.
+type mergeModel map[string]modelEntry
+
+type modelEntry struct {
+	typ   byte
+	layer int
+}
+
+func applyLayers(layers [][]*tar.Header) mergeModel {
+	m := mergeModel{}
+	for i, hdrs := range layers {
+		for _, hdr := range hdrs {
+			m.apply(i, hdr)
+		}
+	}
+	return m
+}
+
+func (m mergeModel) apply(layer int, hdr *tar.Header) {
+	p := strings.Trim(hdr.Name, "/")
+	dir, base := path.Split(p)
+	dir = strings.TrimSuffix(dir, "/")
+	m.makeParents(layer, p)
+
+	switch {
+	case base == ".wh..wh..opq":
+		m.prune(layer, dir)
+	case strings.HasPrefix(base, ".wh."):
+		target := path.Join(dir, strings.TrimPrefix(base, ".wh."))
+		if e, ok := m[target]; ok {
+			m.prune(layer, target)
+			if e.layer != layer && !m.hasChildren(target) {
+				delete(m, target)
+			}
+		}
+	default:
+		typ := hdr.Typeflag
+		if strings.HasSuffix(hdr.Name, "/") {
+			typ = tar.TypeDir
+		}
+		if typ != tar.TypeDir {
+			m.removeBelow(p)
+		}
+		m[p] = modelEntry{typ: typ, layer: layer}
+	}
+}
+
+// makeParents creates the missing parents of p, replacing those that are
+// not directories.
+func (m mergeModel) makeParents(layer int, p string) {
+	parts := strings.Split(p, "/")
+	for i := 1; i < len(parts); i++ {
+		parent := strings.Join(parts[:i], "/")
+		if e, ok := m[parent]; !ok || e.typ != tar.TypeDir {
+			m[parent] = modelEntry{typ: tar.TypeDir, layer: layer}
+		}
+	}
+}
+
+// prune removes what lower layers have below dir, keeping directories that
+// hold entries of layer.
+func (m mergeModel) prune(layer int, dir string) {
+	below := m.below(dir)
+	// deepest first, so directories are checked once emptied
+	sort.Slice(below, func(i, j int) bool { return below[i] > below[j] })
+	for _, p := range below {
+		if m[p].layer != layer && !m.hasChildren(p) {
+			delete(m, p)
+		}
+	}
+}
+
+func (m mergeModel) removeBelow(dir string) {
+	for _, p := range m.below(dir) {
+		delete(m, p)
+	}
+}
+
+func (m mergeModel) below(dir string) []string {
+	var paths []string
+	for p := range m {
+		if dir == "" || strings.HasPrefix(p, dir+"/") {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+func (m mergeModel) hasChildren(dir string) bool {
+	return len(m.below(dir)) > 0
+}
+
+// paths returns the paths of the model, sorted.
+func (m mergeModel) paths() []string {
+	var paths []string
+	for p := range m {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// underSymlink reports whether a parent of p is a symlink in the model, in
+// which case looking p up in a file system follows it.
+func (m mergeModel) underSymlink(p string) bool {
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		if m[dir].typ == tar.TypeSymlink {
+			return true
+		}
+	}
+	return false
+}
+
+func FuzzUnifiedTreeMerge(f *testing.F) {
+	for seed := int64(0); seed < 200; seed++ {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, seed int64) {
+		layers := randomLayers(rand.New(rand.NewSource(seed)))
+		model := applyLayers(layers)
+
+		tree := newUnifiedTree()
+		for i, hdrs := range layers {
+			tree.AddLayer(fmt.Sprintf("/layer%d", i), hdrs)
+		}
+
+		var traversed []string
+		tree.TraverseAll(func(n *unifiedTreeNode, p string) bool {
+			traversed = append(traversed, strings.TrimPrefix(p, "/"))
+			return true
+		})
+		sort.Strings(traversed)
+		if got, want := strings.Join(traversed, " "), strings.Join(model.paths(), " "); got != want {
+			t.Fatalf("layers %s\ntraversed %s\nwant      %s", formatLayers(layers), got, want)
+		}
+		for _, p := range mentioned(layers) {
+			n, ok := tree.Get(p)
+			e, want := model[p]
+			if ok != want {
+				t.Fatalf("layers %s\nGet(%q) found %v, want %v", formatLayers(layers), p, ok, want)
+			}
+			if ok && n.header != nil && !isDirHeader(n.header) && n.header.Typeflag != e.typ {
+				t.Errorf("layers %s\nGet(%q) has type %c, want %c", formatLayers(layers), p, n.header.Typeflag, e.typ)
+			}
+		}
+	})
+}
+
+func formatLayers(layers [][]*tar.Header) string {
+	var b strings.Builder
+	for i, hdrs := range layers {
+		fmt.Fprintf(&b, "\n  %d:", i)
+		for _, hdr := range hdrs {
+			fmt.Fprintf(&b, " %s", hdr.Name)
+			if hdr.Typeflag == tar.TypeSymlink {
+				fmt.Fprintf(&b, "->%s", hdr.Linkname)
+			}
+		}
+	}
+	return b.String()
+}
+
+// TestMountMergeRandom checks that readdir, lookup and getattr on the mount,
+// Image.FS and checkouts agree with the model on random layer stacks.
+func TestMountMergeRandom(t *testing.T) {
+	host := testRegistry(t, nil)
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seed := int64(0); seed < 20; seed++ {
+		layers := randomLayers(rand.New(rand.NewSource(seed)))
+		model := applyLayers(layers)
+		want := strings.Join(model.paths(), " ")
+
+		ref, err := name.ParseReference(fmt.Sprintf("%s/random%d:v1", host, seed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ls []v1.Layer
+		for _, hdrs := range layers {
+			ls = append(ls, tarLayer(t, hdrs, nil))
+		}
+		img, err := mutate.AppendLayers(empty.Image, ls...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(ref, img); err != nil {
+			t.Fatal(err)
+		}
+
+		im, err := ofs.Mount(ref.String(), MountWithTargetPath(t.TempDir()))
+		if errors.Is(err, ErrFUSEUnavailable) {
+			t.Skip(err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := strings.Join(walkTypes(t, os.DirFS(im.MountPoint()), model), " "); got != want {
+			t.Errorf("seed %d: layers %s\nmount lists %s\nwant        %s", seed, formatLayers(layers), got, want)
+		}
+		for _, p := range mentioned(layers) {
+			if model.underSymlink(p) {
+				continue
+			}
+			fi, err := os.Lstat(filepath.Join(im.MountPoint(), p))
+			e, ok := model[p]
+			if (err == nil) != ok {
+				t.Errorf("seed %d: layers %s\nlookup of %s: %v, want found %v", seed, formatLayers(layers), p, err, ok)
+			} else if ok && modeType(fi.Mode()) != e.typ {
+				t.Errorf("seed %d: layers %s\ngetattr of %s: mode %v, want type %c", seed, formatLayers(layers), p, fi.Mode(), e.typ)
+			}
+		}
+		if err := im.Unmount(); err != nil {
+			t.Fatal(err)
+		}
+
+		image, err := ofs.Image(ref.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(walkTypes(t, image.FS(), model), " "); got != want {
+			t.Errorf("seed %d: layers %s\nImage.FS lists %s\nwant           %s", seed, formatLayers(layers), got, want)
+		}
+		dir := filepath.Join(t.TempDir(), "checkout")
+		if err := image.Checkout(dir); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(walkTypes(t, os.DirFS(dir), model), " "); got != want {
+			t.Errorf("seed %d: layers %s\ncheckout has %s\nwant         %s", seed, formatLayers(layers), got, want)
+		}
+	}
+}
+
+// walkTypes lists fsys, checking the type of each entry against the model.
+func walkTypes(t *testing.T, fsys iofs.FS, model mergeModel) []string {
+	t.Helper()
+	var paths []string
+	err := iofs.WalkDir(fsys, ".", func(p string, d iofs.DirEntry, err error) error {
+		if err != nil || p == "." {
+			return err
+		}
+		if e, ok := model[p]; ok && modeType(d.Type()) != e.typ {
+			t.Errorf("%s: type %v, want %c", p, d.Type(), e.typ)
+		}
+		paths = append(paths, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func modeType(mode iofs.FileMode) byte {
+	switch {
+	case mode.IsDir():
+		return tar.TypeDir
+	case mode&iofs.ModeSymlink != 0:
+		return tar.TypeSymlink
+	}
+	return tar.TypeReg
+}
@@ -0,0 +1,76 @@
+package ocifs
+
+import (
+	"log/slog"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// LayoutDir returns the directory of the OCI layout images are stored in.
+func (o *OCIFS) LayoutDir() string {
+	return o.layoutDir
+}
+
+// Migrate imports the images of the store at workDir, such as one left in
+// the temp dir by an older version, into this store and unpacks them. The
+// old store is not modified. It returns the number of images imported.
+func (o *OCIFS) Migrate(workDir string) (int, error) {
+	src, err := layout.FromPath(workDir)
+	if err != nil {
+		return 0, err
+	}
+	idx, err := src.ImageIndex()
+	if err != nil {
+		return 0, err
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	for _, desc := range im.Manifests {
+		if desc.MediaType != types.OCIManifestSchema1 && desc.MediaType != types.DockerManifestSchema2 {
+			slog.Debug("skipping non-image manifest", "digest", desc.Digest, "mediaType", desc.MediaType)
+			continue
+		}
+
+		img, err := idx.Image(desc.Digest)
+		if err != nil {
+			return imported, err
+		}
+		if err := o.appendImage(desc.Digest, &foreignLayers{Image: img, ignore: o.ignoreForeign}, desc.Annotations[annotationRefName]); err != nil {
+			return imported, err
+		}
+		if served := desc.Annotations[annotationSchema1]; served != "" {
+			h, err := v1.NewHash(served)
+			if err != nil {
+				return imported, err
+			}
+			if err := o.recordSchema1(desc.Digest, h); err != nil {
+				return imported, err
+			}
+		}
+
+		local, err := o.lp.Image(desc.Digest)
+		if err != nil {
+			return imported, err
+		}
+		layers, err := o.fsLayers(local)
+		if err != nil {
+			return imported, err
+		}
+		for _, layer := range layers {
+			if err := o.unpackLayer(layer); err != nil {
+				return imported, err
+			}
+		}
+
+		slog.Info("migrated image", "digest", desc.Digest)
+		imported++
+	}
+
+	return imported, nil
+}
@@ -0,0 +1,57 @@
+package ocifs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// mountAllConcurrency is how many mounts MountAll makes at once.
+const mountAllConcurrency = 8
+
+// MountSpec is an image to mount with MountAll and the options to mount it
+// with.
+type MountSpec struct {
+	ImageRef string
+	Options  []MountOption
+}
+
+// MountAll mounts the images of specs concurrently and returns the mounts in
+// the order of specs. Layers shared by several images are downloaded and
+// unpacked once, by whichever mount gets to them first. When some mounts
+// fail, their entries are nil, the others stay mounted, and the returned
+// error joins the errors of the failed ones. Mounts still waiting for their
+// image when ctx is done fail with its error.
+func (o *OCIFS) MountAll(ctx context.Context, specs []MountSpec) ([]*ImageMount, error) {
+	mounts := make([]*ImageMount, len(specs))
+	errs := make([]error, len(specs))
+	sem := make(chan struct{}, mountAllConcurrency)
+	var wg sync.WaitGroup
+	for i, spec := range specs {
+		wg.Add(1)
+		go func(i int, spec MountSpec) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = fmt.Errorf("mount %s: %w", spec.ImageRef, ctx.Err())
+				return
+			}
+			defer func() { <-sem }()
+			if err := ctx.Err(); err != nil {
+				errs[i] = fmt.Errorf("mount %s: %w", spec.ImageRef, err)
+				return
+			}
+
+			im, err := o.MountContext(ctx, spec.ImageRef, spec.Options...)
+			if err != nil {
+				errs[i] = fmt.Errorf("mount %s: %w", spec.ImageRef, err)
+				return
+			}
+			mounts[i] = im
+		}(i, spec)
+	}
+	wg.Wait()
+	return mounts, errors.Join(errs...)
+}
@@ -0,0 +1,95 @@
+package ocifs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestMountAll(t *testing.T) {
+	var mu sync.Mutex
+	gets := map[string]int{}
+	host := testRegistry(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+			mu.Lock()
+			gets[r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]]++
+
+			mu.Unlock()
+		}
+		return false
+	})
+
+	base, err := random.Layer(4096, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var specs []MountSpec
+	for i := 0; i < 4; i++ {
+		top, err := random.Layer(512, types.DockerLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := mutate.AppendLayers(empty.Image, base, top)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := name.ParseReference(fmt.Sprintf("%s/app:v%d", host, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(ref, img); err != nil {
+			t.Fatal(err)
+		}
+		specs = append(specs, MountSpec{ImageRef: ref.String(), Options: []MountOption{MountWithTargetPath(t.TempDir())}})
+	}
+	specs = append(specs, MountSpec{ImageRef: host + "/missing:v1"})
+	mu.Lock()
+	clear(gets)
+	mu.Unlock()
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounts, err := ofs.MountAll(context.Background(), specs)
+	for _, im := range mounts {
+		if im != nil {
+			defer im.Unmount()
+		}
+	}
+	if err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("error %v, want one for the missing image", err)
+	}
+	for i, im := range mounts[:4] {
+		if im == nil {
+			t.Fatalf("mount %d failed", i)
+		}
+	}
+	if mounts[4] != nil {
+		t.Error("missing image was mounted")
+	}
+
+	h, err := base.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := gets[h.String()]; n != 1 {
+		t.Errorf("shared layer downloaded %d times, want once", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ofs.MountAll(ctx, specs[:1]); err == nil {
+		t.Error("MountAll with a canceled context succeeded")
+	}
+}
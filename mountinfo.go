@@ -0,0 +1,188 @@
+package ocifs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// MountWithTakeover detaches an ocifs mount left at the mount point, such as
+// one whose process died and that only fails with "transport endpoint is
+// not connected", before mounting. The old mount is detached lazily, so
+// files still open in it keep working. Mounts of other file systems are
+// still refused.
+var MountWithTakeover = func() MountOption {
+	return func(im *ImageMount) {
+		im.takeover = true
+	}
+}
+
+// mountEntry is a line of /proc/self/mountinfo.
+type mountEntry struct {
+	mountPoint string
+	fsType     string
+	source     string
+}
+
+// isOCIFS reports whether the mount was made by ocifs.
+func (e *mountEntry) isOCIFS() bool {
+	return e.fsType == "fuse.ocifs"
+}
+
+// mountAt returns the mount at p, the last one if several are stacked, or
+// nil if p is not a mount point.
+func mountAt(p string) (*mountEntry, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return findMount(f, p)
+}
+
+func findMount(r io.Reader, p string) (*mountEntry, error) {
+	var found *mountEntry
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		e, err := parseMountInfo(sc.Text())
+		if err != nil {
+			return nil, err
+		}
+		if e.mountPoint == p {
+			found = e
+		}
+	}
+	return found, sc.Err()
+}
+
+// parseMountInfo parses a line of mountinfo, as documented in proc(5):
+// the mount point is the fifth field, and the file system type and source
+// follow the separator of the optional fields.
+func parseMountInfo(line string) (*mountEntry, error) {
+	fields := strings.Fields(line)
+	sep := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sep = i
+			break
+		}
+	}
+	if len(fields) < 5 || sep < 0 || sep+2 >= len(fields) {
+		return nil, fmt.Errorf("malformed mountinfo line %q", line)
+	}
+	return &mountEntry{
+		mountPoint: unescapeMountInfo(fields[4]),
+		fsType:     fields[sep+1],
+		source:     unescapeMountInfo(fields[sep+2]),
+	}, nil
+}
+
+// unescapeMountInfo decodes the octal escapes mountinfo uses for spaces,
+// tabs, newlines and backslashes.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// checkMountPoint makes sure nothing is mounted at the mount point, detaching
+// a previous ocifs mount there when taking over. When mountinfo cannot be
+// read, it falls back to comparing devices with the parent directory.
+func (im *ImageMount) checkMountPoint() error {
+	p := im.mountPoint
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(p)); err == nil {
+		p = filepath.Join(dir, filepath.Base(p))
+	}
+
+	e, err := mountAt(p)
+	if err != nil {
+		busy, err := isMountPoint(p)
+		if err != nil {
+			return err
+		}
+		if busy {
+			return fmt.Errorf("%s: %w", p, ErrMountPointBusy)
+		}
+		return nil
+	}
+	if e == nil {
+		return nil
+	}
+
+	stale := false
+	var st syscall.Stat_t
+	if err := syscall.Stat(p, &st); errors.Is(err, syscall.ENOTCONN) {
+		stale = true
+	}
+	if !im.takeover || !e.isOCIFS() {
+		kind := e.fsType
+		if stale {
+			kind = "stale " + kind
+		}
+		return fmt.Errorf("%s: %w: %s mount of %s", p, ErrMountPointBusy, kind, e.source)
+	}
+
+	slog.Warn("taking over mount point", "mountpoint", p, "stale", stale)
+	if err := forceUnmount(p); err != nil {
+		return fmt.Errorf("detach previous mount at %s: %w", p, err)
+	}
+	return nil
+}
+
+// MountedImage returns the image of the ocifs mount at mountPoint, which may
+// be served by another process sharing the work directory. The image is
+// found from the digest in the source of the mount, so mounts given another
+// name with MountWithFsName cannot be looked up.
+func (o *OCIFS) MountedImage(mountPoint string) (*Image, error) {
+	p, err := filepath.Abs(mountPoint)
+	if err != nil {
+		return nil, err
+	}
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(p)); err == nil {
+		p = filepath.Join(dir, filepath.Base(p))
+	}
+
+	e, err := mountAt(p)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil || !e.isOCIFS() {
+		return nil, fmt.Errorf("%s: not an ocifs mount", p)
+	}
+	digest, ok := sourceDigest(e.source)
+	if !ok {
+		return nil, fmt.Errorf("%s: source %q of the mount names no image digest", p, e.source)
+	}
+	return o.Image(digest)
+}
+
+// sourceDigest returns the digest of the image in the source of a mount,
+// written as <ref>@<digest> by defaultFsName, or as the bare digest for
+// images mounted by digest. The reference may itself hold a digest, such as
+// that of an index, so the image digest is the last one.
+func sourceDigest(source string) (string, bool) {
+	digest := source[strings.LastIndex(source, "@")+1:]
+	if !isDigest(digest) {
+		return "", false
+	}
+	return digest, true
+}
@@ -0,0 +1,131 @@
+package ocifs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFindMount(t *testing.T) {
+	const mountinfo = `22 1 259:1 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p1 rw
+35 22 0:31 / /mnt/with\040space rw,nosuid shared:12 master:3 - fuse.ocifs ocifs rw,user_id=0,group_id=0
+36 22 0:32 / /mnt/stacked rw - tmpfs tmpfs rw
+37 36 0:33 / /mnt/stacked rw - fuse.ocifs ocifs rw
+`
+	for _, tt := range []struct {
+		path   string
+		fsType string
+	}{
+		{"/", "ext4"},
+		{"/mnt/with space", "fuse.ocifs"},
+		{"/mnt/stacked", "fuse.ocifs"},
+		{"/mnt", ""},
+	} {
+		e, err := findMount(strings.NewReader(mountinfo), tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if e != nil {
+			got = e.fsType
+		}
+		if got != tt.fsType {
+			t.Errorf("mount at %s: got %q, want %q", tt.path, got, tt.fsType)
+		}
+	}
+
+	if _, err := findMount(strings.NewReader("35 22 0:31 / /mnt rw\n"), "/mnt"); err == nil {
+		t.Error("malformed line was accepted")
+	}
+}
+
+func TestMountTakeover(t *testing.T) {
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	pushRandomImage(t, ref, 64, 1)
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountPoint := t.TempDir()
+	first, err := ofs.Mount(ref.String(), MountWithTargetPath(mountPoint))
+	if errors.Is(err, ErrFUSEUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Unmount()
+
+	if _, err := ofs.Mount(ref.String(), MountWithTargetPath(mountPoint)); !errors.Is(err, ErrMountPointBusy) {
+		t.Fatalf("second mount: got %v, want ErrMountPointBusy", err)
+	}
+
+	second, err := ofs.Mount(ref.String(), MountWithTargetPath(mountPoint), MountWithTakeover())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Unmount()
+	first.Wait()
+}
+
+func TestMountFsName(t *testing.T) {
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	img := pushRandomImage(t, ref, 64, 1)
+	h, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		opts []MountOption
+		want string
+	}{
+		{nil, ref.String() + "@" + h.String()},
+		{[]MountOption{MountWithFsName("app")}, "app"},
+	} {
+		mountPoint := t.TempDir()
+		im, err := ofs.Mount(ref.String(), append(tt.opts, MountWithTargetPath(mountPoint))...)
+		if errors.Is(err, ErrFUSEUnavailable) {
+			t.Skip(err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := mountAt(mountPoint)
+		im.Unmount()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e == nil || e.source != tt.want || !e.isOCIFS() {
+			t.Errorf("mount is %+v, want an ocifs mount of %s", e, tt.want)
+		}
+	}
+}
+
+func TestSourceDigest(t *testing.T) {
+	const (
+		idx = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		img = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	)
+	for _, tt := range []struct {
+		source string
+		digest string
+	}{
+		{"alpine:3.19@" + img, img},
+		{"alpine@" + idx + "@" + img, img},
+		{"alpine@" + img, img},
+		{img, img},
+		{"ocifs", ""},
+		{"alpine@latest", ""},
+	} {
+		got, ok := sourceDigest(tt.source)
+		if got != tt.digest || ok != (tt.digest != "") {
+			t.Errorf("sourceDigest(%q) = %q, %v, want %q", tt.source, got, ok, tt.digest)
+		}
+	}
+}
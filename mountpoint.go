@@ -0,0 +1,116 @@
+package ocifs
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// mountDirGrace is how old an empty directory of the mount dir must be to be
+// swept, so that directories just created for mounts being set up by other
+// processes are left alone.
+const mountDirGrace = time.Minute
+
+// MountWithCreateMountpoint creates the mount point, and any missing parent,
+// with mode when it does not exist, instead of failing. The directories get
+// the owner given with MountWithDefaultOwner, if any. Those created are
+// removed again once the mount is unmounted, if they are empty.
+var MountWithCreateMountpoint = func(mode os.FileMode) MountOption {
+	return func(im *ImageMount) {
+		im.createMode = mode.Perm() | os.ModeDir
+	}
+}
+
+// createMountPoint creates the missing directories of the mount point,
+// recording them so they can be removed with removeCreated.
+func (im *ImageMount) createMountPoint() error {
+	var missing []string
+	for p := im.mountPoint; ; p = filepath.Dir(p) {
+		// anything but a missing entry, such as a stale mount, is left
+		// for checkMountPoint
+		if _, err := os.Lstat(p); !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		missing = append(missing, p)
+		if p == filepath.Dir(p) {
+			break
+		}
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		p := missing[i]
+		if err := os.Mkdir(p, im.createMode.Perm()); err != nil {
+			return err
+		}
+		im.created = append(im.created, p)
+		// the mode was cut by the umask
+		if err := os.Chmod(p, im.createMode.Perm()); err != nil {
+			return err
+		}
+		if im.owner != nil {
+			if err := os.Lchown(p, im.owner.uid, im.owner.gid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeCreated removes the directories the mount created for its mount
+// point, deepest first, leaving those that are not empty.
+func (im *ImageMount) removeCreated() {
+	for i := len(im.created) - 1; i >= 0; i-- {
+		if err := os.Remove(im.created[i]); err != nil {
+			slog.Warn("remove created mount point", "dir", im.created[i], "error", err)
+			return
+		}
+	}
+	im.created = nil
+}
+
+// SweepMountDir removes the directories of the mount dir left by mounts
+// whose process exited without unmounting, and returns them. Stale ocifs
+// mounts are detached first. Directories that are still mounted, are not
+// empty or were created less than a minute ago are kept.
+func (o *OCIFS) SweepMountDir() ([]string, error) {
+	entries, err := os.ReadDir(o.mountDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	var errs []error
+	for _, ent := range entries {
+		p := filepath.Join(o.mountDir, ent.Name())
+		e, err := mountAt(p)
+		if err != nil {
+			return removed, err
+		}
+		if e != nil {
+			var st syscall.Stat_t
+			if !e.isOCIFS() || !errors.Is(syscall.Stat(p, &st), syscall.ENOTCONN) {
+				continue
+			}
+			if err := forceUnmount(p); err != nil {
+				errs = append(errs, fmt.Errorf("detach stale mount at %s: %w", p, err))
+				continue
+			}
+		} else if fi, err := ent.Info(); err != nil || !fi.IsDir() || time.Since(fi.ModTime()) < mountDirGrace {
+			continue
+		}
+
+		if err := os.Remove(p); err != nil {
+			// directories with content are not ours to delete
+			if !errors.Is(err, syscall.ENOTEMPTY) && !errors.Is(err, syscall.EEXIST) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		removed = append(removed, p)
+	}
+	return removed, errors.Join(errs...)
+}
@@ -0,0 +1,120 @@
+package ocifs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreateMountpoint(t *testing.T) {
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	pushRandomImage(t, ref, 64, 1)
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := t.TempDir()
+	mountPoint := filepath.Join(base, "a", "b", "mnt")
+
+	if _, err := ofs.Mount(ref.String(), MountWithTargetPath(mountPoint)); err == nil {
+		t.Fatal("mount on a missing directory succeeded")
+	}
+
+	im, err := ofs.Mount(ref.String(), MountWithTargetPath(mountPoint), MountWithCreateMountpoint(0700))
+	if errors.Is(err, ErrFUSEUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(base, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0700 {
+		t.Errorf("created parent has mode %v, want 0700", fi.Mode().Perm())
+	}
+
+	if err := im.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	im.Wait()
+	if _, err := os.Stat(filepath.Join(base, "a")); !os.IsNotExist(err) {
+		t.Errorf("created directories left after unmount: %v", err)
+	}
+
+	// directories that existed are kept
+	if err := os.Mkdir(filepath.Join(base, "kept"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	im, err = ofs.Mount(ref.String(), MountWithTargetPath(filepath.Join(base, "kept")), MountWithCreateMountpoint(0700))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	im.Wait()
+	if _, err := os.Stat(filepath.Join(base, "kept")); err != nil {
+		t.Errorf("existing mount point removed: %v", err)
+	}
+}
+
+func TestSweepMountDir(t *testing.T) {
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	pushRandomImage(t, ref, 64, 1)
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// generated mount points are removed after unmounting
+	im, err := ofs.Mount(ref.String(), MountWithID("generated"))
+	if errors.Is(err, ErrFUSEUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	im.Wait()
+	if _, err := os.Stat(filepath.Join(ofs.mountDir, "generated")); !os.IsNotExist(err) {
+		t.Errorf("generated mount point left after unmount: %v", err)
+	}
+
+	live, err := ofs.Mount(ref.String(), MountWithID("live"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Unmount()
+
+	old := time.Now().Add(-time.Hour)
+	for _, d := range []string{"orphan", "young", "full", "live"} {
+		p := filepath.Join(ofs.mountDir, d)
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if d == "full" {
+			if err := os.WriteFile(filepath.Join(p, "file"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if d != "young" {
+			os.Chtimes(p, old, old)
+		}
+	}
+
+	removed, err := ofs.SweepMountDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(ofs.mountDir, "orphan"); len(removed) != 1 || removed[0] != want {
+		t.Errorf("removed %v, want [%s]", removed, want)
+	}
+}
@@ -1,16 +1,30 @@
 package ocifs
 
 import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/google/uuid"
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/text/unicode/norm"
 )
 
 type cacheEntry struct {
@@ -20,12 +34,110 @@ type cacheEntry struct {
 
 type Option func(*OCIFS)
 
+// WithWorkDir keeps unpacked layers and mount points in workDir, and with
+// them the OCI layout unless WithLayoutDir is given too.
 var WithWorkDir = func(workDir string) Option {
 	return func(o *OCIFS) {
 		o.workDir = filepath.Clean(workDir)
 	}
 }
 
+// WithLayoutDir keeps the OCI layout, the blobs of the images stored and the
+// index.json recording their references, in dir.
+var WithLayoutDir = func(dir string) Option {
+	return func(o *OCIFS) {
+		o.layoutDir = filepath.Clean(dir)
+	}
+}
+
+// WithUnpackDir stores unpacked layers in dir instead of under the work dir.
+var WithUnpackDir = func(dir string) Option {
+	return func(o *OCIFS) {
+		o.unpackDir = filepath.Clean(dir)
+	}
+}
+
+// WithMountDir creates mount points for mounts without a target path in dir
+// instead of under the work dir.
+var WithMountDir = func(dir string) Option {
+	return func(o *OCIFS) {
+		o.mountDir = filepath.Clean(dir)
+	}
+}
+
+// DefaultWorkDir returns the work dir used when none is given: ocifs under
+// the user's cache dir, $XDG_CACHE_HOME or ~/.cache on Linux, falling back
+// to the temp dir when there is none.
+func DefaultWorkDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "ocifs")
+	}
+	return filepath.Join(dir, "ocifs")
+}
+
+// DefaultLayoutDir returns the layout dir used when neither it nor a work dir
+// is given: ocifs under the user's state dir, $XDG_STATE_HOME or
+// ~/.local/state, so that the references survive cache cleaners. The blobs
+// stay next to the references they are recorded under.
+func DefaultLayoutDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "ocifs")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return DefaultWorkDir()
+	}
+	return filepath.Join(home, ".local", "state", "ocifs")
+}
+
+// WithAdmissionHook calls hook once an image reference is resolved to a
+// digest and its config is fetched, before any layer is fetched or unpacked.
+// An error from hook fails the pull, and with it the mount.
+var WithAdmissionHook = func(hook func(ctx context.Context, desc v1.Descriptor, cfg *v1.ConfigFile) error) Option {
+	return func(o *OCIFS) {
+		o.admissionHook = hook
+	}
+}
+
+// WithLabelAllowlist refuses to pull images whose config label does not
+// match one of allowed, as understood by path.Match, or that lack the label.
+// For example, WithLabelAllowlist("org.opencontainers.image.licenses",
+// "MIT", "Apache-2.0") only admits images under one of those licenses.
+var WithLabelAllowlist = func(label string, allowed ...string) Option {
+	return func(o *OCIFS) {
+		o.labelPolicies = append(o.labelPolicies, labelPolicy{label: label, allowed: allowed})
+	}
+}
+
+// WithBandwidthLimit caps the combined download rate of all registry
+// traffic at bytesPerSec.
+var WithBandwidthLimit = func(bytesPerSec int64) Option {
+	return func(o *OCIFS) {
+		o.bandwidthLimit = bytesPerSec
+	}
+}
+
+// WithSymlinkDepth caps how many symlinks are followed while resolving a
+// single path when images are read without mounting them, such as through
+// Image.FS. It defaults to 40, like the kernel. Mounts leave following
+// symlinks to the kernel.
+var WithSymlinkDepth = func(depth int) Option {
+	return func(o *OCIFS) {
+		o.symlinkDepth = depth
+	}
+}
+
+// WithWindowsLayers allows pulling images built for Windows, which otherwise
+// fail with ErrWindowsImage, so they can be mounted for inspection. The
+// filesystem of their layers is served at the root; registry hives, the
+// utility VM and Windows security descriptors are left out.
+var WithWindowsLayers = func() Option {
+	return func(o *OCIFS) {
+		o.windowsLayers = true
+	}
+}
+
 var WithCacheExpiration = func(exp time.Duration) Option {
 	return func(o *OCIFS) {
 		o.exp = exp
@@ -51,42 +163,101 @@ var WithEnableDefaultKeychain = func() Option {
 }
 
 type OCIFS struct {
-	cache     map[string]*cacheEntry
-	workDir   string
-	lp        layout.Path
-	mountDir  string
-	extraDirs []string
-	exp       time.Duration
-	authn     *ocifsKeychain
+	cache          map[string]*cacheEntry
+	workDir        string
+	layoutDir      string
+	unpackDir      string
+	lp             layout.Path
+	mountDir       string
+	extraDirs      []string
+	exp            time.Duration
+	authn          *ocifsKeychain
+	eventHandler   func(Event)
+	admissionHook  func(ctx context.Context, desc v1.Descriptor, cfg *v1.ConfigFile) error
+	labelPolicies  []labelPolicy
+	bandwidthLimit int64
+	bandwidth      *tokenBucket
+	symlinkDepth   int
+	windowsLayers  bool
+	remountPolicy  *RemountPolicy
+	crashOnPanic   bool
+	logLimits      map[Op]int
+	logs           *logSampler
+	sources        map[string]Source
+	containerdRoot string
+	platform       v1.Platform
+	indexAnnots    map[string]string
+	ignoreForeign  bool
+	layerFormats   map[types.MediaType]layerFormat
+	httpTransport  *http.Transport
+	httpTimeout    time.Duration
+	transport      http.RoundTripper
+	userAgent      string
+	headers        map[string]http.Header
+	pinned         map[string][]string
+	dnsServer      string
+	mu             sync.Mutex // guards cache, pulls and jobs
+	pulls          map[string]*pullCall
+	jobs           map[string]*pullCall
+	pullSlots      chan struct{}
+	indexMu        sync.Mutex // serializes updates of the layout's index.json
+	layerLocks     keyedMutex
+	trees          map[v1.Hash]*sharedTree
 }
 
 func New(opts ...Option) (*OCIFS, error) {
 	// default values
 	ofs := &OCIFS{
-		workDir: filepath.Join(os.TempDir(), "ocifs"),
-		cache:   make(map[string]*cacheEntry),
-		exp:     24 * time.Hour,
+		cache:    make(map[string]*cacheEntry),
+		pulls:    make(map[string]*pullCall),
+		jobs:     make(map[string]*pullCall),
+		trees:    make(map[v1.Hash]*sharedTree),
+		exp:      24 * time.Hour,
+		platform: defaultPlatform(),
 		authn: &ocifsKeychain{
 			creds: make(map[string]authn.AuthConfig),
 		},
 	}
 
+	ofs.sources = ofs.defaultSources()
+
 	// apply options
 	for _, opt := range opts {
 		opt(ofs)
 	}
 
-	// if dir does not exist, create it
-	if _, err := os.Stat(ofs.workDir); os.IsNotExist(err) {
-		if err := os.MkdirAll(ofs.workDir, 0755); err != nil {
+	if len(ofs.logLimits) > 0 {
+		ofs.logs = newLogSampler(ofs.logLimits)
+	}
+	if ofs.bandwidthLimit > 0 {
+		ofs.bandwidth = newTokenBucket(ofs.bandwidthLimit)
+	}
+	ofs.transport = ofs.newTransport()
+
+	if ofs.layoutDir == "" {
+		// a work dir given alone holds the whole store
+		ofs.layoutDir = ofs.workDir
+		if ofs.layoutDir == "" {
+			ofs.layoutDir = DefaultLayoutDir()
+		}
+	}
+	if ofs.workDir == "" {
+		ofs.workDir = DefaultWorkDir()
+	}
+
+	// if dirs do not exist, create them
+	for _, dir := range []string{ofs.workDir, ofs.layoutDir} {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return nil, err
+			}
+		} else if err != nil {
 			return nil, err
 		}
-	} else if err != nil {
-		return nil, err
 	}
 
 	// creat config.json if it does not exist
-	idxFilePath := filepath.Join(ofs.workDir, "index.json")
+	idxFilePath := filepath.Join(ofs.layoutDir, "index.json")
 	if _, err := os.Stat(idxFilePath); os.IsNotExist(err) {
 		// create index.json
 		if err := os.WriteFile(idxFilePath, []byte("{}"), 0644); err != nil {
@@ -96,19 +267,26 @@ func New(opts ...Option) (*OCIFS, error) {
 		return nil, err
 	}
 
-	// create mount dir if it does not exist
-	mountDir := filepath.Join(ofs.workDir, "mounts")
-	if _, err := os.Stat(mountDir); os.IsNotExist(err) {
-		if err := os.MkdirAll(mountDir, 0755); err != nil {
+	if ofs.unpackDir == "" {
+		ofs.unpackDir = filepath.Join(ofs.workDir, "unpacked")
+	}
+	if ofs.mountDir == "" {
+		ofs.mountDir = filepath.Join(ofs.workDir, "mounts")
+	}
+
+	// create unpack and mount dirs if they do not exist
+	for _, dir := range []string{ofs.unpackDir, ofs.mountDir} {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return nil, err
+			}
+		} else if err != nil {
 			return nil, err
 		}
-	} else if err != nil {
-		return nil, err
 	}
-	ofs.mountDir = mountDir
 
 	// at this point, if the directory exists, it should be a valid layout
-	lp, err := layout.FromPath(ofs.workDir)
+	lp, err := layout.FromPath(ofs.layoutDir)
 	if err != nil {
 		return nil, err
 	}
@@ -119,11 +297,60 @@ func New(opts ...Option) (*OCIFS, error) {
 }
 
 type ImageMount struct {
-	ofs        *OCIFS
-	srv        *fuse.Server
-	h          v1.Hash
-	mountPoint string
-	id         string
+	ofs            *OCIFS
+	srv            *fuse.Server
+	root           *ociFS
+	h              v1.Hash
+	ref            string
+	mountPoint     string
+	id             string
+	extraDirs      []ExtraDir
+	bindDirs       []bindDir
+	lowerDirs      []string
+	normalize      func(string) string
+	readahead      int64
+	directIO       bool
+	sharedTree     bool
+	audit          *auditLog
+	policy         AccessPolicy
+	hidden         []string
+	masked         map[string][]byte
+	maskDir        string
+	transforms     []transform
+	selinuxContext string
+	worldReadable  bool
+	umask          uint32
+	owner          *fileOwner
+	stats          pullStats
+	takeover       bool
+	createMode     os.FileMode
+	created        []string
+	helper         FUSEHelper
+	used           FUSEHelper
+	fsName         string
+	allowOther     bool
+	verifyReads    bool
+	fixedAttrs     *fixedAttrs
+	dateEpoch      *time.Time
+	rootAttrs      *rootAttrs
+	mu             sync.Mutex // guards srv, root, exited and used
+	exited         chan struct{}
+	done           chan struct{}
+	closing        atomic.Bool
+	wake           chan struct{}
+}
+
+// release frees what a server of the mount held once it is done, including
+// the masked files it served from maskDir.
+func (im *ImageMount) release(maskDir string) {
+	if im.sharedTree {
+		im.ofs.releaseTree(im.h)
+	}
+	if maskDir != "" {
+		if err := os.RemoveAll(maskDir); err != nil {
+			slog.Error("remove masked files", "dir", maskDir, "error", err)
+		}
+	}
 }
 
 func (im *ImageMount) ConfigFile() (*v1.ConfigFile, error) {
@@ -135,12 +362,132 @@ func (im *ImageMount) ConfigFile() (*v1.ConfigFile, error) {
 	return img.ConfigFile()
 }
 
+// Wait blocks until the mount is unmounted for good.
 func (im *ImageMount) Wait() {
-	im.srv.Wait()
+	<-im.done
 }
 
 func (im *ImageMount) Unmount() error {
-	return im.srv.Unmount()
+	im.closing.Store(true)
+	srv, _ := im.server()
+	if err := srv.Unmount(); err != nil {
+		if !im.serverExited() {
+			im.closing.Store(false)
+			im.ofs.emit(Event{Type: EventError, ImageRef: im.ref, Digest: im.h, MountPoint: im.mountPoint, Err: err})
+			return err
+		}
+		// the server is gone, as when waiting to be remounted, so at
+		// most a stale mount is left
+		forceUnmount(im.mountPoint)
+	}
+	im.wakeSupervisor()
+	im.ofs.emit(Event{Type: EventUnmounted, ImageRef: im.ref, Digest: im.h, MountPoint: im.mountPoint})
+	return nil
+}
+
+// Shutdown stops the mount from serving new operations, failing them with
+// EIO, waits for the open file handles to be released and unmounts. Only
+// reads, stats, flushes and releases of the handles already open are still
+// served. If ctx is done before all handles are released, the mount is
+// forcibly detached.
+func (im *ImageMount) Shutdown(ctx context.Context) error {
+	im.closing.Store(true)
+	im.wakeSupervisor()
+	_, root := im.server()
+	if err := root.handles.drain(ctx); err == nil {
+		return im.Unmount()
+	}
+
+	slog.Warn("shutdown deadline reached, forcing unmount", "mountpoint", im.mountPoint)
+	if err := forceUnmount(im.mountPoint); err != nil {
+		im.ofs.emit(Event{Type: EventError, ImageRef: im.ref, Digest: im.h, MountPoint: im.mountPoint, Err: err})
+		return err
+	}
+	im.ofs.emit(Event{Type: EventUnmounted, ImageRef: im.ref, Digest: im.h, MountPoint: im.mountPoint})
+	return ctx.Err()
+}
+
+// forceUnmount aborts the FUSE connection and detaches the mount, falling
+// back to a lazy unmount through fusermount when not privileged.
+func forceUnmount(mountPoint string) error {
+	err := syscall.Unmount(mountPoint, syscall.MNT_FORCE|syscall.MNT_DETACH)
+	if err == nil {
+		return nil
+	}
+	for _, bin := range []string{"fusermount3", "fusermount"} {
+		if _, lerr := exec.LookPath(bin); lerr != nil {
+			continue
+		}
+		out, cerr := exec.Command(bin, "-u", "-z", mountPoint).CombinedOutput()
+		if cerr != nil {
+			return fmt.Errorf("%s: %w: %s", bin, cerr, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	return err
+}
+
+// Invalidate drops the kernel's cached data, attributes and directory entry
+// for the file at p, relative to the mount root.
+func (im *ImageMount) Invalidate(p string) error {
+	_, root := im.server()
+	n := root.inodeAt(p)
+	if n == nil {
+		return os.ErrNotExist
+	}
+	if errno := n.NotifyContent(0, 0); errno != fs.OK && errno != syscall.ENOENT {
+		return errno
+	}
+	name, parent := n.Parent()
+	if parent == nil {
+		return nil
+	}
+	if errno := parent.NotifyEntry(name); errno != fs.OK && errno != syscall.ENOENT {
+		return errno
+	}
+	return nil
+}
+
+// Resolve reports which layer provides the file at p and where its content
+// is stored on disk. If p was removed by a whiteout, the returned digest is
+// that of the layer holding the whiteout and whiteout is true. The digest is
+// zero for files coming from a lower dir, and backingPath is empty for
+// entries that have no content on disk, such as symlinks and devices.
+func (im *ImageMount) Resolve(p string) (layer v1.Hash, backingPath string, whiteout bool, err error) {
+	_, root := im.server()
+	ut := root.ut
+
+	n, ok := ut.Get(p)
+	if !ok {
+		// paths hidden by the mount itself are not reported as whiteouts
+		if wh, ok := ut.Whiteout(p); ok && wh.rootPath != "" {
+			return root.layers[wh.rootPath], "", true, nil
+		}
+		return v1.Hash{}, "", false, os.ErrNotExist
+	}
+	if n.Header() == nil {
+		return v1.Hash{}, "", false, nil
+	}
+
+	hdr := n.Header()
+	switch hdr.Typeflag {
+	case tar.TypeLink:
+		target, ok := ut.LinkTarget(n)
+		if !ok {
+			return v1.Hash{}, "", false, fmt.Errorf("hardlink target %s: %w", hdr.Linkname, os.ErrNotExist)
+		}
+		return root.layers[target.rootPath], target.Path(), false, nil
+	case tar.TypeReg:
+		return root.layers[n.rootPath], n.Path(), false, nil
+	case tar.TypeDir:
+		// directories of unpacked layers only exist in their index
+		if n.hashed {
+			return root.layers[n.rootPath], "", false, nil
+		}
+		return root.layers[n.rootPath], n.Path(), false, nil
+	default:
+		return root.layers[n.rootPath], "", false, nil
+	}
 }
 
 func (im *ImageMount) MountPoint() string {
@@ -161,14 +508,213 @@ var MountWithID = func(id string) MountOption {
 	}
 }
 
+// ExtraDir is a directory added to the mount that is not part of the image.
+// When Mode is zero the directory keeps its attributes from the image, or
+// gets 0755 owned by root if the image does not have it.
+type ExtraDir struct {
+	Path string
+	Mode uint32
+	Uid  uint32
+	Gid  uint32
+}
+
+var MountWithExtraDirs = func(dirs ...ExtraDir) MountOption {
+	return func(im *ImageMount) {
+		im.extraDirs = append(im.extraDirs, dirs...)
+	}
+}
+
+// MountWithBindDir exposes hostPath at mountPath inside the mount. Reads and
+// writes below mountPath go straight to the host directory.
+var MountWithBindDir = func(hostPath, mountPath string) MountOption {
+	return func(im *ImageMount) {
+		im.bindDirs = append(im.bindDirs, bindDir{hostPath: hostPath, mountPath: mountPath})
+	}
+}
+
+// MountWithLowerDir merges the contents of hostPath into the mount on top of
+// the image layers. Files named with the .wh. prefix hide image files, as
+// they would in a layer.
+var MountWithLowerDir = func(hostPath string) MountOption {
+	return func(im *ImageMount) {
+		im.lowerDirs = append(im.lowerDirs, hostPath)
+	}
+}
+
+// MountWithUnicodeNormalization converts file names from all layers to form
+// and applies the same conversion to looked up names, so that, for example,
+// NFD names from images built on macOS can be opened with NFC names.
+var MountWithUnicodeNormalization = func(form norm.Form) MountOption {
+	return func(im *ImageMount) {
+		im.normalize = form.String
+	}
+}
+
+// MountWithReadahead prefetches up to bytes of a file's content into the
+// page cache when it is read sequentially. It also raises the kernel's FUSE
+// readahead limit to the same size.
+var MountWithReadahead = func(bytes int64) MountOption {
+	return func(im *ImageMount) {
+		im.readahead = bytes
+	}
+}
+
+// MountWithDirectIO bypasses the kernel page cache so every read is served
+// by ocifs.
+var MountWithDirectIO = func() MountOption {
+	return func(im *ImageMount) {
+		im.directIO = true
+	}
+}
+
+// MountWithAuditLog writes a JSON line to w for every operation that changes
+// content, with the caller's uid, gid and pid and the result. Image content
+// is read-only, so only bind dirs produce records.
+var MountWithAuditLog = func(w io.Writer) MountOption {
+	return func(im *ImageMount) {
+		im.audit = newAuditLog(w)
+	}
+}
+
+// MountWithHiddenPaths removes paths, and everything below them, from the
+// view of the image.
+var MountWithHiddenPaths = func(paths []string) MountOption {
+	return func(im *ImageMount) {
+		im.hidden = append(im.hidden, paths...)
+	}
+}
+
+// MountWithMaskedFiles replaces the content of files, keyed by path, in the
+// view of the image. Files that do not exist in the image are added.
+var MountWithMaskedFiles = func(files map[string][]byte) MountOption {
+	return func(im *ImageMount) {
+		if im.masked == nil {
+			im.masked = make(map[string][]byte, len(files))
+		}
+		for p, data := range files {
+			im.masked[p] = data
+		}
+	}
+}
+
+// MountWithTransform rewrites the content of files whose absolute path in the
+// image matches glob, as understood by path.Match. The transform runs when a
+// file is first looked up or opened, so that stat reports the size of its
+// result, and the result is kept for the life of the mount.
+// Transforms matching the same file are applied in the order given.
+var MountWithTransform = func(glob string, fn func([]byte) ([]byte, error)) MountOption {
+	return func(im *ImageMount) {
+		im.transforms = append(im.transforms, transform{glob: glob, fn: fn})
+	}
+}
+
+// MountWithFsName sets the source shown for the mount by findmnt and in
+// /proc/self/mountinfo, by default the image reference and its digest. The
+// file system type is always fuse.ocifs, so ocifs mounts can be told apart.
+var MountWithFsName = func(name string) MountOption {
+	return func(im *ImageMount) {
+		im.fsName = name
+	}
+}
+
+// defaultFsName identifies the image the mount serves, as ref@digest. The
+// kernel rejects unknown mount options, so the digest cannot go there.
+func (im *ImageMount) defaultFsName() string {
+	if isDigest(im.ref) || strings.HasSuffix(im.ref, "@"+im.h.String()) {
+		return im.ref
+	}
+	return im.ref + "@" + im.h.String()
+}
+
+// MountWithSELinuxContext labels every file in the mount with a fixed SELinux
+// context, like the context= option of other filesystems, in place of any
+// security.selinux xattrs recorded in the layers.
+var MountWithSELinuxContext = func(context string) MountOption {
+	return func(im *ImageMount) {
+		im.selinuxContext = context
+	}
+}
+
+// MountWithWorldReadable lets every caller read and traverse all of the
+// image, regardless of the ownership and mode bits recorded in the layers.
+var MountWithWorldReadable = func() MountOption {
+	return func(im *ImageMount) {
+		im.worldReadable = true
+	}
+}
+
+// MountWithAllowOther lets users other than the one mounting access the
+// mount, such as the user of an image running from it. Without it, the
+// kernel refuses everyone else, root included. Mounting through fusermount
+// needs user_allow_other in /etc/fuse.conf for this. Accesses to bind
+// directories are checked against the permissions of the host entries for
+// the calling user, since the mount acts on them with its own privileges.
+var MountWithAllowOther = func() MountOption {
+	return func(im *ImageMount) {
+		im.allowOther = true
+	}
+}
+
+// MountWithAccessPolicy lets policy allow or deny each operation on the mount
+// based on the calling uid, gid and pid. Denied operations fail with EACCES.
+var MountWithAccessPolicy = func(policy AccessPolicy) MountOption {
+	return func(im *ImageMount) {
+		im.policy = policy
+	}
+}
+
+// MountWithUmask clears the bits of mask from the mode of files and
+// directories created in bind directories, on top of the umask of the
+// process.
+var MountWithUmask = func(mask os.FileMode) MountOption {
+	return func(im *ImageMount) {
+		im.umask = uint32(mask.Perm())
+	}
+}
+
+// MountWithDefaultOwner makes uid and gid the owner of the entries created in
+// bind directories, rather than the user running the mount or, when that is
+// root, the user creating them. Changing owner usually requires running as
+// root; creations fail if it is not permitted.
+var MountWithDefaultOwner = func(uid, gid int) MountOption {
+	return func(im *ImageMount) {
+		im.owner = &fileOwner{uid: uid, gid: gid}
+	}
+}
+
 func (o *OCIFS) Mount(imgRef string, opts ...MountOption) (*ImageMount, error) {
+	return o.MountContext(context.Background(), imgRef, opts...)
+}
+
+// MountContext is like Mount, but gives up waiting for the image to be
+// pulled when ctx is done. The pull itself goes on for other mounts of the
+// same reference, and to fill the cache.
+func (o *OCIFS) MountContext(ctx context.Context, imgRef string, opts ...MountOption) (*ImageMount, error) {
+	im, err := o.mount(ctx, imgRef, opts...)
+	if err != nil {
+		o.emit(Event{Type: EventError, ImageRef: imgRef, Err: err})
+		return nil, err
+	}
+	o.emit(Event{Type: EventMounted, ImageRef: imgRef, Digest: im.h, MountPoint: im.mountPoint})
+	return im, nil
+}
+
+func (o *OCIFS) mount(ctx context.Context, imgRef string, opts ...MountOption) (*ImageMount, error) {
 	im := &ImageMount{
 		ofs: o,
+		ref: imgRef,
+	}
+	for _, d := range o.extraDirs {
+		im.extraDirs = append(im.extraDirs, ExtraDir{Path: d})
 	}
 	for _, opt := range opts {
 		opt(im)
 	}
 
+	if !im.helper.valid() {
+		return nil, fmt.Errorf("unknown FUSE helper %q", im.helper)
+	}
+
 	if im.mountPoint == "" {
 		id := im.id
 		if id == "" {
@@ -183,6 +729,7 @@ func (o *OCIFS) Mount(imgRef string, opts ...MountOption) (*ImageMount, error) {
 			return nil, err
 		}
 		im.mountPoint = path
+		im.created = append(im.created, path)
 	}
 
 	im.mountPoint = filepath.Clean(im.mountPoint)
@@ -194,30 +741,144 @@ func (o *OCIFS) Mount(imgRef string, opts ...MountOption) (*ImageMount, error) {
 		im.mountPoint = filepath.Clean(filepath.Join(cwd, im.mountPoint))
 	}
 
-	h, err := o.pullImage(imgRef)
+	if im.createMode != 0 {
+		if err := im.createMountPoint(); err != nil {
+			im.removeCreated()
+			return nil, err
+		}
+	}
+	mounted := false
+	defer func() {
+		if !mounted {
+			im.removeCreated()
+		}
+	}()
+
+	if err := im.checkMountPoint(); err != nil {
+		return nil, err
+	}
+
+	h, err := o.pullImage(ctx, imgRef, &im.stats)
 	if err != nil {
 		return nil, err
 	}
 	im.h = *h
 
-	root, err := o.initFS(h, o.extraDirs)
-	if err != nil {
+	for i, b := range im.bindDirs {
+		hostPath, err := filepath.Abs(b.hostPath)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(hostPath)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("bind source %s is not a directory", hostPath)
+		}
+		im.bindDirs[i].hostPath = hostPath
+	}
+
+	for _, t := range im.transforms {
+		if _, err := path.Match(t.glob, "/"); err != nil {
+			return nil, fmt.Errorf("transform glob %q: %w", t.glob, err)
+		}
+	}
+
+	for i, d := range im.lowerDirs {
+		lowerDir, err := filepath.Abs(d)
+		if err != nil {
+			return nil, err
+		}
+		im.lowerDirs[i] = lowerDir
+	}
+
+	// mounts that show the image as is can share its unified tree
+	im.sharedTree = im.normalize == nil && len(im.lowerDirs) == 0 && len(im.hidden) == 0 && len(im.masked) == 0
+
+	im.done = make(chan struct{})
+	im.wake = make(chan struct{}, 1)
+	if err := im.serve(); err != nil {
 		return nil, err
 	}
 
+	if o.remountPolicy != nil {
+		go im.supervise(*o.remountPolicy)
+	} else {
+		go func() {
+			<-im.exited
+			im.removeCreated()
+			close(im.done)
+		}()
+	}
+
+	mounted = true
+	return im, nil
+}
+
+// serve builds the file system of the mount from the unpacked layers and
+// mounts it at the mount point.
+func (im *ImageMount) serve() error {
+	root, err := im.ofs.initFS(im)
+	if err != nil {
+		return err
+	}
+
+	mountOpts := fuse.MountOptions{
+		AllowOther: im.allowOther,
+		Name:       "ocifs",
+		FsName:     im.fsName,
+		Debug:      false, // Set to true for debugging
+	}
+	if mountOpts.FsName == "" {
+		mountOpts.FsName = im.defaultFsName()
+	}
+	if im.readahead > 0 {
+		mountOpts.MaxReadAhead = int(im.readahead)
+	}
+	if im.selinuxContext != "" {
+		mountOpts.Options = append(mountOpts.Options, fmt.Sprintf("context=\"%s\"", im.selinuxContext))
+	}
+
 	// Create a FUSE server
-	srv, err := fs.Mount(im.mountPoint, root, &fs.Options{
-		MountOptions: fuse.MountOptions{
-			AllowOther:  false,
-			Name:        "ocifs",
-			DirectMount: true,
-			Debug:       false, // Set to true for debugging
-		},
-	})
+	maskDir := im.maskDir
+	rawFS := &recoverFS{
+		RawFileSystem: fs.NewNodeFS(root, &fs.Options{MountOptions: mountOpts}),
+		im:            im,
+		handles:       root.handles,
+	}
+	srv, used, err := newServer(rawFS, im.mountPoint, mountOpts, im.helper)
 	if err != nil {
-		return nil, err
+		im.release(maskDir)
+		return err
+	}
+	go srv.Serve()
+	if err := srv.WaitMount(); err != nil {
+		im.release(maskDir)
+		return err
 	}
+
+	exited := make(chan struct{})
+	im.mu.Lock()
 	im.srv = srv
+	im.root = root
+	im.exited = exited
+	im.used = used
+	im.mu.Unlock()
+
+	go func() {
+		srv.Wait()
+		im.release(maskDir)
+		close(exited)
+	}()
+
+	return nil
+}
 
-	return im, nil
+// server returns the FUSE server and file system currently serving the
+// mount, which change when it is remounted.
+func (im *ImageMount) server() (*fuse.Server, *ociFS) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	return im.srv, im.root
 }
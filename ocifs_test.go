@@ -1,8 +1,15 @@
 package ocifs
 
 import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
 	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestMountBusybox(t *testing.T) {
@@ -27,3 +34,84 @@ func TestMountBusybox(t *testing.T) {
 
 	os.RemoveAll(workDir)
 }
+
+func TestShutdown(t *testing.T) {
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	pushTarImage(t, ref, []*tar.Header{
+		{Name: "file", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"file": "content"})
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		// closeAfter closes the open file while Shutdown waits, if set
+		closeAfter time.Duration
+		wantErr    error
+	}{
+		{"handles released", 10 * time.Second, 300 * time.Millisecond, nil},
+		{"deadline reached", 300 * time.Millisecond, 0, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im, err := ofs.Mount(ref.String(), MountWithTargetPath(t.TempDir()))
+			if errors.Is(err, ErrFUSEUnavailable) {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer im.Unmount()
+
+			f, err := os.Open(filepath.Join(im.MountPoint(), "file"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- im.Shutdown(ctx) }()
+
+			// new operations are refused while the open file is still served
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				_, err := os.Lstat(filepath.Join(im.MountPoint(), "other"))
+				if errors.Is(err, syscall.EIO) {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("lookup while shutting down: %v, want EIO", err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if b, err := io.ReadAll(f); err != nil || string(b) != "content" {
+				t.Errorf("read of open file while shutting down = %q, %v", b, err)
+			}
+
+			if tt.closeAfter > 0 {
+				time.Sleep(tt.closeAfter)
+				select {
+				case err := <-done:
+					t.Fatalf("Shutdown returned %v with a file open", err)
+				default:
+				}
+				f.Close()
+			}
+
+			select {
+			case err := <-done:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Shutdown = %v, want %v", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Shutdown did not return")
+			}
+		})
+	}
+}
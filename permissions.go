@@ -0,0 +1,102 @@
+package ocifs
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// checkPermissions evaluates an access mask of R_OK, W_OK and X_OK against
+// the mode and ownership of attr for the caller in ctx. Image content can
+// never be written, so W_OK fails with EROFS.
+func (ofs *ociFS) checkPermissions(ctx context.Context, attr *fuse.Attr, mask uint32) syscall.Errno {
+	if mask&unixWOK != 0 {
+		return syscall.EROFS
+	}
+	if ofs.worldReadable {
+		return fs.OK
+	}
+	return modePermissions(ctx, attr, mask)
+}
+
+// modePermissions evaluates an access mask against the mode and ownership
+// of attr for the caller in ctx, as the kernel does.
+func modePermissions(ctx context.Context, attr *fuse.Attr, mask uint32) syscall.Errno {
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return fs.OK
+	}
+
+	perm := attr.Mode & 07777
+	if caller.Uid == 0 {
+		// root may read anything, but only execute what has an x bit
+		if mask&unixXOK != 0 && attr.Mode&syscall.S_IFMT != syscall.S_IFDIR && perm&0111 == 0 {
+			return syscall.EACCES
+		}
+		return fs.OK
+	}
+
+	var bits uint32
+	switch {
+	case caller.Uid == attr.Uid:
+		bits = perm >> 6
+	case caller.Gid == attr.Gid || inGroup(caller.Pid, attr.Gid):
+		bits = perm >> 3
+	default:
+		bits = perm
+	}
+	if bits&mask&07 != mask&07 {
+		return syscall.EACCES
+	}
+	return fs.OK
+}
+
+const (
+	unixXOK = 1
+	unixWOK = 2
+	unixROK = 4
+)
+
+// openMask returns the access mask needed to open a file with flags.
+func openMask(flags uint32) uint32 {
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_WRONLY:
+		return unixWOK
+	case syscall.O_RDWR:
+		return unixROK | unixWOK
+	default:
+		return unixROK
+	}
+}
+
+// inGroup reports whether gid is one of the supplementary groups of the
+// process pid.
+func inGroup(pid uint32, gid uint32) bool {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		groups, ok := strings.CutPrefix(sc.Text(), "Groups:")
+		if !ok {
+			continue
+		}
+		for _, g := range strings.Fields(groups) {
+			if n, err := strconv.ParseUint(g, 10, 32); err == nil && uint32(n) == gid {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
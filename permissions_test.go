@@ -0,0 +1,91 @@
+package ocifs
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestCheckPermissions(t *testing.T) {
+	// a process with the file group as supplementary group, for inGroup to
+	// find
+	var groupPid uint32
+	if os.Geteuid() == 0 {
+		cmd := exec.Command("sleep", "60")
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 1000, Gid: 1000, Groups: []uint32{100}}}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer cmd.Wait()
+		defer cmd.Process.Kill()
+		groupPid = uint32(cmd.Process.Pid)
+	}
+
+	const (
+		file = syscall.S_IFREG
+		dir  = syscall.S_IFDIR
+	)
+	// the file is owned by 1000 with group 100
+	tests := []struct {
+		name string
+		// uid, gid and pid of the caller, none if uid is -1
+		uid, gid int
+		pid      uint32
+		mode     uint32
+		mask     uint32
+		// host checks modePermissions alone, as for bind dirs
+		host          bool
+		worldReadable bool
+		want          syscall.Errno
+	}{
+		{name: "owner read", uid: 1000, gid: 1000, mode: file | 0600, mask: unixROK, want: fs.OK},
+		{name: "owner exec without x bit", uid: 1000, gid: 1000, mode: file | 0600, mask: unixXOK, want: syscall.EACCES},
+		{name: "owner bits win over others", uid: 1000, gid: 1000, mode: file | 0004, mask: unixROK, want: syscall.EACCES},
+		{name: "group read", uid: 2000, gid: 100, mode: file | 0640, mask: unixROK, want: fs.OK},
+		{name: "group read and exec", uid: 2000, gid: 100, mode: file | 0650, mask: unixROK | unixXOK, want: fs.OK},
+		{name: "group exec without x bit", uid: 2000, gid: 100, mode: file | 0640, mask: unixXOK, want: syscall.EACCES},
+		{name: "other read", uid: 2000, gid: 2000, mode: file | 0644, mask: unixROK, want: fs.OK},
+		{name: "other read denied", uid: 2000, gid: 2000, mode: file | 0640, mask: unixROK, want: syscall.EACCES},
+		{name: "supplementary group read", uid: 2000, gid: 2000, pid: groupPid, mode: file | 0640, mask: unixROK, want: fs.OK},
+		{name: "root read without r bits", uid: 0, gid: 0, mode: file | 0000, mask: unixROK, want: fs.OK},
+		{name: "root exec without x bit", uid: 0, gid: 0, mode: file | 0644, mask: unixXOK, want: syscall.EACCES},
+		{name: "root exec with an x bit", uid: 0, gid: 0, mode: file | 0601, mask: unixXOK, want: fs.OK},
+		{name: "root search of dir without x bit", uid: 0, gid: 0, mode: dir | 0600, mask: unixXOK, want: fs.OK},
+		{name: "write to image", uid: 1000, gid: 1000, mode: file | 0777, mask: unixWOK, want: syscall.EROFS},
+		{name: "write to image as root", uid: 0, gid: 0, mode: file | 0777, mask: unixROK | unixWOK, want: syscall.EROFS},
+		{name: "world readable", uid: 2000, gid: 2000, mode: file | 0600, mask: unixROK | unixXOK, worldReadable: true, want: fs.OK},
+		{name: "world readable write", uid: 2000, gid: 2000, mode: file | 0666, mask: unixWOK, worldReadable: true, want: syscall.EROFS},
+		{name: "no caller", uid: -1, mode: file | 0000, mask: unixROK | unixXOK, want: fs.OK},
+		{name: "host write by owner", uid: 1000, gid: 1000, mode: file | 0644, mask: unixWOK, host: true, want: fs.OK},
+		{name: "host write by group", uid: 2000, gid: 100, mode: file | 0664, mask: unixWOK, host: true, want: fs.OK},
+		{name: "host write by other", uid: 2000, gid: 2000, mode: file | 0644, mask: unixWOK, host: true, want: syscall.EACCES},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name == "supplementary group read" && groupPid == 0 {
+				t.Skip("needs root to start a process with supplementary groups")
+			}
+			ctx := context.Background()
+			if tt.uid >= 0 {
+				ctx = &fuse.Context{Caller: fuse.Caller{Owner: fuse.Owner{Uid: uint32(tt.uid), Gid: uint32(tt.gid)}, Pid: tt.pid}}
+			}
+			attr := &fuse.Attr{Mode: tt.mode, Owner: fuse.Owner{Uid: 1000, Gid: 100}}
+
+			var got syscall.Errno
+			if tt.host {
+				got = modePermissions(ctx, attr, tt.mask)
+			} else {
+				got = (&ociFS{worldReadable: tt.worldReadable}).checkPermissions(ctx, attr, tt.mask)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
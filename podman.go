@@ -0,0 +1,353 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultContainersStorage is where podman and buildah keep the images of
+// root.
+const DefaultContainersStorage = "/var/lib/containers/storage"
+
+// WithContainersStorage reads images for containers-storage: references from
+// the containers/storage graph root at root rather than
+// DefaultContainersStorage. Only the overlay driver is supported.
+var WithContainersStorage = func(root string) Option {
+	return func(o *OCIFS) {
+		o.sources[SchemeContainersStorage] = &containersStorage{root: root}
+	}
+}
+
+// containersStorage resolves image names or IDs to the images podman and
+// buildah store in containers/storage. The compressed layers are not kept
+// there, so each layer is rebuilt as a tar of its overlay diff directory,
+// and the resolved image gets a digest of its own.
+type containersStorage struct {
+	root string
+}
+
+type storageImage struct {
+	ID     string   `json:"id"`
+	Digest string   `json:"digest"`
+	Names  []string `json:"names"`
+	Layer  string   `json:"layer"`
+}
+
+type storageLayer struct {
+	ID     string `json:"id"`
+	Parent string `json:"parent"`
+}
+
+func (c *containersStorage) Resolve(ctx context.Context, ref string) (v1.Image, error) {
+	var images []storageImage
+	if err := readJSON(filepath.Join(c.root, "overlay-images", "images.json"), &images); err != nil {
+		return nil, err
+	}
+	img, err := findStorageImage(images, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := c.config(img)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := c.layerChain(img.Layer)
+	if err != nil {
+		return nil, err
+	}
+
+	layers := make([]v1.Layer, len(chain))
+	for i, id := range chain {
+		diff := filepath.Join(c.root, "overlay", id, "diff")
+		if layers[i], err = tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return tarDiff(diff), nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return appendWithHistory(cfg, layers)
+}
+
+// findStorageImage finds the image named ref, comparing normalized names so
+// alpine matches docker.io/library/alpine:latest, or whose ID starts with
+// ref.
+func findStorageImage(images []storageImage, ref string) (storageImage, error) {
+	want := ""
+	if r, err := name.ParseReference(ref); err == nil {
+		want = r.Name()
+	}
+	for _, img := range images {
+		if len(ref) >= 12 && strings.HasPrefix(img.ID, ref) {
+			return img, nil
+		}
+		for _, n := range img.Names {
+			if r, err := name.ParseReference(n); err == nil && r.Name() == want {
+				return img, nil
+			}
+		}
+	}
+	return storageImage{}, fmt.Errorf("image %s not found in containers storage", ref)
+}
+
+// config reads the config of img, which containers/storage keeps as a big
+// data item keyed by its digest.
+func (c *containersStorage) config(img storageImage) (*v1.ConfigFile, error) {
+	var m v1.Manifest
+	if err := readJSON(c.bigData(img.ID, "manifest"), &m); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(c.bigData(img.ID, m.Config.Digest.String()))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return v1.ParseConfigFile(f)
+}
+
+// bigData returns the file a big data item of an image is stored in. Keys
+// with characters other than lowercase letters, digits and dots are base64
+// encoded behind an equals sign.
+func (c *containersStorage) bigData(id, key string) string {
+	base := key
+	if strings.TrimLeft(key, "abcdefghijklmnopqrstuvwxyz0123456789.") != "" {
+		base = "=" + base64.StdEncoding.EncodeToString([]byte(key))
+	}
+	return filepath.Join(c.root, "overlay-images", id, base)
+}
+
+// layerChain returns the IDs of the layers from the base up to top.
+func (c *containersStorage) layerChain(top string) ([]string, error) {
+	var layers []storageLayer
+	for _, f := range []string{"layers.json", "volatile-layers.json"} {
+		var l []storageLayer
+		err := readJSON(filepath.Join(c.root, "overlay-layers", f), &l)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		layers = append(layers, l...)
+	}
+	parents := map[string]string{}
+	for _, l := range layers {
+		parents[l.ID] = l.Parent
+	}
+
+	var chain []string
+	for id := top; id != ""; id = parents[id] {
+		if _, ok := parents[id]; !ok {
+			return nil, fmt.Errorf("layer %s not found in containers storage", id)
+		}
+		if len(chain) > len(layers) {
+			return nil, fmt.Errorf("layer %s has a cyclic parent chain", top)
+		}
+		chain = append([]string{id}, chain...)
+	}
+	return chain, nil
+}
+
+// appendWithHistory builds an image of cfg and layers, keeping the history
+// of cfg lined up with the layers, whose diff IDs differ from those of the
+// original blobs.
+func appendWithHistory(cfg *v1.ConfigFile, layers []v1.Layer) (v1.Image, error) {
+	history := cfg.History
+	cfg = cfg.DeepCopy()
+	cfg.RootFS.DiffIDs = nil
+	cfg.History = nil
+	base, err := mutate.ConfigFile(empty.Image, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	nonEmpty := 0
+	for _, h := range history {
+		if !h.EmptyLayer {
+			nonEmpty++
+		}
+	}
+	if nonEmpty != len(layers) {
+		return mutate.AppendLayers(base, layers...)
+	}
+
+	adds := make([]mutate.Addendum, 0, len(history))
+	for _, h := range history {
+		add := mutate.Addendum{History: h}
+		if !h.EmptyLayer {
+			add.Layer, layers = layers[0], layers[1:]
+		}
+		adds = append(adds, add)
+	}
+	return mutate.Append(base, adds...)
+}
+
+// tarDiff streams an overlay diff directory as a layer tar, turning whiteout
+// devices into .wh. entries and opaque directories into .wh..wh..opq.
+func tarDiff(dir string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeDiff(pw, dir))
+	}()
+	return pr
+}
+
+func writeDiff(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	links := map[uint64]string{}
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSocket != 0 {
+			return nil
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+
+		if fi.Mode()&fs.ModeCharDevice != 0 && st.Rdev == 0 {
+			return tw.WriteHeader(&tar.Header{
+				Name:     whiteoutName(rel),
+				Typeflag: tar.TypeReg,
+				ModTime:  fi.ModTime(),
+			})
+		}
+
+		link := ""
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.PAXRecords = diffXattrs(p)
+
+		if fi.Mode().IsRegular() && st.Nlink > 1 {
+			if first, ok := links[st.Ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				links[st.Ino] = rel
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.IsDir() && isOpaque(p) {
+			if err := tw.WriteHeader(&tar.Header{
+				Name:     rel + "/.wh..wh..opq",
+				Typeflag: tar.TypeReg,
+				ModTime:  fi.ModTime(),
+			}); err != nil {
+				return err
+			}
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// whiteoutName returns the tar name that deletes rel in lower layers.
+func whiteoutName(rel string) string {
+	dir, base := filepath.Split(rel)
+	return dir + ".wh." + base
+}
+
+// isOpaque reports whether the overlay directory at p hides the content of
+// lower layers, as marked by overlayfs or fuse-overlayfs.
+func isOpaque(p string) bool {
+	for _, attr := range []string{"trusted.overlay.opaque", "user.overlay.opaque", "user.fuseoverlayfs.opaque"} {
+		buf := make([]byte, 1)
+		if n, err := unix.Lgetxattr(p, attr, buf); err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// diffXattrs returns the extended attributes of p as PAX records, leaving
+// out those overlayfs uses for its own bookkeeping.
+func diffXattrs(p string) map[string]string {
+	size, err := unix.Llistxattr(p, nil)
+	if err != nil || size <= 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(p, buf); err != nil {
+		return nil
+	}
+
+	var recs map[string]string
+	for _, attr := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if attr == "" || strings.Contains(attr, "overlay.") {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(p, attr, nil)
+		if err != nil {
+			continue
+		}
+		val := make([]byte, vsize)
+		if vsize, err = unix.Lgetxattr(p, attr, val); err != nil {
+			continue
+		}
+		if recs == nil {
+			recs = map[string]string{}
+		}
+		recs["SCHILY.xattr."+attr] = string(val[:vsize])
+	}
+	return recs
+}
+
+func readJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,102 @@
+package ocifs
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sys/unix"
+)
+
+func TestContainersStorage(t *testing.T) {
+	root := t.TempDir()
+	write := func(p, data string) {
+		t.Helper()
+		p = filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	marshal := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// base layer with a file, a hardlink and a directory, and an upper layer
+	// deleting the file and making the directory opaque
+	write("overlay/base/diff/etc/motd", "hello")
+	write("overlay/base/diff/lib/old", "old")
+	if err := os.Link(filepath.Join(root, "overlay/base/diff/etc/motd"), filepath.Join(root, "overlay/base/diff/etc/issue")); err != nil {
+		t.Fatal(err)
+	}
+	write("overlay/upper/diff/lib/new", "new")
+	if err := os.Mkdir(filepath.Join(root, "overlay/upper/diff/etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mknod(filepath.Join(root, "overlay/upper/diff/etc/motd"), unix.S_IFCHR, 0); err != nil {
+		t.Skipf("cannot create whiteout device: %v", err)
+	}
+	if err := unix.Setxattr(filepath.Join(root, "overlay/upper/diff/lib"), "user.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Skipf("cannot set opaque xattr: %v", err)
+	}
+	write("overlay-layers/layers.json", marshal([]storageLayer{{ID: "base"}, {ID: "upper", Parent: "base"}}))
+
+	cfg := v1.ConfigFile{
+		Architecture: "amd64",
+		OS:           "linux",
+		Config:       v1.Config{Env: []string{"PATH=/bin"}},
+		History:      []v1.History{{CreatedBy: "ADD base"}, {CreatedBy: "ENV PATH=/bin", EmptyLayer: true}, {CreatedBy: "RUN upgrade"}},
+	}
+	const cfgDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	c := &containersStorage{root: root}
+	write(filepath.Join("overlay-images", "img1", "manifest"), `{"schemaVersion":2,"config":{"digest":"`+cfgDigest+`"}}`)
+	rel, err := filepath.Rel(root, c.bigData("img1", cfgDigest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(rel, marshal(cfg))
+	write("overlay-images/images.json", marshal([]storageImage{{ID: "img1", Names: []string{"docker.io/library/app:latest"}, Layer: "upper"}}))
+
+	ofs, err := New(WithWorkDir(t.TempDir()), WithContainersStorage(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := ofs.Image("containers-storage:app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := img.FS()
+	for name, want := range map[string]string{"etc/issue": "hello", "lib/new": "new"} {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Errorf("read %s: %v", name, err)
+			continue
+		}
+		if string(data) != want {
+			t.Errorf("%s = %q, want %q", name, data, want)
+		}
+	}
+	for _, name := range []string{"etc/motd", "lib/old"} {
+		if _, err := fs.Stat(fsys, name); err == nil {
+			t.Errorf("%s exists, want it deleted", name)
+		}
+	}
+
+	got, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.RootFS.DiffIDs) != 2 || len(got.History) != 3 || got.History[2].CreatedBy != "RUN upgrade" {
+		t.Errorf("config rootfs %v history %v, want 2 layers and the original history", got.RootFS.DiffIDs, got.History)
+	}
+}
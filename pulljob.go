@@ -0,0 +1,225 @@
+package ocifs
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// PullState is the stage a pull is at.
+type PullState string
+
+const (
+	// PullQueued pulls wait for one of the pulls running to finish, see
+	// WithMaxConcurrentPulls.
+	PullQueued  PullState = "queued"
+	PullRunning PullState = "running"
+	PullDone    PullState = "done"
+	PullFailed  PullState = "failed"
+)
+
+// PullStatus describes a pull started with StartPull. The counts are filled
+// in as the pull gets to them, and stay zero for images found in the cache.
+type PullStatus struct {
+	ImageRef string    `json:"imageRef"`
+	State    PullState `json:"state"`
+	// Digest is that of the image, once resolved.
+	Digest v1.Hash `json:"digest"`
+	// BytesTotal is the compressed size of the layers missing from the
+	// store, and BytesDownloaded how much of it was downloaded.
+	BytesTotal      int64 `json:"bytesTotal"`
+	BytesDownloaded int64 `json:"bytesDownloaded"`
+	// Layers is the number of layers of the image, and LayersUnpacked how
+	// many of them are unpacked.
+	Layers         int       `json:"layers"`
+	LayersUnpacked int       `json:"layersUnpacked"`
+	Error          string    `json:"error,omitempty"`
+	Queued         time.Time `json:"queued"`
+	Started        time.Time `json:"started,omitempty"`
+	Finished       time.Time `json:"finished,omitempty"`
+}
+
+// WithMaxConcurrentPulls runs at most n pulls at the same time, including
+// those of mounts, queueing the others. There is no limit by default.
+var WithMaxConcurrentPulls = func(n int) Option {
+	return func(o *OCIFS) {
+		if n > 0 {
+			o.pullSlots = make(chan struct{}, n)
+		}
+	}
+}
+
+// StartPull pulls imgRef in the background, as Pull does, and returns its
+// status. A pull of imgRef already running is joined rather than started
+// again. Mounts of imgRef made while it runs wait for it, and those made
+// after it is done find the image in the cache.
+//
+// A pull that failed is resumed by starting it again: the layers it stored
+// and unpacked, also by pulls of other processes sharing the work dir, are
+// not fetched again.
+func (o *OCIFS) StartPull(imgRef string) PullStatus {
+	o.mu.Lock()
+	call, ok := o.cachedPull(imgRef)
+	if !ok {
+		call, _ = o.startPull(context.Background(), imgRef)
+	}
+	o.jobs[imgRef] = call
+	o.mu.Unlock()
+	return call.status(imgRef)
+}
+
+// PullStatus returns the status of the last pull of imgRef started with
+// StartPull, if any.
+func (o *OCIFS) PullStatus(imgRef string) (PullStatus, bool) {
+	o.mu.Lock()
+	call, ok := o.jobs[imgRef]
+	o.mu.Unlock()
+	if !ok {
+		return PullStatus{}, false
+	}
+	return call.status(imgRef), true
+}
+
+// PullStatuses returns the status of the last pull of each reference started
+// with StartPull.
+func (o *OCIFS) PullStatuses() []PullStatus {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	statuses := make([]PullStatus, 0, len(o.jobs))
+	for ref, call := range o.jobs {
+		statuses = append(statuses, call.status(ref))
+	}
+	return statuses
+}
+
+// cachedPull returns a finished pull for imgRef if it is in the cache. It
+// must be called with o.mu held.
+func (o *OCIFS) cachedPull(imgRef string) (*pullCall, bool) {
+	ce, ok := o.cache[imgRef]
+	if !ok || !ce.exp.After(time.Now()) {
+		return nil, false
+	}
+	now := time.Now()
+	call := &pullCall{done: make(chan struct{}), h: ce.hash}
+	call.progress.state = PullDone
+	call.progress.digest = *ce.hash
+	call.progress.queued, call.progress.started, call.progress.finished = now, now, now
+	close(call.done)
+	return call, true
+}
+
+// status returns the status of the pull of imgRef.
+func (c *pullCall) status(imgRef string) PullStatus {
+	p := &c.progress
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := PullStatus{
+		ImageRef:        imgRef,
+		State:           p.state,
+		Digest:          p.digest,
+		BytesTotal:      p.bytesTotal,
+		BytesDownloaded: p.downloaded,
+		Layers:          p.layers,
+		LayersUnpacked:  p.unpacked,
+		Queued:          p.queued,
+		Started:         p.started,
+		Finished:        p.finished,
+	}
+	if p.err != nil {
+		st.Error = p.err.Error()
+	}
+	return st
+}
+
+// pullProgress tracks how far a pull got. Its methods do nothing on a nil
+// pullProgress, for stores that are not pulls, such as imports.
+type pullProgress struct {
+	mu         sync.Mutex
+	state      PullState
+	digest     v1.Hash
+	bytesTotal int64
+	downloaded int64
+	layers     int
+	unpacked   int
+	err        error
+	queued     time.Time
+	started    time.Time
+	finished   time.Time
+}
+
+func (p *pullProgress) start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state = PullRunning
+	p.started = time.Now()
+}
+
+func (p *pullProgress) finish(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state, p.err = PullDone, err
+	if err != nil {
+		p.state = PullFailed
+	}
+	p.finished = time.Now()
+}
+
+func (p *pullProgress) resolved(h v1.Hash) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.digest = h
+}
+
+func (p *pullProgress) downloading(total int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bytesTotal = total
+}
+
+func (p *pullProgress) unpacking(layers int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.layers = layers
+}
+
+func (p *pullProgress) layerUnpacked() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.unpacked++
+}
+
+// counting returns rc counting what is read from it as downloaded.
+func (p *pullProgress) counting(rc io.ReadCloser) io.ReadCloser {
+	if p == nil {
+		return rc
+	}
+	return &countingReader{ReadCloser: rc, p: p}
+}
+
+type countingReader struct {
+	io.ReadCloser
+	p *pullProgress
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.p.mu.Lock()
+	r.p.downloaded += int64(n)
+	r.p.mu.Unlock()
+	return n, err
+}
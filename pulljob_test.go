@@ -0,0 +1,116 @@
+package ocifs
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestStartPull(t *testing.T) {
+	block := make(chan struct{})
+	host := testRegistry(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v2/slow/manifests/") {
+			<-block
+		}
+		return false
+	})
+	var once sync.Once
+	release := func() { once.Do(func() { close(block) }) }
+	defer release()
+
+	push := func(repo string) (name.Reference, v1.Hash) {
+		ref, err := name.ParseReference(host + "/" + repo + ":v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := random.Image(1024, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(ref, img); err != nil {
+			t.Fatal(err)
+		}
+		h, err := img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ref, h
+	}
+	slow, slowDigest := push("slow")
+	fast, _ := push("fast")
+
+	ofs, err := New(WithWorkDir(t.TempDir()), WithMaxConcurrentPulls(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ofs.PullStatus(slow.String()); ok {
+		t.Error("status of a pull never started")
+	}
+
+	ofs.StartPull(slow.String())
+	waitPull(t, ofs, slow.String(), PullRunning)
+	if st := ofs.StartPull(fast.String()); st.State != PullQueued {
+		t.Errorf("second pull is %s, want queued behind the first", st.State)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if st, _ := ofs.PullStatus(fast.String()); st.State != PullQueued {
+		t.Errorf("second pull is %s while the first runs, want queued", st.State)
+	}
+
+	release()
+	st := waitPull(t, ofs, slow.String(), PullDone)
+	if st.Digest != slowDigest || st.Layers != 2 || st.LayersUnpacked != 2 {
+		t.Errorf("status %+v, want digest %s and 2 layers unpacked", st, slowDigest)
+	}
+	if st.BytesTotal == 0 || st.BytesDownloaded != st.BytesTotal {
+		t.Errorf("downloaded %d of %d bytes", st.BytesDownloaded, st.BytesTotal)
+	}
+	if st.Started.Before(st.Queued) || st.Finished.Before(st.Started) {
+		t.Errorf("times queued %v, started %v, finished %v out of order", st.Queued, st.Started, st.Finished)
+	}
+	waitPull(t, ofs, fast.String(), PullDone)
+	if n := len(ofs.PullStatuses()); n != 2 {
+		t.Errorf("%d pulls listed, want 2", n)
+	}
+
+	// a failed pull is started again once the image is there
+	missing := host + "/later:v1"
+	ofs.StartPull(missing)
+	if st := waitPull(t, ofs, missing, PullFailed); st.Error == "" {
+		t.Error("failed pull has no error")
+	}
+	later, _ := push("later")
+	ofs.StartPull(later.String())
+	waitPull(t, ofs, later.String(), PullDone)
+
+	// pulls of cached images are done right away
+	if st := ofs.StartPull(slow.String()); st.State != PullDone || st.Digest != slowDigest {
+		t.Errorf("pull of cached image: %+v", st)
+	}
+}
+
+// waitPull waits for the pull of ref started with StartPull to reach state.
+func waitPull(t *testing.T, ofs *OCIFS, ref string, state PullState) PullStatus {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		st, ok := ofs.PullStatus(ref)
+		if !ok {
+			t.Fatalf("no pull of %s", ref)
+		}
+		if st.State == state {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pull of %s is %s, want %s", ref, st.State, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
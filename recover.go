@@ -0,0 +1,321 @@
+package ocifs
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// WithCrashOnPanic lets a panic in a file system handler crash the process,
+// as it would without ocifs recovering it, which is handier to debug during
+// development. By default the panic is logged with its stack, reported as an
+// EventError and the request fails with EIO, leaving the mount serving.
+var WithCrashOnPanic = func() Option {
+	return func(o *OCIFS) {
+		o.crashOnPanic = true
+	}
+}
+
+// recoverFS recovers panics in the handlers of the wrapped file system, so
+// a bug hit by one request does not take the mount down for every user.
+// Once the mount is shutting down, it also refuses every operation but
+// those letting the handles already open finish.
+type recoverFS struct {
+	fuse.RawFileSystem
+	im      *ImageMount
+	handles *handleTracker
+}
+
+// recover is deferred by each handler. It turns a panic into EIO in code,
+// if the handler returns a status.
+func (f *recoverFS) recover(op string, nodeID uint64, code *fuse.Status) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if f.im.ofs.crashOnPanic {
+		panic(r)
+	}
+
+	err := fmt.Errorf("panic in %s: %v", op, r)
+	slog.Error("panic in fuse handler", "op", op, "node", nodeID, "mountpoint", f.im.mountPoint, "panic", r, "stack", string(debug.Stack()))
+	f.im.ofs.emit(Event{Type: EventError, ImageRef: f.im.ref, Digest: f.im.h, MountPoint: f.im.mountPoint, Err: err})
+	if code != nil {
+		*code = fuse.EIO
+	}
+}
+
+// refused reports whether op must fail because the mount is shutting down.
+func (f *recoverFS) refused(op string, nodeID uint64) bool {
+	if !f.handles.closing() {
+		return false
+	}
+	f.im.ofs.logs.debug(Op(op), "Refused, shutting down", "node", nodeID)
+	return true
+}
+
+func (f *recoverFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) (code fuse.Status) {
+	defer f.recover("lookup", header.NodeId, &code)
+	if f.refused("lookup", header.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.Lookup(cancel, header, name, out)
+}
+
+func (f *recoverFS) Forget(nodeid, nlookup uint64) {
+	defer f.recover("forget", nodeid, nil)
+	f.RawFileSystem.Forget(nodeid, nlookup)
+}
+
+func (f *recoverFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) (code fuse.Status) {
+	defer f.recover("getattr", input.NodeId, &code)
+	return f.RawFileSystem.GetAttr(cancel, input, out)
+}
+
+func (f *recoverFS) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) (code fuse.Status) {
+	defer f.recover("setattr", input.NodeId, &code)
+	if f.refused("setattr", input.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.SetAttr(cancel, input, out)
+}
+
+func (f *recoverFS) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) (code fuse.Status) {
+	defer f.recover("mknod", input.NodeId, &code)
+	if f.refused("mknod", input.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.Mknod(cancel, input, name, out)
+}
+
+func (f *recoverFS) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) (code fuse.Status) {
+	defer f.recover("mkdir", input.NodeId, &code)
+	if f.refused("mkdir", input.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.Mkdir(cancel, input, name, out)
+}
+
+func (f *recoverFS) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) (code fuse.Status) {
+	defer f.recover("unlink", header.NodeId, &code)
+	if f.refused("unlink", header.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.Unlink(cancel, header, name)
+}
+
+func (f *recoverFS) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) (code fuse.Status) {
+	defer f.recover("rmdir", header.NodeId, &code)
+	if f.refused("rmdir", header.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.Rmdir(cancel, header, name)
+}
+
+func (f *recoverFS) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) (code fuse.Status) {
+	defer f.recover("rename", input.NodeId, &code)
+	if f.refused("rename", input.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.Rename(cancel, input, oldName, newName)
+}
+
+func (f *recoverFS) Link(cancel <-chan struct{}, input *fuse.LinkIn, filename string, out *fuse.EntryOut) (code fuse.Status) {
+	defer f.recover("link", input.NodeId, &code)
+	if f.refused("link", input.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.Link(cancel, input, filename, out)
+}
+
+func (f *recoverFS) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) (code fuse.Status) {
+	defer f.recover("symlink", header.NodeId, &code)
+	if f.refused("symlink", header.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.Symlink(cancel, header, pointedTo, linkName, out)
+}
+
+func (f *recoverFS) Readlink(cancel <-chan struct{}, header *fuse.InHeader) (out []byte, code fuse.Status) {
+	defer f.recover("readlink", header.NodeId, &code)
+	if f.refused("readlink", header.NodeId) {
+		return nil, fuse.EIO
+	}
+	return f.RawFileSystem.Readlink(cancel, header)
+}
+
+func (f *recoverFS) Access(cancel <-chan struct{}, input *fuse.AccessIn) (code fuse.Status) {
+	defer f.recover("access", input.NodeId, &code)
+	if f.refused("access", input.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.Access(cancel, input)
+}
+
+func (f *recoverFS) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (sz uint32, code fuse.Status) {
+	defer f.recover("getxattr", header.NodeId, &code)
+	if f.refused("getxattr", header.NodeId) {
+		return 0, fuse.EIO
+	}
+	return f.RawFileSystem.GetXAttr(cancel, header, attr, dest)
+}
+
+func (f *recoverFS) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (sz uint32, code fuse.Status) {
+	defer f.recover("listxattr", header.NodeId, &code)
+	if f.refused("listxattr", header.NodeId) {
+		return 0, fuse.EIO
+	}
+	return f.RawFileSystem.ListXAttr(cancel, header, dest)
+}
+
+func (f *recoverFS) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) (code fuse.Status) {
+	defer f.recover("setxattr", input.NodeId, &code)
+	if f.refused("setxattr", input.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.SetXAttr(cancel, input, attr, data)
+}
+
+func (f *recoverFS) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) (code fuse.Status) {
+	defer f.recover("removexattr", header.NodeId, &code)
+	if f.refused("removexattr", header.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.RemoveXAttr(cancel, header, attr)
+}
+
+func (f *recoverFS) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) (code fuse.Status) {
+	defer f.recover("create", input.NodeId, &code)
+	if f.refused("create", input.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.Create(cancel, input, name, out)
+}
+
+func (f *recoverFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) (code fuse.Status) {
+	defer f.recover("open", input.NodeId, &code)
+	if f.refused("open", input.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.Open(cancel, input, out)
+}
+
+func (f *recoverFS) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (res fuse.ReadResult, code fuse.Status) {
+	defer f.recover("read", input.NodeId, &code)
+	return f.RawFileSystem.Read(cancel, input, buf)
+}
+
+func (f *recoverFS) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.LseekOut) (code fuse.Status) {
+	defer f.recover("lseek", in.NodeId, &code)
+	return f.RawFileSystem.Lseek(cancel, in, out)
+}
+
+func (f *recoverFS) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.LkOut) (code fuse.Status) {
+	defer f.recover("getlk", input.NodeId, &code)
+	if f.refused("getlk", input.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.GetLk(cancel, input, out)
+}
+
+func (f *recoverFS) SetLk(cancel <-chan struct{}, input *fuse.LkIn) (code fuse.Status) {
+	defer f.recover("setlk", input.NodeId, &code)
+	if f.refused("setlk", input.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.SetLk(cancel, input)
+}
+
+func (f *recoverFS) SetLkw(cancel <-chan struct{}, input *fuse.LkIn) (code fuse.Status) {
+	defer f.recover("setlkw", input.NodeId, &code)
+	if f.refused("setlkw", input.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.SetLkw(cancel, input)
+}
+
+func (f *recoverFS) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
+	defer f.recover("release", input.NodeId, nil)
+	f.RawFileSystem.Release(cancel, input)
+}
+
+func (f *recoverFS) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (written uint32, code fuse.Status) {
+	defer f.recover("write", input.NodeId, &code)
+	if f.refused("write", input.NodeId) {
+		return 0, fuse.EIO
+	}
+	return f.RawFileSystem.Write(cancel, input, data)
+}
+
+func (f *recoverFS) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRangeIn) (written uint32, code fuse.Status) {
+	defer f.recover("copyfilerange", input.NodeId, &code)
+	if f.refused("copyfilerange", input.NodeId) {
+		return 0, fuse.EIO
+	}
+	return f.RawFileSystem.CopyFileRange(cancel, input)
+}
+
+func (f *recoverFS) Flush(cancel <-chan struct{}, input *fuse.FlushIn) (code fuse.Status) {
+	defer f.recover("flush", input.NodeId, &code)
+	return f.RawFileSystem.Flush(cancel, input)
+}
+
+func (f *recoverFS) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) (code fuse.Status) {
+	defer f.recover("fsync", input.NodeId, &code)
+	return f.RawFileSystem.Fsync(cancel, input)
+}
+
+func (f *recoverFS) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) (code fuse.Status) {
+	defer f.recover("fallocate", input.NodeId, &code)
+	if f.refused("fallocate", input.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.Fallocate(cancel, input)
+}
+
+func (f *recoverFS) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) (code fuse.Status) {
+	defer f.recover("opendir", input.NodeId, &code)
+	if f.refused("opendir", input.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.OpenDir(cancel, input, out)
+}
+
+func (f *recoverFS) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) (code fuse.Status) {
+	defer f.recover("readdir", input.NodeId, &code)
+	if f.refused("readdir", input.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.ReadDir(cancel, input, out)
+}
+
+func (f *recoverFS) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) (code fuse.Status) {
+	defer f.recover("readdirplus", input.NodeId, &code)
+	if f.refused("readdirplus", input.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.ReadDirPlus(cancel, input, out)
+}
+
+func (f *recoverFS) ReleaseDir(input *fuse.ReleaseIn) {
+	defer f.recover("releasedir", input.NodeId, nil)
+	f.RawFileSystem.ReleaseDir(input)
+}
+
+func (f *recoverFS) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) (code fuse.Status) {
+	defer f.recover("fsyncdir", input.NodeId, &code)
+	if f.refused("fsyncdir", input.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.FsyncDir(cancel, input)
+}
+
+func (f *recoverFS) StatFs(cancel <-chan struct{}, input *fuse.InHeader, out *fuse.StatfsOut) (code fuse.Status) {
+	defer f.recover("statfs", input.NodeId, &code)
+	if f.refused("statfs", input.NodeId) {
+		return fuse.EIO
+	}
+	return f.RawFileSystem.StatFs(cancel, input, out)
+}
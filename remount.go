@@ -0,0 +1,149 @@
+package ocifs
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// RemountPolicy configures how mounts are brought back when they fail.
+type RemountPolicy struct {
+	// Interval between health checks of each mount. If zero, mounts are
+	// only remounted when their FUSE server exits.
+	Interval time.Duration
+	// Backoff is the delay after a failed remount, doubled after each
+	// further failure up to a minute. It defaults to a second.
+	Backoff time.Duration
+	// MaxAttempts caps the consecutive failed remounts before the mount is
+	// given up, and Wait returns. Zero means no limit.
+	MaxAttempts int
+}
+
+// maxRemountBackoff caps the delay between remount attempts.
+const maxRemountBackoff = time.Minute
+
+var errServerExited = errors.New("fuse server exited")
+
+// WithAutoRemount remounts mounts at the same mount point when their FUSE
+// server exits without being unmounted, or when they fail a health check,
+// after detaching the stale mount. The content is served again from the
+// unpacked layers, without touching the registry. Each remount emits an
+// EventRemounted, each failure an EventError.
+var WithAutoRemount = func(policy RemountPolicy) Option {
+	return func(o *OCIFS) {
+		o.remountPolicy = &policy
+	}
+}
+
+// supervise keeps the mount served according to policy until it is
+// unmounted or remounting it fails too many times.
+func (im *ImageMount) supervise(policy RemountPolicy) {
+	defer close(im.done)
+	defer im.removeCreated()
+
+	for {
+		cause := im.watch(policy)
+		if cause == nil {
+			return
+		}
+		slog.Warn("mount failed, remounting", "mountpoint", im.mountPoint, "error", cause)
+		im.ofs.emit(Event{Type: EventError, ImageRef: im.ref, Digest: im.h, MountPoint: im.mountPoint, Err: cause})
+		if !im.remount(policy) {
+			return
+		}
+	}
+}
+
+// watch waits for the current server of the mount to fail, returning why,
+// or for it to be unmounted, returning nil.
+func (im *ImageMount) watch(policy RemountPolicy) error {
+	im.mu.Lock()
+	exited := im.exited
+	im.mu.Unlock()
+
+	var tick <-chan time.Time
+	if policy.Interval > 0 {
+		t := time.NewTicker(policy.Interval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		select {
+		case <-exited:
+			if im.closing.Load() {
+				return nil
+			}
+			return errServerExited
+		case <-tick:
+			if im.closing.Load() {
+				continue
+			}
+			if err := im.Healthy(); err != nil && !im.closing.Load() {
+				return err
+			}
+		}
+	}
+}
+
+// wakeSupervisor interrupts the wait of the supervisor between remount
+// attempts, so that it sees the mount is closing.
+func (im *ImageMount) wakeSupervisor() {
+	select {
+	case im.wake <- struct{}{}:
+	default:
+	}
+}
+
+// serverExited reports whether the current server of the mount exited, as
+// when it is waiting to be remounted.
+func (im *ImageMount) serverExited() bool {
+	im.mu.Lock()
+	exited := im.exited
+	im.mu.Unlock()
+	select {
+	case <-exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// remount detaches the stale mount and serves the mount again, retrying as
+// policy allows. It reports whether the mount is served again.
+func (im *ImageMount) remount(policy RemountPolicy) bool {
+	backoff := policy.Backoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+
+	for attempt := 1; policy.MaxAttempts == 0 || attempt <= policy.MaxAttempts; attempt++ {
+		if im.closing.Load() {
+			return false
+		}
+
+		// the stale mount may already be gone
+		if err := forceUnmount(im.mountPoint); err != nil {
+			slog.Debug("detach stale mount", "mountpoint", im.mountPoint, "error", err)
+		}
+
+		err := im.serve()
+		if err == nil {
+			slog.Info("remounted", "mountpoint", im.mountPoint, "attempt", attempt)
+			im.ofs.emit(Event{Type: EventRemounted, ImageRef: im.ref, Digest: im.h, MountPoint: im.mountPoint})
+			return true
+		}
+
+		slog.Error("remount", "mountpoint", im.mountPoint, "attempt", attempt, "error", err)
+		im.ofs.emit(Event{Type: EventError, ImageRef: im.ref, Digest: im.h, MountPoint: im.mountPoint, Err: err})
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-im.wake:
+			t.Stop()
+		}
+		backoff = min(backoff*2, maxRemountBackoff)
+	}
+
+	return false
+}
@@ -0,0 +1,62 @@
+package ocifs
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUnmountDuringRemountBackoff(t *testing.T) {
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	pushRandomImage(t, ref, 256, 1)
+
+	failed := make(chan error, 16)
+	ofs, err := New(WithWorkDir(t.TempDir()), WithAutoRemount(RemountPolicy{Backoff: time.Minute}), WithEventHandler(func(ev Event) {
+		if ev.Type == EventError {
+			failed <- ev.Err
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lower := t.TempDir()
+	im, err := ofs.Mount(ref.String(), MountWithTargetPath(t.TempDir()), MountWithLowerDir(lower))
+	if errors.Is(err, ErrFUSEUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// remounting fails without the lower dir
+	if err := os.Remove(lower); err != nil {
+		t.Fatal(err)
+	}
+	if err := forceUnmount(im.MountPoint()); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(10 * time.Second)
+	for remountFailed := false; !remountFailed; {
+		select {
+		case err := <-failed:
+			remountFailed = !errors.Is(err, errServerExited)
+		case <-timeout:
+			t.Fatal("remount did not fail")
+		}
+	}
+
+	if err := im.Unmount(); err != nil {
+		t.Fatalf("unmount while waiting to remount: %v", err)
+	}
+	waited := make(chan struct{})
+	go func() {
+		im.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait still blocked by the remount backoff after unmounting")
+	}
+}
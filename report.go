@@ -0,0 +1,176 @@
+package ocifs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// MountReport summarizes a mount, for logging by tools such as CI systems.
+// The byte counts are those of the compressed layers.
+type MountReport struct {
+	ImageRef        string        `json:"imageRef"`
+	Digest          v1.Hash       `json:"digest"`
+	Platform        *v1.Platform  `json:"platform,omitempty"`
+	MountPoint      string        `json:"mountPoint"`
+	Layers          int           `json:"layers"`
+	BytesDownloaded int64         `json:"bytesDownloaded"`
+	BytesCached     int64         `json:"bytesCached"`
+	UnpackTime      time.Duration `json:"unpackTime"`
+	Files           int           `json:"files"`
+	Options         []string      `json:"options,omitempty"`
+}
+
+// pullStats records what a pull had to do, as opposed to what it found in
+// the store.
+type pullStats struct {
+	downloaded int64
+	unpackTime time.Duration
+}
+
+// missingBytes returns the size of the layers of img whose blobs are not in
+// the store yet.
+func (s *OCIFS) missingBytes(img v1.Image) (int64, error) {
+	layers, err := s.fsLayers(img)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, l := range layers {
+		h, err := l.Digest()
+		if err != nil {
+			return 0, err
+		}
+		if s.hasBlob(h) {
+			continue
+		}
+		size, err := l.Size()
+		if err != nil {
+			return 0, err
+		}
+		n += size
+	}
+	return n, nil
+}
+
+// Report returns a summary of the mount: the image it serves, how much of it
+// had to be downloaded and unpacked when it was mounted, and the options in
+// effect.
+func (im *ImageMount) Report() (*MountReport, error) {
+	img, err := im.ofs.lp.Image(im.h)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := im.ofs.fsLayers(img)
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	for _, l := range layers {
+		n, err := l.Size()
+		if err != nil {
+			return nil, err
+		}
+		size += n
+	}
+
+	_, root := im.server()
+	files := 0
+	root.ut.Traverse(func(*unifiedTreeNode, string) bool {
+		files++
+		return true
+	})
+
+	return &MountReport{
+		ImageRef:        im.ref,
+		Digest:          im.h,
+		Platform:        cfg.Platform(),
+		MountPoint:      im.mountPoint,
+		Layers:          len(layers),
+		BytesDownloaded: im.stats.downloaded,
+		BytesCached:     size - im.stats.downloaded,
+		UnpackTime:      im.stats.unpackTime,
+		Files:           files,
+		Options:         im.options(),
+	}, nil
+}
+
+// options lists the mount options in effect, in the key=value form of mount
+// options where they take a value.
+func (im *ImageMount) options() []string {
+	var opts []string
+	if helper := im.FUSEHelper(); helper != "" {
+		opts = append(opts, "helper="+string(helper))
+	}
+	if im.readahead > 0 {
+		opts = append(opts, fmt.Sprintf("readahead=%d", im.readahead))
+	}
+	if im.directIO {
+		opts = append(opts, "direct_io")
+	}
+	if im.allowOther {
+		opts = append(opts, "allow_other")
+	}
+	if f := im.fixedAttrs; f != nil {
+		opts = append(opts, fmt.Sprintf("normalized_attrs=%d:%d:%d", f.epoch.Unix(), f.uid, f.gid))
+	}
+	if im.dateEpoch != nil {
+		opts = append(opts, fmt.Sprintf("source_date_epoch=%d", im.dateEpoch.Unix()))
+	}
+	if r := im.rootAttrs; r != nil {
+		opts = append(opts, fmt.Sprintf("root_attr=%04o:%d:%d", r.mode, r.uid, r.gid))
+	}
+	if im.verifyReads {
+		opts = append(opts, "verified_reads")
+	}
+	if im.worldReadable {
+		opts = append(opts, "world_readable")
+	}
+	if im.selinuxContext != "" {
+		opts = append(opts, "context="+im.selinuxContext)
+	}
+	if im.umask != 0 {
+		opts = append(opts, fmt.Sprintf("umask=%03o", im.umask))
+	}
+	if im.owner != nil {
+		opts = append(opts, fmt.Sprintf("owner=%d:%d", im.owner.uid, im.owner.gid))
+	}
+	if im.policy != nil {
+		opts = append(opts, "access_policy")
+	}
+	if im.audit != nil {
+		opts = append(opts, "audit_log")
+	}
+	if im.normalize != nil {
+		opts = append(opts, "unicode_normalization")
+	}
+	for _, d := range im.extraDirs {
+		opts = append(opts, "extra_dir="+d.Path)
+	}
+	for _, b := range im.bindDirs {
+		opts = append(opts, "bind="+b.hostPath+":"+b.mountPath)
+	}
+	for _, d := range im.lowerDirs {
+		opts = append(opts, "lower_dir="+d)
+	}
+	if len(im.hidden) > 0 {
+		opts = append(opts, "hidden="+strings.Join(im.hidden, ","))
+	}
+	masked := make([]string, 0, len(im.masked))
+	for p := range im.masked {
+		masked = append(masked, "masked="+p)
+	}
+	sort.Strings(masked)
+	opts = append(opts, masked...)
+	for _, t := range im.transforms {
+		opts = append(opts, "transform="+t.glob)
+	}
+	return opts
+}
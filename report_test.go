@@ -0,0 +1,58 @@
+package ocifs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMountReport(t *testing.T) {
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	img := pushRandomImage(t, ref, 512, 3)
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var layerBytes int64
+	for _, l := range layers {
+		n, err := l.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		layerBytes += n
+	}
+
+	workDir := t.TempDir()
+	for i, wantDownloaded := range []int64{layerBytes, 0} {
+		// a new instance does not share the cache of pulled references
+		ofs, err := New(WithWorkDir(workDir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		im, err := ofs.Mount(ref.String(), MountWithTargetPath(t.TempDir()), MountWithDirectIO(), MountWithReadahead(4096))
+		if errors.Is(err, ErrFUSEUnavailable) {
+			t.Skip(err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := im.Report()
+		im.Unmount()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if report.Layers != 3 {
+			t.Errorf("mount %d: %d layers, want 3", i, report.Layers)
+		}
+		if report.BytesDownloaded != wantDownloaded || report.BytesDownloaded+report.BytesCached != layerBytes {
+			t.Errorf("mount %d: downloaded %d and cached %d, want %d of %d downloaded", i, report.BytesDownloaded, report.BytesCached, wantDownloaded, layerBytes)
+		}
+		if report.Files == 0 {
+			t.Errorf("mount %d: no files reported", i)
+		}
+		if got := strings.Join(report.Options, " "); got != "helper="+string(im.FUSEHelper())+" readahead=4096 direct_io" {
+			t.Errorf("mount %d: options %q", i, got)
+		}
+	}
+}
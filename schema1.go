@@ -0,0 +1,242 @@
+package ocifs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// schema1Manifest is the part of a Docker schema 1 manifest needed to
+// convert it. Both lists run from the top layer down.
+type schema1Manifest struct {
+	FSLayers []struct {
+		BlobSum v1.Hash `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+// schema1Layer is a v1Compatibility entry. The entry of the top layer also
+// holds the config of the image.
+type schema1Layer struct {
+	v1.ConfigFile
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd"`
+	} `json:"container_config"`
+	Comment   string `json:"comment"`
+	Throwaway bool   `json:"throwaway"`
+}
+
+// schema1Image is an image served with a Docker schema 1 manifest, which has
+// no config blob, converted to a schema 2 image when it is first used. It is
+// admitted with the descriptor of the manifest as served and the config of
+// its top layer, so its layers are only fetched once it is admitted.
+type schema1Image struct {
+	served   v1.Image
+	desc     v1.Descriptor
+	manifest schema1Manifest
+	config   *v1.ConfigFile
+
+	once   sync.Once
+	img    v1.Image
+	err    error
+	spools []*os.File
+}
+
+var _ v1.Image = (*schema1Image)(nil)
+
+// newSchema1Image parses the manifest of img, served as described by desc.
+func newSchema1Image(img v1.Image, desc v1.Descriptor) (*schema1Image, error) {
+	i := &schema1Image{served: img, desc: desc}
+	raw, err := img.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &i.manifest); err != nil {
+		return nil, err
+	}
+	m := &i.manifest
+	if len(m.FSLayers) == 0 || len(m.FSLayers) != len(m.History) {
+		return nil, fmt.Errorf("schema 1 manifest has %d layers and %d history entries", len(m.FSLayers), len(m.History))
+	}
+
+	var top schema1Layer
+	if err := json.Unmarshal([]byte(m.History[0].V1Compatibility), &top); err != nil {
+		return nil, err
+	}
+	i.config = top.ConfigFile.DeepCopy()
+	i.config.RootFS = v1.RootFS{Type: "layers"}
+	i.config.History = nil
+	return i, nil
+}
+
+// converted returns the image as schema 2, converting it on the first call.
+func (i *schema1Image) converted() (v1.Image, error) {
+	i.once.Do(func() {
+		i.img, i.err = i.convert()
+	})
+	return i.img, i.err
+}
+
+// convert rebuilds the image as a schema 2 image. Layers marked throwaway are
+// left out, as docker does. Each layer is downloaded once to a spool file,
+// since the diff IDs of the new config need its uncompressed content.
+func (i *schema1Image) convert() (v1.Image, error) {
+	base, err := mutate.ConfigFile(empty.Image, i.config.DeepCopy())
+	if err != nil {
+		return nil, err
+	}
+
+	m := &i.manifest
+	var adds []mutate.Addendum
+	for j := len(m.FSLayers) - 1; j >= 0; j-- {
+		var l schema1Layer
+		if err := json.Unmarshal([]byte(m.History[j].V1Compatibility), &l); err != nil {
+			return nil, err
+		}
+		add := mutate.Addendum{History: v1.History{
+			Created:    l.Created,
+			CreatedBy:  strings.Join(l.ContainerConfig.Cmd, " "),
+			Comment:    l.Comment,
+			Author:     l.Author,
+			EmptyLayer: l.Throwaway,
+		}}
+		if !l.Throwaway {
+			if add.Layer, err = i.spoolLayer(m.FSLayers[j].BlobSum); err != nil {
+				return nil, err
+			}
+		}
+		adds = append(adds, add)
+	}
+	return mutate.Append(base, adds...)
+}
+
+// spoolLayer downloads the blob h to a spool file and returns it as a layer.
+func (i *schema1Image) spoolLayer(h v1.Hash) (v1.Layer, error) {
+	l, err := i.served.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := l.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	f, size, err := spool(rc)
+	if err != nil {
+		return nil, err
+	}
+	i.spools = append(i.spools, f)
+	return tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(io.NewSectionReader(f, 0, size)), nil
+	})
+}
+
+// Close frees the spool files of the layers.
+func (i *schema1Image) Close() error {
+	var errs []error
+	for _, f := range i.spools {
+		errs = append(errs, f.Close())
+	}
+	i.spools = nil
+	return errors.Join(errs...)
+}
+
+func (i *schema1Image) Layers() ([]v1.Layer, error) {
+	img, err := i.converted()
+	if err != nil {
+		return nil, err
+	}
+	return img.Layers()
+}
+
+func (i *schema1Image) MediaType() (types.MediaType, error) {
+	img, err := i.converted()
+	if err != nil {
+		return "", err
+	}
+	return img.MediaType()
+}
+
+func (i *schema1Image) Size() (int64, error) {
+	img, err := i.converted()
+	if err != nil {
+		return 0, err
+	}
+	return img.Size()
+}
+
+func (i *schema1Image) ConfigName() (v1.Hash, error) {
+	img, err := i.converted()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	return img.ConfigName()
+}
+
+func (i *schema1Image) ConfigFile() (*v1.ConfigFile, error) {
+	img, err := i.converted()
+	if err != nil {
+		return nil, err
+	}
+	return img.ConfigFile()
+}
+
+func (i *schema1Image) RawConfigFile() ([]byte, error) {
+	img, err := i.converted()
+	if err != nil {
+		return nil, err
+	}
+	return img.RawConfigFile()
+}
+
+func (i *schema1Image) Digest() (v1.Hash, error) {
+	img, err := i.converted()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	return img.Digest()
+}
+
+func (i *schema1Image) Manifest() (*v1.Manifest, error) {
+	img, err := i.converted()
+	if err != nil {
+		return nil, err
+	}
+	return img.Manifest()
+}
+
+func (i *schema1Image) RawManifest() ([]byte, error) {
+	img, err := i.converted()
+	if err != nil {
+		return nil, err
+	}
+	return img.RawManifest()
+}
+
+func (i *schema1Image) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	img, err := i.converted()
+	if err != nil {
+		return nil, err
+	}
+	return img.LayerByDigest(h)
+}
+
+func (i *schema1Image) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	img, err := i.converted()
+	if err != nil {
+		return nil, err
+	}
+	return img.LayerByDiffID(h)
+}
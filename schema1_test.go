@@ -0,0 +1,154 @@
+package ocifs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestPullSchema1(t *testing.T) {
+	var blobs atomic.Int32
+	host := testRegistry(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+			blobs.Add(1)
+		}
+		return false
+	})
+	repo, err := name.NewRepository(host + "/legacy/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sums []v1.Hash
+	for i := 0; i < 3; i++ {
+		l, err := random.Layer(128, types.DockerLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.WriteLayer(repo, l); err != nil {
+			t.Fatal(err)
+		}
+		h, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sums = append(sums, h)
+	}
+
+	// top layer first; the middle one is a throwaway layer of an ENV
+	manifest := map[string]any{
+		"schemaVersion": 1,
+		"name":          "legacy/app",
+		"tag":           "v1",
+		"architecture":  "amd64",
+		"fsLayers": []map[string]string{
+			{"blobSum": sums[2].String()},
+			{"blobSum": sums[1].String()},
+			{"blobSum": sums[0].String()},
+		},
+		"history": []map[string]string{
+			{"v1Compatibility": `{"id":"c","parent":"b","created":"2016-01-03T00:00:00Z","os":"linux","architecture":"amd64","config":{"Env":["PATH=/bin"],"Cmd":["sh"]},"container_config":{"Cmd":["/bin/sh","-c","echo top"]}}`},
+			{"v1Compatibility": `{"id":"b","parent":"a","created":"2016-01-02T00:00:00Z","throwaway":true,"container_config":{"Cmd":["/bin/sh","-c","#(nop) ENV PATH=/bin"]}}`},
+			{"v1Compatibility": `{"id":"a","created":"2016-01-01T00:00:00Z","container_config":{"Cmd":["/bin/sh","-c","#(nop) ADD file"]}}`},
+		},
+	}
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://%s/v2/legacy/app/manifests/v1", host), bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", string(types.DockerManifestSchema1))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("put manifest: %s", resp.Status)
+	}
+
+	ref := host + "/legacy/app:v1"
+
+	// the image is admitted as served, before any layer is fetched
+	var admitted v1.Descriptor
+	rejecting, err := New(WithWorkDir(t.TempDir()), WithAdmissionHook(func(ctx context.Context, desc v1.Descriptor, cfg *v1.ConfigFile) error {
+		admitted = desc
+		if len(cfg.Config.Env) != 1 {
+			t.Errorf("admitted config = %+v", cfg.Config)
+		}
+		return errors.New("rejected")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rejecting.Pull(ref); !errors.Is(err, ErrNotAdmitted) {
+		t.Fatalf("pull of rejected image: %v", err)
+	}
+	if admitted.MediaType != types.DockerManifestSchema1 && admitted.MediaType != types.DockerManifestSchema1Signed {
+		t.Errorf("admitted %+v, want the schema 1 manifest", admitted)
+	}
+	if n := blobs.Load(); n != 0 {
+		t.Errorf("%d blobs fetched for a rejected image", n)
+	}
+
+	workDir := t.TempDir()
+	ofs, err := New(WithWorkDir(workDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := ofs.Image(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.RootFS.DiffIDs) != 2 {
+		t.Errorf("got %d layers, want 2 without the throwaway one", len(cfg.RootFS.DiffIDs))
+	}
+	if len(cfg.History) != 3 || !cfg.History[1].EmptyLayer || cfg.History[2].CreatedBy != "/bin/sh -c echo top" {
+		t.Errorf("history = %+v", cfg.History)
+	}
+	if len(cfg.Config.Env) != 1 || cfg.Config.Env[0] != "PATH=/bin" || cfg.OS != "linux" {
+		t.Errorf("config = %+v", cfg.Config)
+	}
+	for _, h := range []v1.Hash{sums[0], sums[2]} {
+		if !ofs.hasBlob(h) {
+			t.Errorf("layer %s not in store", h)
+		}
+	}
+
+	// a later pull of the unchanged tag finds the converted image
+	blobs.Store(0)
+	again, err := New(WithWorkDir(workDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := again.Pull(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != img.Digest() {
+		t.Errorf("pulled again as %s, want %s", h, img.Digest())
+	}
+	if n := blobs.Load(); n != 0 {
+		t.Errorf("%d blobs fetched again for an unchanged tag", n)
+	}
+}
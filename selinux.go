@@ -0,0 +1,51 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+const selinuxXattr = "security.selinux"
+
+// selinuxLabel returns the SELinux context of a file: the fixed context of
+// the mount if one was given, else the one recorded in its layer, if any.
+func (ofs *ociFS) selinuxLabel(hdr *tar.Header) string {
+	if ofs.selinuxContext != "" {
+		return ofs.selinuxContext
+	}
+	if hdr == nil {
+		return ""
+	}
+	return hdr.PAXRecords["SCHILY.xattr."+selinuxXattr]
+}
+
+// getxattrLabel serves a getxattr request for a node labeled label.
+func getxattrLabel(label, attr string, dest []byte) (uint32, syscall.Errno) {
+	if attr != selinuxXattr || label == "" {
+		return 0, syscall.ENODATA
+	}
+	if len(dest) == 0 {
+		return uint32(len(label)), fs.OK
+	}
+	if len(dest) < len(label) {
+		return 0, syscall.ERANGE
+	}
+	return uint32(copy(dest, label)), fs.OK
+}
+
+// listxattrLabel serves a listxattr request for a node labeled label.
+func listxattrLabel(label string, dest []byte) (uint32, syscall.Errno) {
+	if label == "" {
+		return 0, fs.OK
+	}
+	list := selinuxXattr + "\x00"
+	if len(dest) == 0 {
+		return uint32(len(list)), fs.OK
+	}
+	if len(dest) < len(list) {
+		return 0, syscall.ERANGE
+	}
+	return uint32(copy(dest, list)), fs.OK
+}
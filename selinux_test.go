@@ -0,0 +1,70 @@
+package ocifs
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+func TestGetxattrLabel(t *testing.T) {
+	const label = "system_u:object_r:container_file_t:s0"
+	tests := []struct {
+		name    string
+		label   string
+		attr    string
+		destLen int
+		wantN   uint32
+		want    syscall.Errno
+	}{
+		{"size probe", label, selinuxXattr, 0, uint32(len(label)), fs.OK},
+		{"fits", label, selinuxXattr, 64, uint32(len(label)), fs.OK},
+		{"fits exactly", label, selinuxXattr, len(label), uint32(len(label)), fs.OK},
+		{"too small", label, selinuxXattr, len(label) - 1, 0, syscall.ERANGE},
+		{"other attribute", label, "user.comment", 64, 0, syscall.ENODATA},
+		{"unlabeled", "", selinuxXattr, 64, 0, syscall.ENODATA},
+		{"unlabeled size probe", "", selinuxXattr, 0, 0, syscall.ENODATA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := make([]byte, tt.destLen)
+			n, errno := getxattrLabel(tt.label, tt.attr, dest)
+			if n != tt.wantN || errno != tt.want {
+				t.Fatalf("got %d, %v, want %d, %v", n, errno, tt.wantN, tt.want)
+			}
+			if errno == fs.OK && tt.destLen > 0 && string(dest[:n]) != tt.label {
+				t.Errorf("value %q, want %q", dest[:n], tt.label)
+			}
+		})
+	}
+}
+
+func TestListxattrLabel(t *testing.T) {
+	const list = selinuxXattr + "\x00"
+	tests := []struct {
+		name    string
+		label   string
+		destLen int
+		wantN   uint32
+		want    syscall.Errno
+	}{
+		{"size probe", "label", 0, uint32(len(list)), fs.OK},
+		{"fits", "label", 64, uint32(len(list)), fs.OK},
+		{"fits exactly", "label", len(list), uint32(len(list)), fs.OK},
+		{"too small", "label", len(list) - 1, 0, syscall.ERANGE},
+		{"unlabeled", "", 64, 0, fs.OK},
+		{"unlabeled size probe", "", 0, 0, fs.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := make([]byte, tt.destLen)
+			n, errno := listxattrLabel(tt.label, dest)
+			if n != tt.wantN || errno != tt.want {
+				t.Fatalf("got %d, %v, want %d, %v", n, errno, tt.wantN, tt.want)
+			}
+			if errno == fs.OK && tt.destLen > 0 && string(dest[:n]) != list[:n] {
+				t.Errorf("list %q, want %q", dest[:n], list)
+			}
+		})
+	}
+}
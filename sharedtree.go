@@ -0,0 +1,73 @@
+package ocifs
+
+import (
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// sharedTree is a unified tree shared by all mounts of the same image that
+// do not change its content, such as with lower dirs or normalization.
+type sharedTree struct {
+	ut     *unifiedTree
+	layers map[string]v1.Hash
+	refs   int
+}
+
+// buildTree unifies the unpacked layers of the image h. It also returns the
+// digest of each layer keyed by its unpacked path.
+func (o *OCIFS) buildTree(h v1.Hash, normalize func(string) string) (*unifiedTree, map[string]v1.Hash, error) {
+	layers, err := o.getUnpackedLayers(&h)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ut := newUnifiedTree()
+	ut.normalize = normalize
+	digests := make(map[string]v1.Hash, len(layers))
+	for _, l := range layers {
+		ut.AddUnpackedLayer(l.Path(), l.Files())
+		digests[l.Path()] = l.Hash()
+	}
+
+	return ut, digests, nil
+}
+
+// acquireTree returns the shared tree for h, building it on first use.
+// Every call must be matched by a call to releaseTree.
+func (o *OCIFS) acquireTree(h v1.Hash) (*unifiedTree, map[string]v1.Hash, error) {
+	unlock := o.layerLocks.Lock("tree:" + h.String())
+	defer unlock()
+
+	o.mu.Lock()
+	st, ok := o.trees[h]
+	if ok {
+		st.refs++
+		o.mu.Unlock()
+		return st.ut, st.layers, nil
+	}
+	o.mu.Unlock()
+
+	ut, digests, err := o.buildTree(h, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	o.mu.Lock()
+	o.trees[h] = &sharedTree{ut: ut, layers: digests, refs: 1}
+	o.mu.Unlock()
+
+	return ut, digests, nil
+}
+
+func (o *OCIFS) releaseTree(h v1.Hash) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	st, ok := o.trees[h]
+	if !ok {
+		return
+	}
+	st.refs--
+	if st.refs == 0 {
+		delete(o.trees, h)
+	}
+}
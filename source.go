@@ -0,0 +1,273 @@
+package ocifs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// A Source resolves the image references of one scheme to images. The store
+// copies the manifest, config and layers of the returned image, so they are
+// read only once per digest.
+type Source interface {
+	Resolve(ctx context.Context, ref string) (v1.Image, error)
+}
+
+// SourceFunc adapts a function to a Source.
+type SourceFunc func(ctx context.Context, ref string) (v1.Image, error)
+
+func (f SourceFunc) Resolve(ctx context.Context, ref string) (v1.Image, error) {
+	return f(ctx, ref)
+}
+
+// Schemes of the built in sources. References without a scheme are pulled
+// from a registry.
+const (
+	SchemeRegistry      = "registry"
+	SchemeOCI           = "oci"
+	SchemeDockerArchive = "docker-archive"
+	// SchemeContainersStorage reads images pulled or built by podman and
+	// buildah, see WithContainersStorage.
+	SchemeContainersStorage = "containers-storage"
+	// SchemeDockerDaemon exports images from a docker daemon, see
+	// WithDockerHost.
+	SchemeDockerDaemon = "docker-daemon"
+)
+
+// WithSource resolves references written as scheme:ref with src, which is
+// given ref without the prefix. It replaces a built in source of the same
+// scheme.
+var WithSource = func(scheme string, src Source) Option {
+	return func(o *OCIFS) {
+		o.sources[scheme] = src
+	}
+}
+
+func (s *OCIFS) defaultSources() map[string]Source {
+	return map[string]Source{
+		SchemeRegistry:          SourceFunc(s.resolveRegistry),
+		SchemeOCI:               SourceFunc(s.resolveLayout),
+		SchemeDockerArchive:     SourceFunc(resolveArchive),
+		SchemeContainersStorage: &containersStorage{root: DefaultContainersStorage},
+		SchemeDockerDaemon:      &dockerDaemon{},
+	}
+}
+
+// source returns the source for imageRef and the reference to pass to it.
+// A bare digest names an image already in the store. References without a
+// known scheme go to the registry, as does a scheme followed by a port
+// number, as in registry:5000/img.
+func (s *OCIFS) source(imageRef string) (Source, string) {
+	if isDigest(imageRef) {
+		return SourceFunc(s.resolveStored), imageRef
+	}
+	scheme, ref, ok := strings.Cut(imageRef, ":")
+	if src, known := s.sources[scheme]; ok && known && !isPort(ref) {
+		return src, ref
+	}
+	return s.sources[SchemeRegistry], imageRef
+}
+
+// isPort reports whether ref starts with a port number followed by a path.
+func isPort(ref string) bool {
+	port, _, ok := strings.Cut(ref, "/")
+	if !ok || port == "" {
+		return false
+	}
+	for _, c := range port {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isDigest reports whether ref is a bare digest such as sha256:abc...
+func isDigest(ref string) bool {
+	_, err := v1.NewHash(ref)
+	return err == nil
+}
+
+// resolveStored returns the image with digest ref from the store, such as
+// one added by ImportArchive.
+func (s *OCIFS) resolveStored(ctx context.Context, ref string) (v1.Image, error) {
+	h, err := v1.NewHash(ref)
+	if err != nil {
+		return nil, err
+	}
+	img, err := s.lp.Image(h)
+	if err != nil {
+		return nil, fmt.Errorf("image %s is not in the store: %w", ref, err)
+	}
+	return img, nil
+}
+
+func (s *OCIFS) resolveRegistry(ctx context.Context, ref string) (v1.Image, error) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	opts := append(s.remoteOptions(), remote.WithContext(ctx))
+	if img := s.storedImage(r, opts); img != nil {
+		return img, nil
+	}
+	desc, err := remote.Get(r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if desc.MediaType.IsIndex() {
+		// kept so the next pull of the tag can pick the image without it
+		if err := s.lp.WriteBlob(desc.Digest, io.NopCloser(bytes.NewReader(desc.Manifest))); err != nil {
+			slog.Debug("store index manifest", "digest", desc.Digest, "error", err)
+		}
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		return s.selectImage(idx)
+	}
+	if desc.MediaType == types.DockerManifestSchema1 || desc.MediaType == types.DockerManifestSchema1Signed {
+		img, err := desc.Schema1()
+		if err != nil {
+			return nil, err
+		}
+		return newSchema1Image(img, desc.Descriptor)
+	}
+	return desc.Image()
+}
+
+// storedImage returns the image r points to when it is already in the
+// store, or nil when it has to be fetched. A tag costs a HEAD request for
+// its current digest, which is compared against the stored images, the index
+// manifests of earlier pulls and the schema 1 manifests of converted images,
+// and a digest costs nothing.
+func (s *OCIFS) storedImage(r name.Reference, opts []remote.Option) v1.Image {
+	var h v1.Hash
+	if d, ok := r.(name.Digest); ok {
+		var err error
+		if h, err = v1.NewHash(d.DigestStr()); err != nil {
+			return nil
+		}
+	} else {
+		desc, err := remote.Head(r, opts...)
+		if err != nil {
+			slog.Debug("head manifest", "image", r, "error", err)
+			return nil
+		}
+		h = desc.Digest
+	}
+
+	if img, err := s.lp.Image(h); err == nil {
+		if s.missingForeign(img) {
+			return nil
+		}
+		slog.Debug("manifest unchanged", "image", r, "digest", h)
+		return img
+	}
+	if img := s.convertedImage(h); img != nil {
+		slog.Debug("schema 1 manifest unchanged", "image", r, "digest", h)
+		return img
+	}
+	rc, err := s.lp.Blob(h)
+	if err != nil {
+		return nil
+	}
+	defer rc.Close()
+	// image manifests parse as indexes without manifests, which nothing
+	// is selected from
+	im, err := v1.ParseIndexManifest(rc)
+	if err != nil {
+		return nil
+	}
+	desc, err := s.selectManifest(im)
+	if err != nil {
+		return nil
+	}
+	img, err := s.lp.Image(desc.Digest)
+	if err != nil || s.missingForeign(img) {
+		return nil
+	}
+	slog.Debug("index unchanged", "image", r, "digest", h, "manifest", desc.Digest)
+	return img
+}
+
+// resolveLayout opens path[:tag] or path@digest in an OCI image layout. The
+// tag matches the org.opencontainers.image.ref.name annotation; without one
+// the layout must hold a single image. An index is resolved as
+// selectImage does.
+func (s *OCIFS) resolveLayout(ctx context.Context, ref string) (v1.Image, error) {
+	dir, tag, digest := splitPathRef(ref)
+	lp, err := layout.FromPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := lp.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []v1.Descriptor
+	for _, desc := range im.Manifests {
+		switch {
+		case digest != "" && desc.Digest.String() == digest,
+			tag != "" && desc.Annotations[annotationRefName] == tag,
+			digest == "" && tag == "":
+			matches = append(matches, desc)
+		}
+	}
+	if len(matches) != 1 {
+		return nil, fmt.Errorf("layout %s has %d images matching %q", dir, len(matches), ref)
+	}
+
+	desc := matches[0]
+	if desc.MediaType.IsIndex() {
+		child, err := idx.ImageIndex(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		return s.selectImage(child)
+	}
+	return idx.Image(desc.Digest)
+}
+
+// resolveArchive opens path[:tag] in a tarball written by docker save. The
+// tag, a full image reference, is needed when the archive holds more than
+// one image, so the path cannot contain colons.
+func resolveArchive(ctx context.Context, ref string) (v1.Image, error) {
+	path, tag, ok := strings.Cut(ref, ":")
+	if !ok {
+		return tarball.ImageFromPath(path, nil)
+	}
+	t, err := name.NewTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	return tarball.ImageFromPath(path, &t)
+}
+
+// splitPathRef splits path:tag and path@digest. A colon is only a tag
+// separator after the last slash, so directory names may contain colons.
+func splitPathRef(ref string) (path, tag, digest string) {
+	if p, d, ok := strings.Cut(ref, "@"); ok {
+		return p, "", d
+	}
+	i := strings.LastIndex(ref, ":")
+	if i < 0 || i < strings.LastIndex(ref, "/") {
+		return ref, "", ""
+	}
+	return ref[:i], ref[i+1:], ""
+}
@@ -0,0 +1,159 @@
+package ocifs
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestSourceScheme(t *testing.T) {
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		imageRef string
+		scheme   string
+		ref      string
+	}{
+		{"busybox:latest", SchemeRegistry, "busybox:latest"},
+		{"localhost:5000/img", SchemeRegistry, "localhost:5000/img"},
+		{"registry:5000/img:v1", SchemeRegistry, "registry:5000/img:v1"},
+		{"registry:ghcr.io/org/img", SchemeRegistry, "ghcr.io/org/img"},
+		{"oci:/srv/layout:v1", SchemeOCI, "/srv/layout:v1"},
+		{"docker-archive:img.tar", SchemeDockerArchive, "img.tar"},
+	}
+	for _, tt := range tests {
+		src, ref := ofs.source(tt.imageRef)
+		if src == nil || ref != tt.ref {
+			t.Errorf("source(%q) = %v, %q, want %s, %q", tt.imageRef, src, ref, tt.scheme, tt.ref)
+		}
+	}
+}
+
+func TestSourceLocal(t *testing.T) {
+	img, err := random.Image(256, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	lp, err := layout.Write(filepath.Join(dir, "layout"), empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lp.AppendImage(img, layout.WithAnnotations(map[string]string{annotationRefName: "v1"})); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := name.NewTag("example.com/img:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "img.tar")
+	if err := tarball.WriteToFile(archive, tag, img); err != nil {
+		t.Fatal(err)
+	}
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{
+		"oci:" + filepath.Join(dir, "layout"),
+		"oci:" + filepath.Join(dir, "layout") + ":v1",
+		"oci:" + filepath.Join(dir, "layout") + "@" + want.String(),
+		"docker-archive:" + archive,
+		"docker-archive:" + archive + ":example.com/img:v1",
+	} {
+		got, err := ofs.Image(ref)
+		if err != nil {
+			t.Errorf("Image(%q): %v", ref, err)
+			continue
+		}
+		if got.Digest() != want {
+			t.Errorf("Image(%q) digest = %s, want %s", ref, got.Digest(), want)
+		}
+	}
+
+	if _, err := ofs.Image("oci:" + filepath.Join(dir, "layout") + ":v2"); err == nil {
+		t.Error("Image with a missing tag succeeded")
+	}
+}
+
+func TestRegistryRevalidation(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	host := testRegistry(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			mu.Lock()
+			requests[r.Method]++
+			mu.Unlock()
+		}
+		return false
+	})
+
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add:        img,
+		Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "riscv64"}},
+	})
+	for _, tt := range []struct {
+		tag string
+		put func(name.Reference) error
+	}{
+		{"image", func(r name.Reference) error { return remote.Write(r, img) }},
+		{"index", func(r name.Reference) error { return remote.WriteIndex(r, idx) }},
+	} {
+		t.Run(tt.tag, func(t *testing.T) {
+			ref, err := name.ParseReference(host + "/app:" + tt.tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.put(ref); err != nil {
+				t.Fatal(err)
+			}
+
+			workDir := t.TempDir()
+			pull := func() {
+				t.Helper()
+				ofs, err := New(WithWorkDir(workDir), WithPlatform(v1.Platform{OS: "linux", Architecture: "riscv64"}))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := ofs.Pull(ref.String()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			pull()
+			mu.Lock()
+			clear(requests)
+			mu.Unlock()
+
+			pull()
+			mu.Lock()
+			defer mu.Unlock()
+			if requests[http.MethodGet] != 0 || requests[http.MethodHead] != 1 {
+				t.Errorf("second pull made %v manifest requests, want a single HEAD", requests)
+			}
+		})
+	}
+}
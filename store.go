@@ -2,16 +2,24 @@ package ocifs
 
 import (
 	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 )
 
@@ -41,7 +49,7 @@ func (s *OCIFS) getUnpackedLayers(h *v1.Hash) ([]*unpackedLayer, error) {
 	}
 
 	// get layers
-	layers, err := img.Layers()
+	layers, err := s.fsLayers(img)
 	if err != nil {
 		slog.Error("get image layers", "error", err)
 		return nil, err
@@ -57,11 +65,14 @@ func (s *OCIFS) getUnpackedLayers(h *v1.Hash) ([]*unpackedLayer, error) {
 		}
 		slog.Debug("layer digest", "digest", lh)
 
-		targetDir := filepath.Join(string(s.lp), "unpacked", h.Algorithm, lh.Hex)
-		idxName := targetDir + ".json"
+		targetDir := s.layerDir(lh, layer)
+		idxName := layerIndex(targetDir)
 
 		data, err := os.ReadFile(idxName)
 		if err != nil {
+			if mt, _ := layer.MediaType(); isForeign(mt) && os.IsNotExist(err) {
+				return nil, fmt.Errorf("%w %s: ignored when the image was pulled", ErrForeignLayer, lh)
+			}
 			return nil, err
 		}
 
@@ -80,24 +91,126 @@ func (s *OCIFS) getUnpackedLayers(h *v1.Hash) ([]*unpackedLayer, error) {
 	return idx, nil
 }
 
-func (s *OCIFS) pullImage(imageRef string) (*v1.Hash, error) {
+// Pull fetches imgRef and unpacks its layers into the work dir, so that
+// later mounts of it do not need to touch the registry.
+func (s *OCIFS) Pull(imgRef string) (v1.Hash, error) {
+	h, err := s.pullImage(context.Background(), imgRef, nil)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	return *h, nil
+}
+
+// pullCall is a pull in progress, shared by all callers of pullImage for
+// the same reference.
+type pullCall struct {
+	done     chan struct{}
+	h        *v1.Hash
+	stats    pullStats
+	progress pullProgress
+	err      error
+}
+
+// pullImage returns the digest of imageRef, storing it first if it is not
+// cached. Concurrent calls for the same reference share a single pull, run
+// on its own so that callers can stop waiting for it when their ctx is done.
+// The stats of the pull are recorded in stats, when not nil, for the caller
+// that started it.
+func (s *OCIFS) pullImage(ctx context.Context, imageRef string, stats *pullStats) (*v1.Hash, error) {
 	// look in cache first
-	if ce, ok := s.cache[imageRef]; ok && ce.exp.After(time.Now()) {
+	s.mu.Lock()
+	ce, ok := s.cache[imageRef]
+	if ok && ce.exp.After(time.Now()) {
+		s.mu.Unlock()
 		slog.Debug("cache hit", "image", imageRef, "hash", ce.hash)
 		return ce.hash, nil
 	}
+	call, joined := s.startPull(ctx, imageRef)
+	s.mu.Unlock()
 
-	ref, err := name.ParseReference(imageRef)
-	if err != nil {
-		slog.Error("parse reference", "error", err)
-		return nil, err
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	if stats != nil && !joined {
+		*stats = call.stats
 	}
+	return call.h, nil
+}
 
-	rmtImg, err := remote.Image(ref, remote.WithAuthFromKeychain(s.authn))
+// startPull returns the pull of imageRef in progress, reporting whether it
+// was joined, or starts one. It must be called with s.mu held.
+func (s *OCIFS) startPull(ctx context.Context, imageRef string) (*pullCall, bool) {
+	if call, ok := s.pulls[imageRef]; ok {
+		return call, true
+	}
+	call := &pullCall{done: make(chan struct{})}
+	call.progress.state = PullQueued
+	call.progress.queued = time.Now()
+	s.pulls[imageRef] = call
+	go s.pull(context.WithoutCancel(ctx), imageRef, call)
+	return call, false
+}
+
+// pull runs call, caching its result.
+func (s *OCIFS) pull(ctx context.Context, imageRef string, call *pullCall) {
+	defer close(call.done)
+	if s.pullSlots != nil {
+		s.pullSlots <- struct{}{}
+		defer func() { <-s.pullSlots }()
+	}
+	call.progress.start()
+	call.h, call.err = s.resolveAndStore(ctx, imageRef, &call.stats, &call.progress)
+	call.progress.finish(call.err)
+
+	s.mu.Lock()
+	delete(s.pulls, imageRef)
+	if call.err == nil {
+		s.cache[imageRef] = &cacheEntry{
+			hash: call.h,
+			exp:  time.Now().Add(s.exp),
+		}
+	}
+	s.mu.Unlock()
+
+	if call.err == nil {
+		s.emit(Event{Type: EventPullCompleted, ImageRef: imageRef, Digest: *call.h})
+	}
+}
+
+func (s *OCIFS) resolveAndStore(ctx context.Context, imageRef string, stats *pullStats, progress *pullProgress) (*v1.Hash, error) {
+	s.emit(Event{Type: EventPullStarted, ImageRef: imageRef})
+
+	src, ref := s.source(imageRef)
+	rmtImg, err := src.Resolve(ctx, ref)
 	if err != nil {
-		slog.Error("get remote image", "error", err)
+		slog.Error("resolve image", "error", err)
 		return nil, err
 	}
+	if c, ok := rmtImg.(io.Closer); ok {
+		defer c.Close()
+	}
+	if s.containerdRoot != "" {
+		rmtImg = &contentStoreImage{Image: rmtImg, blobs: containerdBlobs(s.containerdRoot)}
+	}
+
+	return s.storeImage(imageRef, imageRef, rmtImg, stats, progress)
+}
+
+// storeImage admits img, copies it into the layout and unpacks its layers,
+// recording what it did in stats and how far it got in progress when not
+// nil. The image is named label in errors, and recorded under ref unless
+// that is empty or a digest.
+func (s *OCIFS) storeImage(label, ref string, rmtImg v1.Image, stats *pullStats, progress *pullProgress) (*v1.Hash, error) {
+	if s.admissionHook != nil || len(s.labelPolicies) > 0 {
+		if err := s.admit(label, rmtImg); err != nil {
+			return nil, err
+		}
+	}
 
 	dgst, err := rmtImg.Digest()
 	if err != nil {
@@ -107,81 +220,421 @@ func (s *OCIFS) pullImage(imageRef string) (*v1.Hash, error) {
 
 	h := &v1.Hash{}
 	*h = dgst
+	progress.resolved(dgst)
 
-	img, err := s.lp.Image(*h)
-	if err != nil {
-
-		if err := s.lp.AppendImage(rmtImg); err != nil {
-			slog.Error("append image", "error", err)
+	if !s.windowsLayers {
+		windows, err := isWindowsImage(rmtImg)
+		if err != nil {
+			slog.Error("get image config", "error", err)
 			return nil, err
 		}
+		if windows {
+			return nil, fmt.Errorf("image %s: %w", label, ErrWindowsImage)
+		}
+	}
 
-		slog.Debug("getting local image", "hash", h)
-		img, err = s.lp.Image(*h)
+	// digests are not worth recording as references
+	if isDigest(ref) {
+		ref = ""
+	}
+	withForeign := &foreignLayers{Image: rmtImg, ignore: s.ignoreForeign}
+	if stats != nil || progress != nil {
+		missing, err := s.missingBytes(withForeign)
 		if err != nil {
-			slog.Error("get local image", "error", err)
+			return nil, err
+		}
+		if stats != nil {
+			stats.downloaded = missing
+		}
+		progress.downloading(missing)
+	}
+	if err := s.writeLayers(withForeign, progress); err != nil {
+		slog.Error("write layers", "error", err)
+		return nil, err
+	}
+	if err := s.appendImage(*h, &storedLayers{Image: withForeign, lp: s.lp}, ref); err != nil {
+		slog.Error("append image", "error", err)
+		return nil, err
+	}
+	if s1, ok := rmtImg.(*schema1Image); ok {
+		if err := s.recordSchema1(*h, s1.desc.Digest); err != nil {
 			return nil, err
 		}
 	}
+	if err := s.fetchForeign(withForeign, progress); err != nil {
+		return nil, err
+	}
 
-	layers, err := img.Layers()
+	slog.Debug("getting local image", "hash", h)
+	img, err := s.lp.Image(*h)
+	if err != nil {
+		slog.Error("get local image", "error", err)
+		return nil, err
+	}
+
+	layers, err := s.fsLayers(img)
 	if err != nil {
 		slog.Error("get image layers", "error", err)
 		return nil, err
 	}
 
+	start := time.Now()
+	progress.unpacking(len(layers))
 	for _, layer := range layers {
 		if err := s.unpackLayer(layer); err != nil {
 			slog.Error("unpack layer", "error", err)
 			return nil, err
 		}
+		progress.layerUnpacked()
 	}
-
-	// add to cache
-	s.cache[imageRef] = &cacheEntry{
-		hash: h,
-		exp:  time.Now().Add(s.exp),
+	if stats != nil {
+		stats.unpackTime = time.Since(start)
 	}
 
 	return h, nil
 }
 
-func (s *OCIFS) unpackLayer(layer v1.Layer) error {
-	h, err := layer.Digest()
+// remoteOptions returns the options for all registry requests.
+func (s *OCIFS) remoteOptions() []remote.Option {
+	opts := []remote.Option{
+		remote.WithAuthFromKeychain(s.authn),
+		remote.WithTransport(s.transport),
+	}
+	if s.userAgent != "" {
+		opts = append(opts, remote.WithUserAgent(s.userAgent))
+	}
+	return opts
+}
+
+// admit checks the label policies and runs the admission hook for the
+// resolved image, before any of its layers are fetched or unpacked.
+func (s *OCIFS) admit(imageRef string, img v1.Image) error {
+	desc, cfg, err := admissionView(img)
 	if err != nil {
-		slog.Error("get layer digest", "error", err)
+		slog.Error("get image config", "error", err)
 		return err
 	}
 
-	targetDir := filepath.Join(string(s.lp), "unpacked", h.Algorithm, h.Hex)
+	if err := checkLabels(s.labelPolicies, cfg); err != nil {
+		return fmt.Errorf("image %s %w: %w", imageRef, ErrNotAdmitted, err)
+	}
+	if s.admissionHook == nil {
+		return nil
+	}
+	if err := s.admissionHook(context.Background(), desc, cfg); err != nil {
+		return fmt.Errorf("image %s %w: %w", imageRef, ErrNotAdmitted, err)
+	}
+	return nil
+}
 
-	if _, err := os.Stat(targetDir); err == nil {
-		// if index file exists, we assume the layer has already been unpacked
-		if _, err := os.Stat(targetDir + ".json"); err == nil {
+// admissionView returns the descriptor and config img is admitted with.
+// Converted schema 1 images are admitted as served, since converting them
+// fetches their layers.
+func admissionView(img v1.Image) (v1.Descriptor, *v1.ConfigFile, error) {
+	if s1, ok := img.(*schema1Image); ok {
+		return s1.desc, s1.config.DeepCopy(), nil
+	}
+	desc := v1.Descriptor{}
+	var err error
+	if desc.Digest, err = img.Digest(); err != nil {
+		return desc, nil, err
+	}
+	if desc.MediaType, err = img.MediaType(); err != nil {
+		return desc, nil, err
+	}
+	if desc.Size, err = img.Size(); err != nil {
+		return desc, nil, err
+	}
+	cfg, err := img.ConfigFile()
+	return desc, cfg, err
+}
+
+// annotationRefName records on the index descriptors which reference an image
+// was pulled as.
+const annotationRefName = "org.opencontainers.image.ref.name"
+
+// annotationSchema1 records on the index descriptors of images converted from
+// a Docker schema 1 manifest the digest of that manifest, which is what the
+// registry reports for their tags.
+const annotationSchema1 = "io.github.greatliontech.ocifs.schema1.digest"
+
+// recordSchema1 records that the stored image h was converted from the
+// schema 1 manifest with digest served.
+func (s *OCIFS) recordSchema1(h, served v1.Hash) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	im, err := s.indexManifest()
+	if err != nil {
+		return err
+	}
+	var found *v1.Descriptor
+	for i, desc := range im.Manifests {
+		if desc.Digest != h {
+			continue
+		}
+		if desc.Annotations[annotationSchema1] == served.String() {
 			return nil
 		}
-	} else if os.IsNotExist(err) {
-		if err := os.MkdirAll(targetDir, 0755); err != nil {
-			slog.Error("create target dir", "error", err)
+		found = &im.Manifests[i]
+	}
+	if found == nil {
+		return fmt.Errorf("image %s is not in the store", h)
+	}
+	return s.lp.AppendDescriptor(v1.Descriptor{
+		MediaType:   found.MediaType,
+		Size:        found.Size,
+		Digest:      h,
+		Annotations: map[string]string{annotationSchema1: served.String()},
+	})
+}
+
+// convertedImage returns the stored image converted from the schema 1
+// manifest with digest served, or nil if there is none.
+func (s *OCIFS) convertedImage(served v1.Hash) v1.Image {
+	im, err := s.indexManifest()
+	if err != nil {
+		return nil
+	}
+	for _, desc := range im.Manifests {
+		if desc.Annotations[annotationSchema1] != served.String() {
+			continue
+		}
+		img, err := s.lp.Image(desc.Digest)
+		if err != nil || s.missingForeign(img) {
+			return nil
+		}
+		return img
+	}
+	return nil
+}
+
+// appendImage adds img to the layout unless a concurrent pull already did,
+// recording ref on its descriptor. An image already in the layout under
+// other references gets another descriptor for ref.
+func (s *OCIFS) appendImage(h v1.Hash, img v1.Image, ref string) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	im, err := s.indexManifest()
+	if err != nil {
+		return err
+	}
+	var found *v1.Descriptor
+	for i, desc := range im.Manifests {
+		if desc.Digest != h {
+			continue
+		}
+		if ref == "" || desc.Annotations[annotationRefName] == ref {
+			return nil
+		}
+		found = &im.Manifests[i]
+	}
+
+	var opts []layout.Option
+	if ref != "" {
+		opts = append(opts, layout.WithAnnotations(map[string]string{annotationRefName: ref}))
+	}
+	if found == nil {
+		return s.lp.AppendImage(img, opts...)
+	}
+	desc := v1.Descriptor{
+		MediaType:   found.MediaType,
+		Size:        found.Size,
+		Digest:      h,
+		Annotations: map[string]string{annotationRefName: ref},
+	}
+	return s.lp.AppendDescriptor(desc)
+}
+
+// layerConcurrency is how many layers of an image writeLayers downloads at
+// once.
+const layerConcurrency = 4
+
+// writeLayers copies the layers of img missing from the store into it, one
+// pull at a time for each layer, so that concurrent pulls of images sharing
+// layers download each of them once. Foreign layers are left to appendImage.
+// The bytes downloaded are counted in progress, when not nil.
+func (s *OCIFS) writeLayers(img v1.Image, progress *pullProgress) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	errs := make([]error, len(layers))
+	sem := make(chan struct{}, layerConcurrency)
+	var wg sync.WaitGroup
+	for i, l := range layers {
+		if _, ok := l.(*foreignLayer); ok {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, l v1.Layer) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = s.writeLayer(l, progress)
+		}(i, l)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (s *OCIFS) writeLayer(l v1.Layer, progress *pullProgress) error {
+	h, err := l.Digest()
+	if err != nil {
+		return err
+	}
+	size, err := l.Size()
+	if err != nil {
+		return err
+	}
+
+	unlock := s.layerLocks.Lock("blob:" + h.String())
+	defer unlock()
+
+	blob := filepath.Join(string(s.lp), "blobs", h.Algorithm, h.Hex)
+	if fi, err := os.Stat(blob); err == nil {
+		if fi.Size() == size {
+			return nil
+		}
+		// left from an interrupted download
+		if err := os.Remove(blob); err != nil {
 			return err
 		}
-	} else {
+	}
+	rc, err := l.Compressed()
+	if err != nil {
 		return err
 	}
+	return s.lp.WriteBlob(h, progress.counting(rc))
+}
+
+// storedLayers serves the layers of an image from the store once writeLayers
+// copied them there, since appending the image to the layout would request
+// them from the source again only to find they are stored.
+type storedLayers struct {
+	v1.Image
+	lp layout.Path
+}
 
-	rc, err := layer.Uncompressed()
+func (i *storedLayers) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]v1.Layer, len(layers))
+	for j, l := range layers {
+		out[j] = l
+		if _, ok := l.(*foreignLayer); !ok {
+			out[j] = &storedLayer{Layer: l, lp: i.lp}
+		}
+	}
+	return out, nil
+}
+
+type storedLayer struct {
+	v1.Layer
+	lp layout.Path
+}
+
+func (l *storedLayer) Compressed() (io.ReadCloser, error) {
+	h, err := l.Digest()
+	if err != nil {
+		return nil, err
+	}
+	return l.lp.Blob(h)
+}
+
+// indexManifest reads the layout's index.json.
+func (s *OCIFS) indexManifest() (*v1.IndexManifest, error) {
+	idx, err := s.lp.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	return idx.IndexManifest()
+}
+
+// Refs returns the image references pulled into the store, sorted. A tag
+// that was pulled again after it moved is listed once.
+func (s *OCIFS) Refs() ([]string, error) {
+	s.indexMu.Lock()
+	im, err := s.indexManifest()
+	s.indexMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	refs := []string{}
+	for _, desc := range im.Manifests {
+		ref := desc.Annotations[annotationRefName]
+		if ref == "" || seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	return refs, nil
+}
+
+// layerDir returns where the layer with digest h is unpacked. Raw layers are
+// also keyed by the name they are served under, since manifests can title
+// the same blob differently.
+func (s *OCIFS) layerDir(h v1.Hash, layer fsLayer) string {
+	dir := filepath.Join(s.unpackDir, h.Algorithm, h.Hex)
+	if layer.format.raw {
+		dir += "-" + layer.fileName()
+	}
+	return dir
+}
+
+func (s *OCIFS) unpackLayer(layer fsLayer) error {
+	h, err := layer.Digest()
+	if err != nil {
+		slog.Error("get layer digest", "error", err)
+		return err
+	}
+
+	targetDir := s.layerDir(h, layer)
+
+	// images sharing a layer may be pulled concurrently
+	unlock := s.layerLocks.Lock(h.String())
+	defer unlock()
+
+	// if index file exists, we assume the layer has already been unpacked
+	if _, err := os.Stat(layerIndex(targetDir)); err == nil {
+		return nil
+	}
+	// anything else there is left from an interrupted unpack, or in the
+	// mirrored layout of older versions
+	if err := os.RemoveAll(targetDir); err != nil {
+		return err
+	}
+	os.Remove(targetDir + ".json")
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		slog.Error("create target dir", "error", err)
+		return err
+	}
+
+	rc, err := layer.content()
 	if err != nil {
 		return err
 	}
 	defer rc.Close()
 
-	idx, err := extractTar(rc, targetDir)
+	var idx []*tar.Header
+	if layer.format.raw {
+		idx, err = extractRaw(rc, targetDir, layer.fileName())
+	} else {
+		idx, err = extractTar(rc, targetDir, layer.format)
+	}
 	if err != nil {
 		slog.Error("extract tar.gz", "error", err)
 		return err
 	}
 
-	idxName := targetDir + ".json"
+	idxName := layerIndex(targetDir)
 	// marshal index to json
 	data, err := json.Marshal(idx)
 	if err != nil {
@@ -194,10 +647,74 @@ func (s *OCIFS) unpackLayer(layer v1.Layer) error {
 		return err
 	}
 
+	s.emit(Event{Type: EventLayerUnpacked, Layer: h})
+
 	return nil
 }
 
-func extractTar(rc io.ReadCloser, target string) ([]*tar.Header, error) {
+// layerIndex returns the path of the index of the layer unpacked in dir.
+// Older versions mirrored the image tree in dir and wrote the index to
+// dir.json; such layers are unpacked again.
+func layerIndex(dir string) string {
+	return dir + ".v2.json"
+}
+
+// contentPath returns where the content of the entry name is stored,
+// relative to the directory its layer is unpacked in. Names are hashed, so
+// the length and depth of paths in the store do not grow with those in the
+// image, which can exceed PATH_MAX, and no name can escape the directory.
+func contentPath(name string) string {
+	sum := sha256.Sum256([]byte(cleanName(name)))
+	h := hex.EncodeToString(sum[:])
+	return path.Join(h[:2], h[2:])
+}
+
+// cleanName returns name relative to the root, with . and .. resolved.
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// writeContent stores the content of the entry name read from r in target,
+// returning its size and hex encoded sha256.
+func writeContent(target, name string, r io.Reader) (int64, string, error) {
+	p := filepath.Join(target, filepath.FromSlash(contentPath(name)))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return 0, "", err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return 0, "", err
+	}
+	sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, sum), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, hex.EncodeToString(sum.Sum(nil)), err
+}
+
+// extractRaw writes the content of a layer that is a single file, rather
+// than a tar, as the entry name in target.
+func extractRaw(rc io.Reader, target, name string) ([]*tar.Header, error) {
+	n, sum, err := writeContent(target, name, rc)
+	if err != nil {
+		return nil, err
+	}
+
+	epoch := time.Unix(0, 0)
+	return []*tar.Header{{
+		Name:       name,
+		Typeflag:   tar.TypeReg,
+		Mode:       0644,
+		Size:       n,
+		ModTime:    epoch,
+		AccessTime: epoch,
+		ChangeTime: epoch,
+		PAXRecords: map[string]string{ContentDigestRecord: sum},
+	}}, nil
+}
+
+func extractTar(rc io.ReadCloser, target string, format layerFormat) ([]*tar.Header, error) {
 	// Create a tar reader
 	tarReader := tar.NewReader(rc)
 
@@ -214,42 +731,55 @@ func extractTar(rc io.ReadCloser, target string) ([]*tar.Header, error) {
 			return nil, err
 		}
 
-		// Determine the target file path
-		targetFilePath := filepath.Join(target, header.Name)
+		if format.windows && !mapWindowsEntry(header) {
+			continue
+		}
+
+		name, ok := stripComponents(header.Name, format.strip)
+		if !ok {
+			continue
+		}
+		// names climbing out of the root with .. are resolved against it
+		header.Name = cleanName(name)
+		if header.Typeflag == tar.TypeLink {
+			if header.Linkname, ok = stripComponents(header.Linkname, format.strip); !ok {
+				continue
+			}
+			header.Linkname = cleanName(header.Linkname)
+		}
+
+		// only digests computed here are trusted, not those shipped in
+		// the layer
+		if header.Typeflag != tar.TypeReg {
+			delete(header.PAXRecords, ContentDigestRecord)
+		}
 
-		// Handle different file types
+		// Handle different file types; only the content of regular files
+		// is stored, everything else lives in the index
 		switch header.Typeflag {
 		case tar.TypeDir:
-			if err := os.MkdirAll(targetFilePath, 0755); err != nil {
-				return nil, err
-			}
 
 		case tar.TypeReg:
 			slog.Debug("file", "name", header.Name)
-			dir := filepath.Dir(targetFilePath)
-			if err := os.MkdirAll(dir, 0755); err != nil {
-				return nil, err
-			}
-			outFile, err := os.Create(targetFilePath)
+			_, sum, err := writeContent(target, header.Name, tarReader)
 			if err != nil {
 				return nil, err
 			}
-			defer outFile.Close()
-
-			if _, err := io.Copy(outFile, tarReader); err != nil {
-				return nil, err
+			if header.PAXRecords == nil {
+				header.PAXRecords = map[string]string{}
 			}
+			header.PAXRecords[ContentDigestRecord] = sum
 
 		case tar.TypeSymlink:
-			slog.Debug("symlink", "linkname", header.Linkname, "target", targetFilePath)
+			slog.Debug("symlink", "linkname", header.Linkname, "name", header.Name)
 
 		case tar.TypeLink:
-			slog.Debug("hardlink", "linkname", header.Linkname, "target", targetFilePath)
+			slog.Debug("hardlink", "linkname", header.Linkname, "name", header.Name)
 
 		case tar.TypeBlock, tar.TypeChar, tar.TypeFifo:
 
 		default:
-			fmt.Printf("Unsupported file type: %c in %s\n", header.Typeflag, header.Name)
+			slog.Warn("Unsupported file type", "type", string(header.Typeflag), "name", header.Name)
 			continue
 		}
 
@@ -259,3 +789,39 @@ func extractTar(rc io.ReadCloser, target string) ([]*tar.Header, error) {
 
 	return idx, nil
 }
+
+// keyedMutex hands out one mutex per key, dropping it once unused.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (k *keyedMutex) Lock(key string) (unlock func()) {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
@@ -0,0 +1,349 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestExtractTarLongNames(t *testing.T) {
+	longName := strings.Repeat("n", 200) + ".txt"
+	deepDir := strings.Repeat(strings.Repeat("d", 250)+"/", 20)
+
+	entries := []struct {
+		hdr  tar.Header
+		body string
+	}{
+		{tar.Header{Name: "pax/" + longName, Format: tar.FormatPAX}, "pax"},
+		{tar.Header{Name: "gnu/" + longName, Format: tar.FormatGNU}, "gnu"},
+		{tar.Header{Name: deepDir + "file", Format: tar.FormatPAX}, "deep"},
+		{tar.Header{Name: "gnu/link-" + longName, Typeflag: tar.TypeLink, Linkname: "gnu/" + longName, Format: tar.FormatGNU}, ""},
+		{tar.Header{Name: "../../escape", Format: tar.FormatPAX}, "escape"},
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		hdr.Mode = 0644
+		hdr.Size = int64(len(e.body))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	parent := t.TempDir()
+	target := filepath.Join(parent, "layer")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := extractTar(io.NopCloser(&buf), target, layerFormat{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = filepath.WalkDir(target, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if rel, _ := filepath.Rel(target, p); len(rel) > 100 {
+			t.Errorf("stored path %s grows with the image path", rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "escape")); err == nil {
+		t.Error("entry escaped the layer directory")
+	}
+
+	ut := newUnifiedTree()
+	ut.AddUnpackedLayer(target, idx)
+	fsys := &imageFS{ut: ut}
+
+	want := map[string]string{
+		"pax/" + longName:      "pax",
+		"gnu/" + longName:      "gnu",
+		"gnu/link-" + longName: "gnu",
+		deepDir + "file":       "deep",
+		"escape":               "escape",
+	}
+	for name, body := range want {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Errorf("read %.40s...: %v", name, err)
+			continue
+		}
+		if string(data) != body {
+			t.Errorf("%.40s... = %q, want %q", name, data, body)
+		}
+	}
+}
+
+func TestExtractTarWindows(t *testing.T) {
+	sd := map[string]string{"MSWINDOWS.rawsd": "AQAEgBQAAAAkAAAAAAAAADAAAAAB", "SCHILY.xattr.user.x": "1"}
+	entries := []struct {
+		hdr  tar.Header
+		body string
+	}{
+		{tar.Header{Name: "Files/", Typeflag: tar.TypeDir}, ""},
+		{tar.Header{Name: "Files/Windows/System32/cmd.exe", PAXRecords: sd}, "MZ"},
+		{tar.Header{Name: "Files/cmd.exe", Typeflag: tar.TypeLink, Linkname: "Files/Windows/System32/cmd.exe"}, ""},
+		{tar.Header{Name: "Hives/", Typeflag: tar.TypeDir}, ""},
+		{tar.Header{Name: "Hives/Software_Delta", PAXRecords: sd}, "regf"},
+		{tar.Header{Name: "UtilityVM/Files/boot.wim"}, "wim"},
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		hdr.Size = int64(len(e.body))
+		hdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := extractTar(io.NopCloser(&buf), t.TempDir(), layerFormat{windows: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]*tar.Header{}
+	for _, h := range idx {
+		got[h.Name] = h
+	}
+	if len(got) != 2 {
+		t.Errorf("got entries %v, want only the ones below Files/", got)
+	}
+	exe, ok := got["Windows/System32/cmd.exe"]
+	if !ok {
+		t.Fatal("Windows/System32/cmd.exe missing")
+	}
+	if _, ok := exe.PAXRecords["MSWINDOWS.rawsd"]; ok {
+		t.Error("security descriptor was kept")
+	}
+	if exe.PAXRecords["SCHILY.xattr.user.x"] != "1" {
+		t.Error("other PAX records were dropped")
+	}
+	if l, ok := got["cmd.exe"]; !ok || l.Linkname != "Windows/System32/cmd.exe" {
+		t.Errorf("hardlink = %+v, want it mapped below Files/", l)
+	}
+}
+
+func TestAppendImageRefs(t *testing.T) {
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ref := range []string{"example.com/b:1", "example.com/a:1", "example.com/b:1", ""} {
+		if err := ofs.appendImage(h, img, ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	refs, err := ofs.Refs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"example.com/a:1", "example.com/b:1"}; !slices.Equal(refs, want) {
+		t.Errorf("Refs() = %v, want %v", refs, want)
+	}
+	if _, err := ofs.lp.Image(h); err != nil {
+		t.Errorf("image not in layout: %v", err)
+	}
+}
+
+func TestStoreDirs(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      func(work, state string) []Option
+		layoutDir func(work, state string) string
+	}{
+		{
+			name:      "work dir alone",
+			opts:      func(work, state string) []Option { return []Option{WithWorkDir(work)} },
+			layoutDir: func(work, state string) string { return work },
+		},
+		{
+			name: "separate layout dir",
+			opts: func(work, state string) []Option {
+				return []Option{WithWorkDir(work), WithLayoutDir(filepath.Join(state, "layout"))}
+			},
+			layoutDir: func(work, state string) string { return filepath.Join(state, "layout") },
+		},
+		{
+			name:      "default layout dir",
+			opts:      func(work, state string) []Option { return []Option{WithUnpackDir(filepath.Join(work, "unpacked"))} },
+			layoutDir: func(work, state string) string { return filepath.Join(state, "ocifs") },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			work, state := t.TempDir(), t.TempDir()
+			t.Setenv("XDG_CACHE_HOME", t.TempDir())
+			t.Setenv("XDG_STATE_HOME", state)
+
+			ofs, err := New(tt.opts(work, state)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := random.Image(64, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, err := img.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ofs.appendImage(h, img, "example.com/a:1"); err != nil {
+				t.Fatal(err)
+			}
+
+			dir := tt.layoutDir(work, state)
+			if got := ofs.LayoutDir(); got != dir {
+				t.Errorf("LayoutDir() = %q, want %q", got, dir)
+			}
+			for _, p := range []string{"index.json", filepath.Join("blobs", h.Algorithm, h.Hex)} {
+				if _, err := os.Stat(filepath.Join(dir, p)); err != nil {
+					t.Errorf("%s not in layout dir: %v", p, err)
+				}
+			}
+			if dir != work {
+				if _, err := os.Stat(filepath.Join(work, "index.json")); err == nil {
+					t.Errorf("index.json in work dir")
+				}
+			}
+		})
+	}
+}
+
+func TestPullSingleFlight(t *testing.T) {
+	var manifests atomic.Int32
+	block := make(chan struct{})
+	host := testRegistry(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/manifests/") {
+			manifests.Add(1)
+			<-block
+		}
+		return false
+	})
+	var once sync.Once
+	release := func() { once.Do(func() { close(block) }) }
+	defer release()
+
+	ref := parseRef(t, host+"/app:v1")
+	pushRandomImage(t, ref, 256, 2)
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a caller giving up does not fail the pull for the others
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := ofs.pullImage(ctx, ref.String(), nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("pull with expired context: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = ofs.Pull(ref.String())
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	release()
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("pull %d: %v", i, err)
+		}
+	}
+	if n := manifests.Load(); n != 1 {
+		t.Errorf("manifest fetched %d times, want once", n)
+	}
+}
+
+func TestWriteLayersConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	var active, peak int
+	host := testRegistry(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodGet || !strings.Contains(r.URL.Path, "/blobs/") {
+			return false
+		}
+		mu.Lock()
+		active++
+		peak = max(peak, active)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return false
+	})
+
+	ref := parseRef(t, host+"/app:v1")
+	pushRandomImage(t, ref, 256, 3*layerConcurrency)
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ofs.Pull(ref.String()); err != nil {
+		t.Fatal(err)
+	}
+	// the config blob may be fetched alongside the layers
+	if peak > layerConcurrency+1 {
+		t.Errorf("%d blobs downloaded at once, want at most %d layers", peak, layerConcurrency)
+	}
+}
@@ -0,0 +1,64 @@
+package ocifs
+
+import (
+	"os"
+	"path"
+	"sync"
+)
+
+type transform struct {
+	glob string
+	fn   func([]byte) ([]byte, error)
+}
+
+// transformsFor returns the transforms whose glob matches p, in the order
+// they were given.
+func transformsFor(transforms []transform, p string) []func([]byte) ([]byte, error) {
+	var fns []func([]byte) ([]byte, error)
+	for _, t := range transforms {
+		if ok, _ := path.Match(t.glob, p); ok {
+			fns = append(fns, t.fn)
+		}
+	}
+	return fns
+}
+
+// transformedContent is the content of a file rewritten by transforms. It is
+// produced the first time the file is looked up, stat'ed or opened, so its
+// size is reported right, and kept for the life of the mount.
+type transformedContent struct {
+	fns []func([]byte) ([]byte, error)
+
+	mu     sync.Mutex
+	loaded bool
+	data   []byte
+}
+
+// load runs the transforms over the backing file the first time it is
+// called. A failed transform is retried on the next call.
+func (t *transformedContent) load(backingPath string) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.loaded {
+		return t.data, nil
+	}
+
+	data, err := os.ReadFile(backingPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, fn := range t.fns {
+		if data, err = fn(data); err != nil {
+			return nil, err
+		}
+	}
+
+	t.data, t.loaded = data, true
+	return data, nil
+}
+
+// transformedHandle is an open transformed file.
+type transformedHandle struct {
+	data []byte
+}
@@ -0,0 +1,108 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransformsFor(t *testing.T) {
+	upper := func(b []byte) ([]byte, error) { return bytes.ToUpper(b), nil }
+	suffix := func(b []byte) ([]byte, error) { return append(b, '!'), nil }
+	transforms := []transform{{"/etc/*.conf", upper}, {"/etc/app.conf", suffix}}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/etc/app.conf", "CONF!"},
+		{"/etc/other.conf", "CONF"},
+		{"/etc/sub/app.conf", "conf"},
+		{"/app.conf", "conf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			data := []byte("conf")
+			for _, fn := range transformsFor(transforms, tt.path) {
+				data, _ = fn(data)
+			}
+			if string(data) != tt.want {
+				t.Errorf("got %q, want %q", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformedContentLoad(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(p, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	calls, fail := 0, true
+	tc := &transformedContent{fns: []func([]byte) ([]byte, error){func(b []byte) ([]byte, error) {
+		calls++
+		if fail {
+			return nil, errors.New("failed")
+		}
+		return append(b, "-transformed"...), nil
+	}}}
+
+	if _, err := tc.load(p); err == nil {
+		t.Fatal("failed transform loaded")
+	}
+	// a failed transform is retried, and a successful one kept
+	fail = false
+	for i := 0; i < 2; i++ {
+		data, err := tc.load(p)
+		if err != nil || string(data) != "v1-transformed" {
+			t.Fatalf("load %d = %q, %v", i, data, err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("transform ran %d times, want 2", calls)
+	}
+}
+
+func TestMountTransformSize(t *testing.T) {
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	pushTarImage(t, ref, []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/app.conf", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/link.conf", Typeflag: tar.TypeLink, Linkname: "etc/app.conf"},
+	}, map[string]string{"etc/app.conf": "host=${HOST}\n"})
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := ofs.Mount(ref.String(), MountWithTargetPath(t.TempDir()), MountWithTransform("/etc/*.conf", func(b []byte) ([]byte, error) {
+		return bytes.ReplaceAll(b, []byte("${HOST}"), []byte("db.example.com")), nil
+	}))
+	if errors.Is(err, ErrFUSEUnavailable) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Unmount()
+
+	const want = "host=db.example.com\n"
+	for _, name := range []string{"app.conf", "link.conf"} {
+		p := filepath.Join(im.MountPoint(), "etc", name)
+		// the size is right before the file is ever opened
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != int64(len(want)) {
+			t.Errorf("%s: size %d before open, want %d", name, fi.Size(), len(want))
+		}
+		if data, err := os.ReadFile(p); err != nil || string(data) != want {
+			t.Errorf("%s: content %q, %v, want %q", name, data, err, want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package ocifs
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// WithHTTPTransport sends all registry traffic through t, such as one with
+// a proxy, a custom dialer or connection limits, instead of the default
+// transport of go-containerregistry. Bandwidth limits and timeouts are
+// applied on top of it.
+var WithHTTPTransport = func(t *http.Transport) Option {
+	return func(o *OCIFS) {
+		o.httpTransport = t
+	}
+}
+
+// WithRegistryTimeout bounds how long connecting to a registry, the TLS
+// handshake and waiting for the headers of a response may each take. It
+// does not bound reading a response, so large layers can still be
+// downloaded over slow links.
+var WithRegistryTimeout = func(d time.Duration) Option {
+	return func(o *OCIFS) {
+		o.httpTimeout = d
+	}
+}
+
+// WithUserAgent identifies ocifs to registries as ua, which is sent ahead
+// of the user agent of go-containerregistry.
+var WithUserAgent = func(ua string) Option {
+	return func(o *OCIFS) {
+		o.userAgent = ua
+	}
+}
+
+// WithRegistryHeaders adds headers to all requests made to registry, a host
+// such as registry.example.com or ghcr.io, for instance a key a gateway in
+// front of an internal registry expects. Requests redirected to other hosts,
+// such as blob downloads from a CDN, do not get them.
+var WithRegistryHeaders = func(registry string, headers http.Header) Option {
+	return func(o *OCIFS) {
+		if r, err := name.NewRegistry(registry); err == nil {
+			registry = r.RegistryStr()
+		}
+		if o.headers == nil {
+			o.headers = make(map[string]http.Header)
+		}
+		if o.headers[registry] == nil {
+			o.headers[registry] = make(http.Header)
+		}
+		for k, v := range headers {
+			o.headers[registry][k] = append(o.headers[registry][k], v...)
+		}
+	}
+}
+
+// newTransport builds the transport all registry requests share, so they
+// also share its connection pool.
+func (o *OCIFS) newTransport() http.RoundTripper {
+	t := o.httpTransport
+	if t == nil {
+		t = remote.DefaultTransport.(*http.Transport)
+	}
+
+	if len(o.pinned) > 0 || o.dnsServer != "" {
+		t = t.Clone()
+		dial := t.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		t.DialContext = o.pinnedDial(dial)
+	}
+	if d := o.httpTimeout; d > 0 {
+		t = t.Clone()
+		t.TLSHandshakeTimeout = d
+		t.ResponseHeaderTimeout = d
+		dial := t.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			return dial(ctx, network, addr)
+		}
+	}
+
+	var rt http.RoundTripper = t
+	if len(o.headers) > 0 {
+		rt = &headerTransport{base: rt, headers: o.headers}
+	}
+	if o.bandwidthLimit > 0 {
+		rt = &limitedTransport{base: rt, bucket: o.bandwidth}
+	}
+	return rt
+}
+
+// headerTransport adds the headers of the registry a request goes to.
+type headerTransport struct {
+	base    http.RoundTripper
+	headers map[string]http.Header
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h, ok := t.headers[req.URL.Host]
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	return t.base.RoundTrip(req)
+}
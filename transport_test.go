@@ -0,0 +1,99 @@
+package ocifs
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestHTTPTransport(t *testing.T) {
+	block := make(chan struct{})
+	host := testRegistry(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if strings.Contains(r.URL.Path, "/slow/") {
+			<-block
+		}
+		return false
+	})
+	defer close(block)
+
+	ref := parseRef(t, host+"/app:v1")
+	pushRandomImage(t, ref, 64, 1)
+
+	var dials atomic.Int32
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	ofs, err := New(WithWorkDir(t.TempDir()), WithHTTPTransport(tr), WithRegistryTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ofs.Pull(ref.String()); err != nil {
+		t.Fatal(err)
+	}
+	if dials.Load() == 0 {
+		t.Error("pull did not use the transport")
+	}
+
+	start := time.Now()
+	if _, err := ofs.Pull(host + "/slow/app:v1"); err == nil {
+		t.Error("pull from a registry not answering succeeded")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("pull took %s, want it to time out", d)
+	}
+}
+
+func TestRegistryHeaders(t *testing.T) {
+	var missing atomic.Int32
+	host := testRegistry(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("X-Gateway-Key") != "secret" || !strings.HasPrefix(r.UserAgent(), "ocifs-test") {
+			missing.Add(1)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return true
+		}
+		return false
+	})
+
+	ref := parseRef(t, host+"/app:v1")
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img, remote.WithUserAgent("ocifs-test"), remote.WithTransport(&headerTransport{
+		base:    http.DefaultTransport,
+		headers: map[string]http.Header{host: {"X-Gateway-Key": {"secret"}}},
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	ofs, err := New(WithWorkDir(t.TempDir()), WithUserAgent("ocifs-test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ofs.Pull(ref.String()); err == nil {
+		t.Error("pull without the header succeeded")
+	}
+
+	missing.Store(0)
+	ofs, err = New(WithWorkDir(t.TempDir()), WithUserAgent("ocifs-test"),
+		WithRegistryHeaders(host, http.Header{"X-Gateway-Key": {"secret"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ofs.Pull(ref.String()); err != nil {
+		t.Fatal(err)
+	}
+	if n := missing.Load(); n != 0 {
+		t.Errorf("%d requests went without the header or user agent", n)
+	}
+}
@@ -14,9 +14,20 @@ type unifiedTreeNode struct {
 	rootPath       string
 	isWhiteout     bool
 	opaqueWhiteout bool
+	// linkTarget is the content of a hardlink as it was when its layer was
+	// added, so removing or replacing the target in a higher layer does not
+	// affect the link.
+	linkTarget *unifiedTreeNode
+	// hashed is set for nodes from unpacked layers, whose content is stored
+	// under contentPath rather than a mirror of the image tree.
+	hashed bool
 }
 
+// Path returns where the content of the node is stored on disk.
 func (n *unifiedTreeNode) Path() string {
+	if n.hashed {
+		return path.Join(n.rootPath, contentPath(n.header.Name))
+	}
 	return path.Join(n.rootPath, n.header.Name)
 }
 
@@ -26,6 +37,9 @@ func (n *unifiedTreeNode) Header() *tar.Header {
 
 type unifiedTree struct {
 	root *unifiedTreeNode
+	// normalize, when set, maps path components to the form used as keys
+	// in the tree, so names that differ only in encoding collide.
+	normalize func(string) string
 }
 
 func newUnifiedTree() *unifiedTree {
@@ -37,32 +51,38 @@ func newUnifiedTree() *unifiedTree {
 	}
 }
 
+// AddLayer adds a layer whose files mirror the tree below rootPath, such as
+// a lower dir.
 func (fs *unifiedTree) AddLayer(rootPath string, files []*tar.Header) {
 	for _, header := range files {
-		fs.addFile(rootPath, header)
+		fs.addFile(rootPath, header, false)
+	}
+}
+
+// AddUnpackedLayer adds a layer unpacked into rootPath by unpackLayer.
+func (fs *unifiedTree) AddUnpackedLayer(rootPath string, files []*tar.Header) {
+	for _, header := range files {
+		fs.addFile(rootPath, header, true)
 	}
 }
 
-func (fs *unifiedTree) addFile(rootPath string, header *tar.Header) {
+func (fs *unifiedTree) addFile(rootPath string, header *tar.Header, hashed bool) {
 	name := strings.Trim(header.Name, "/")
 	if name == "." || name == "" {
 		// This is a root entry, update the root node
 		fs.root.header = header
 		fs.root.rootPath = rootPath
+		fs.root.hashed = hashed
 		return
 	}
 
-	parts := strings.Split(name, "/")
+	parts := fs.splitPath(name)
 	current := fs.root
 
 	for i, part := range parts {
 		if part == ".wh..wh..opq" {
-			// Opaque whiteout: remove all children from lower layers
-			for k, v := range current.children {
-				if v.rootPath != rootPath {
-					delete(current.children, k)
-				}
-			}
+			// Opaque whiteout: hide everything below from lower layers
+			pruneLower(current, rootPath)
 			current.opaqueWhiteout = true
 			return
 		}
@@ -70,33 +90,135 @@ func (fs *unifiedTree) addFile(rootPath string, header *tar.Header) {
 		if strings.HasPrefix(part, ".wh.") {
 			// Handle regular whiteout
 			realName := strings.TrimPrefix(part, ".wh.")
-			if i == len(parts)-1 {
-				// Whiteout file
-				delete(current.children, realName)
-				current.children[part] = &unifiedTreeNode{name: part, header: header, isWhiteout: true, rootPath: rootPath}
-			} else {
-				// Whiteout directory
+			if i < len(parts)-1 {
+				// a whiteout directory hides its contents with it
 				delete(current.children, realName)
+				return
 			}
+			// entries of the same layer are not hidden by its whiteouts
+			if n, ok := current.children[realName]; ok {
+				pruneLower(n, rootPath)
+				if n.rootPath != rootPath && !hasEntries(n) {
+					delete(current.children, realName)
+				}
+			}
+			current.children[part] = &unifiedTreeNode{name: part, header: header, isWhiteout: true, rootPath: rootPath, hashed: hashed}
 			return
 		}
 
-		if next, exists := current.children[part]; exists {
-			current = next
-		} else {
-			newNode := &unifiedTreeNode{
+		next, exists := current.children[part]
+		// an entry replacing a directory of a lower layer is the parent of
+		// nothing, and an entry below one that is not a directory replaces
+		// it with a directory
+		if exists && i < len(parts)-1 && next.header != nil && !isDirHeader(next.header) {
+			exists = false
+		}
+		if !exists {
+			next = &unifiedTreeNode{
 				name:     part,
 				children: make(map[string]*unifiedTreeNode),
 				rootPath: rootPath,
+				hashed:   hashed,
 			}
-			current.children[part] = newNode
-			current = newNode
+			current.children[part] = next
 		}
+		current = next
 	}
 
 	// Update the node, including its rootPath
 	current.header = header
 	current.rootPath = rootPath
+	current.hashed = hashed
+	current.linkTarget = nil
+	if !isDirHeader(header) {
+		current.children = make(map[string]*unifiedTreeNode)
+	}
+	if header.Typeflag == tar.TypeLink {
+		current.linkTarget = fs.resolveLink(header.Linkname)
+	}
+}
+
+// isDirHeader reports whether hdr is that of a directory.
+func isDirHeader(hdr *tar.Header) bool {
+	return hdr.Typeflag == tar.TypeDir || strings.HasSuffix(hdr.Name, "/")
+}
+
+// pruneLower removes the entries below n that come from layers other than
+// the one at rootPath, keeping directories that still hold entries of that
+// layer.
+func pruneLower(n *unifiedTreeNode, rootPath string) {
+	for name, ch := range n.children {
+		pruneLower(ch, rootPath)
+		if ch.rootPath != rootPath && !hasEntries(ch) {
+			delete(n.children, name)
+		}
+	}
+}
+
+// hasEntries reports whether n has children other than whiteouts, which
+// only hide what is below them and do not keep a directory in the tree.
+func hasEntries(n *unifiedTreeNode) bool {
+	for _, ch := range n.children {
+		if !ch.isWhiteout {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveLink returns a copy of the node holding the content of the hardlink
+// target name in the tree as it is now, or nil if there is none.
+func (fs *unifiedTree) resolveLink(name string) *unifiedTreeNode {
+	target, ok := fs.Get(name)
+	if !ok || target.header == nil {
+		return nil
+	}
+	if target.linkTarget != nil {
+		return target.linkTarget
+	}
+	if target.header.Typeflag != tar.TypeReg {
+		return nil
+	}
+	return &unifiedTreeNode{name: target.name, header: target.header, rootPath: target.rootPath, hashed: target.hashed}
+}
+
+// linksTo returns the paths of the hardlinks sharing the content of the
+// node at pathStr.
+func (fs *unifiedTree) linksTo(pathStr string) []string {
+	n, ok := fs.Get(pathStr)
+	if !ok || n.header == nil {
+		return nil
+	}
+	content := n.header
+	if n.linkTarget != nil {
+		content = n.linkTarget.header
+	}
+
+	links := []string{}
+	fs.Traverse(func(l *unifiedTreeNode, p string) bool {
+		if l != n && l.linkTarget != nil && l.linkTarget.header == content {
+			links = append(links, strings.TrimPrefix(p, "/"))
+		}
+		return true
+	})
+	return links
+}
+
+// LinkTarget returns the node holding the content of the hardlink n. Links
+// resolved when their layer was added keep that content; others are looked
+// up in the tree as it is now.
+func (fs *unifiedTree) LinkTarget(n *unifiedTreeNode) (*unifiedTreeNode, bool) {
+	if n.linkTarget != nil {
+		return n.linkTarget, true
+	}
+	return fs.Get(n.header.Linkname)
+}
+
+func (fs *unifiedTree) splitPath(pathStr string) []string {
+	if fs.normalize != nil {
+		pathStr = fs.normalize(pathStr)
+	}
+	return strings.Split(pathStr, "/")
 }
 
 func (fs *unifiedTree) removeSubtree(parent *unifiedTreeNode, name string) {
@@ -114,7 +236,7 @@ func (fs *unifiedTree) getNode(pathStr string) *unifiedTreeNode {
 		return fs.root
 	}
 
-	parts := strings.Split(strings.Trim(pathStr, "/"), "/")
+	parts := fs.splitPath(strings.Trim(pathStr, "/"))
 	current := fs.root
 
 	for _, part := range parts {
@@ -132,16 +254,26 @@ func (fs *unifiedTree) Traverse(callback func(*unifiedTreeNode, string) bool) {
 	if fs.root == nil {
 		return
 	}
-	fs.traverseDFS(fs.root, "", callback)
+	fs.traverseDFS(fs.root, "", false, callback)
+}
+
+// TraverseAll is like Traverse, but also calls callback for directories no
+// layer has an entry for, with a nil header. Those only holding whiteouts
+// exist in the image all the same.
+func (fs *unifiedTree) TraverseAll(callback func(*unifiedTreeNode, string) bool) {
+	if fs.root == nil {
+		return
+	}
+	fs.traverseDFS(fs.root, "", true, callback)
 }
 
-func (fs *unifiedTree) traverseDFS(node *unifiedTreeNode, pathStr string, callback func(*unifiedTreeNode, string) bool) bool {
+func (fs *unifiedTree) traverseDFS(node *unifiedTreeNode, pathStr string, implicit bool, callback func(*unifiedTreeNode, string) bool) bool {
 	if node.isWhiteout {
 		return true
 	}
 
 	fullPath := path.Join(pathStr, node.name)
-	if node.header != nil {
+	if node.header != nil || (implicit && node != fs.root) {
 		if !callback(node, fullPath) {
 			return false
 		}
@@ -157,7 +289,7 @@ func (fs *unifiedTree) traverseDFS(node *unifiedTreeNode, pathStr string, callba
 	})
 
 	for _, child := range children {
-		if !fs.traverseDFS(child, fullPath, callback) {
+		if !fs.traverseDFS(child, fullPath, implicit, callback) {
 			return false
 		}
 	}
@@ -175,7 +307,7 @@ func (fs *unifiedTree) Get(pathStr string) (*unifiedTreeNode, bool) {
 	}
 
 	// Split the path into parts
-	parts := strings.Split(strings.TrimPrefix(pathStr, "/"), "/")
+	parts := fs.splitPath(strings.TrimPrefix(pathStr, "/"))
 
 	current := fs.root
 	for _, part := range parts {
@@ -191,3 +323,27 @@ func (fs *unifiedTree) Get(pathStr string) (*unifiedTreeNode, bool) {
 
 	return current, true
 }
+
+// Whiteout returns the whiteout entry hiding pathStr, if a layer removed it.
+func (fs *unifiedTree) Whiteout(pathStr string) (*unifiedTreeNode, bool) {
+	dir, base := path.Split(path.Clean("/" + pathStr))
+	if base == "" {
+		return nil, false
+	}
+	parent, ok := fs.Get(dir)
+	if !ok {
+		return nil, false
+	}
+	// entries added back by a higher layer are not whited out
+	if _, ok := fs.Get(pathStr); ok {
+		return nil, false
+	}
+	if fs.normalize != nil {
+		base = fs.normalize(base)
+	}
+	wh, ok := parent.children[".wh."+base]
+	if !ok || !wh.isWhiteout {
+		return nil, false
+	}
+	return wh, true
+}
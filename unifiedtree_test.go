@@ -10,6 +10,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 func TestUnifiedTreeStress(t *testing.T) {
@@ -370,3 +372,138 @@ func TestUnifiedTreeStress(t *testing.T) {
 		})
 	}
 }
+
+func TestUnifiedTreeNormalization(t *testing.T) {
+	nfd := "cafe\u0301"
+	nfc := "caf\u00e9"
+
+	layers := [][]tar.Header{
+		{
+			{Name: nfd + "/menu.txt", Size: 100, ModTime: time.Now(), Mode: 0644},
+			{Name: "r" + nfd + ".txt", Size: 100, ModTime: time.Now(), Mode: 0644},
+		},
+		{
+			{Name: nfc + "/.wh.menu.txt", Size: 0, ModTime: time.Now(), Mode: 0644},
+			{Name: nfc + "/drinks.txt", Size: 200, ModTime: time.Now(), Mode: 0644},
+			{Name: "r" + nfc + ".txt", Size: 300, ModTime: time.Now(), Mode: 0644},
+		},
+	}
+
+	tree := newUnifiedTree()
+	tree.normalize = norm.NFC.String
+	for i, layer := range layers {
+		headers := make([]*tar.Header, len(layer))
+		for j := range layer {
+			headers[j] = &layer[j]
+		}
+		tree.AddLayer("/layer"+strconv.Itoa(i+1), headers)
+	}
+
+	var result []string
+	tree.Traverse(func(node *unifiedTreeNode, pathStr string) bool {
+		result = append(result, pathStr[1:]+"@"+node.rootPath)
+		return true
+	})
+
+	want := []string{
+		nfc + "/drinks.txt@/layer2",
+		"r" + nfc + ".txt@/layer2",
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("Unexpected result\nGot:\n%q\nWant:\n%q", result, want)
+	}
+
+	for _, p := range []string{nfd + "/drinks.txt", nfc + "/drinks.txt"} {
+		n, ok := tree.Get(p)
+		if !ok {
+			t.Errorf("Get(%q) did not find the file", p)
+			continue
+		}
+		// the content path keeps the name as it was stored in the layer
+		if n.Path() != path.Join("/layer2", nfc+"/drinks.txt") {
+			t.Errorf("Get(%q).Path() = %q", p, n.Path())
+		}
+	}
+
+	if _, ok := tree.Get(nfd + "/menu.txt"); ok {
+		t.Errorf("whiteout with a differently normalized name did not hide the file")
+	}
+}
+
+func TestUnifiedTreeWhiteout(t *testing.T) {
+	tree := newUnifiedTree()
+	tree.AddLayer("/layer1", []*tar.Header{
+		{Name: "etc/passwd", Size: 100, ModTime: time.Now(), Mode: 0644},
+		{Name: "etc/group", Size: 100, ModTime: time.Now(), Mode: 0644},
+	})
+	tree.AddLayer("/layer2", []*tar.Header{
+		{Name: "etc/.wh.passwd", Size: 0, ModTime: time.Now(), Mode: 0644},
+	})
+
+	wh, ok := tree.Whiteout("/etc/passwd")
+	if !ok {
+		t.Fatal("expected /etc/passwd to be whited out")
+	}
+	if wh.rootPath != "/layer2" {
+		t.Errorf("whiteout rootPath = %q, want /layer2", wh.rootPath)
+	}
+
+	for _, p := range []string{"/etc/group", "/etc/shadow", "/", "/usr/bin/sh"} {
+		if _, ok := tree.Whiteout(p); ok {
+			t.Errorf("Whiteout(%q) reported a whiteout", p)
+		}
+	}
+}
+
+func TestHideLayer(t *testing.T) {
+	tree := newUnifiedTree()
+	tree.AddLayer("/layer1", []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/shadow", Size: 100, ModTime: time.Now(), Mode: 0600},
+		{Name: "etc/passwd", Size: 100, ModTime: time.Now(), Mode: 0644},
+		{Name: "secrets/", Typeflag: tar.TypeDir, Mode: 0700},
+		{Name: "secrets/token", Size: 10, ModTime: time.Now(), Mode: 0600},
+	})
+
+	tree.AddLayer("", hideLayer(tree, []string{"/etc/shadow", "secrets", "/does/not/exist", "/"}))
+
+	for _, p := range []string{"/etc/shadow", "/secrets", "/secrets/token", "/does/not/exist"} {
+		if _, ok := tree.Get(p); ok {
+			t.Errorf("%s is still visible", p)
+		}
+	}
+	if _, ok := tree.Get("/etc/passwd"); !ok {
+		t.Error("/etc/passwd was hidden")
+	}
+	if _, ok := tree.Get("/does"); ok {
+		t.Error("hiding a missing path created its parent")
+	}
+}
+
+func TestHideLayerHardlinks(t *testing.T) {
+	tree := newUnifiedTree()
+	tree.AddLayer("/layer1", []*tar.Header{
+		{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0600},
+		{Name: "etc/shadow-", Typeflag: tar.TypeLink, Linkname: "etc/shadow"},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+	})
+	tree.AddLayer("/layer2", []*tar.Header{
+		{Name: "etc/.wh.shadow", Typeflag: tar.TypeReg},
+		{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0600},
+		{Name: "backup/shadow", Typeflag: tar.TypeLink, Linkname: "etc/shadow-"},
+	})
+
+	tree.AddLayer("", hideLayer(tree, []string{"/etc/shadow-"}))
+
+	for _, p := range []string{"/etc/shadow-", "/backup/shadow"} {
+		if _, ok := tree.Get(p); ok {
+			t.Errorf("%s is still visible", p)
+		}
+	}
+	// replaced in a higher layer, it no longer shares content with the links
+	for _, p := range []string{"/etc/shadow", "/etc/passwd"} {
+		if _, ok := tree.Get(p); !ok {
+			t.Errorf("%s was hidden", p)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package ocifs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// ContentDigestRecord is the PAX record the index keeps the hex encoded
+// sha256 of the content of regular files in, as computed while unpacking.
+// Sys of the file infos of Image.FS returns the *tar.Header holding it, that
+// of the target for hardlinks.
+const ContentDigestRecord = "OCIFS.sha256"
+
+// MountWithVerifiedReads checks the content of each regular file of the
+// image against the digest recorded when its layer was unpacked, the first
+// time it is opened in the mount, so content modified in the store since
+// is never served. Opens fail with EIO on a mismatch. Files of layers
+// unpacked by versions that did not record digests cannot be verified and
+// fail to open too.
+var MountWithVerifiedReads = func() MountOption {
+	return func(im *ImageMount) {
+		im.verifyReads = true
+	}
+}
+
+// contentDigest returns the digest of the content of n recorded in the
+// index, or "" if there is none, and whether n is from an unpacked layer of
+// the image, whose content is verified, rather than from host directories
+// or masked files.
+func (n *unifiedTreeNode) contentDigest() (string, bool) {
+	return n.header.PAXRecords[ContentDigestRecord], n.hashed
+}
+
+// contentVerifier remembers the content files of a mount that matched their
+// digest, so each is only hashed once.
+type contentVerifier struct {
+	locks    keyedMutex
+	mu       sync.Mutex
+	verified map[string]bool
+}
+
+func newContentVerifier() *contentVerifier {
+	return &contentVerifier{verified: map[string]bool{}}
+}
+
+// verify checks the content of of against its digest. Files that do not
+// match are checked again on the next open, in case they were repaired.
+func (v *contentVerifier) verify(of *ociFile) syscall.Errno {
+	if v == nil || !of.fromLayer {
+		return fs.OK
+	}
+	p, digest := of.fullPath, of.digest
+	if digest == "" {
+		slog.Error("No digest recorded to verify file, unpack its layer again", "layerPath", p)
+		return syscall.EIO
+	}
+
+	// concurrent opens of a file wait for a single check
+	unlock := v.locks.Lock(p)
+	defer unlock()
+	v.mu.Lock()
+	ok := v.verified[p]
+	v.mu.Unlock()
+	if ok {
+		return fs.OK
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		slog.Error("Error opening file to verify", "layerPath", p, "error", err)
+		return syscall.EIO
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		slog.Error("Error reading file to verify", "layerPath", p, "error", err)
+		return syscall.EIO
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); got != digest {
+		slog.Error("File does not match its digest", "layerPath", p, "digest", "sha256:"+got, "want", "sha256:"+digest)
+		return syscall.EIO
+	}
+
+	v.mu.Lock()
+	v.verified[p] = true
+	v.mu.Unlock()
+	return fs.OK
+}
@@ -0,0 +1,121 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestMountVerifiedReads(t *testing.T) {
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	pushTarImage(t, ref, []*tar.Header{
+		{Name: "good", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "bad", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "link", Typeflag: tar.TypeLink, Linkname: "bad"},
+	}, map[string]string{"good": "good content", "bad": "bad content"})
+
+	workDir := t.TempDir()
+	ofs, err := New(WithWorkDir(workDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ofs.Image(ref.String()); err != nil {
+		t.Fatal(err)
+	}
+	// tamper with the unpacked content of bad
+	err = filepath.WalkDir(filepath.Join(workDir, "unpacked"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if data, err := os.ReadFile(p); err == nil && string(data) == "bad content" {
+			return os.WriteFile(p, []byte("BAD CONTENT"), 0644)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, verified := range []bool{true, false} {
+		opts := []MountOption{MountWithTargetPath(t.TempDir())}
+		if verified {
+			opts = append(opts, MountWithVerifiedReads())
+		}
+		im, err := ofs.Mount(ref.String(), opts...)
+		if errors.Is(err, ErrFUSEUnavailable) {
+			t.Skip(err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, p := range []string{"good", "bad", "link", "good"} {
+			data, err := os.ReadFile(filepath.Join(im.MountPoint(), p))
+			switch {
+			case p == "good":
+				if err != nil || string(data) != "good content" {
+					t.Errorf("verified %v: %s: %q, %v", verified, p, data, err)
+				}
+			case verified:
+				if !errors.Is(err, syscall.EIO) {
+					t.Errorf("verified %v: %s: %q, %v, want EIO", verified, p, data, err)
+				}
+			case string(data) != "BAD CONTENT":
+				t.Errorf("verified %v: %s: %q, %v, want the modified content", verified, p, data, err)
+			}
+		}
+		if err := im.Unmount(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestImageFSContentDigest(t *testing.T) {
+	// digests shipped in the layer must not be taken for the content's
+	forged := fmt.Sprintf("%x", sha256.Sum256([]byte("other content")))
+	ref := parseRef(t, testRegistry(t, nil)+"/app:v1")
+	pushTarImage(t, ref, []*tar.Header{
+		{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, PAXRecords: map[string]string{ContentDigestRecord: forged}},
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755, PAXRecords: map[string]string{ContentDigestRecord: forged}},
+		{Name: "link", Typeflag: tar.TypeLink, Linkname: "file", PAXRecords: map[string]string{ContentDigestRecord: forged}},
+	}, map[string]string{"file": "content"})
+
+	ofs, err := New(WithWorkDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := ofs.Image(ref.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		digest string
+	}{
+		{"file", fmt.Sprintf("%x", sha256.Sum256([]byte("content")))},
+		{"dir", ""},
+		{"link", fmt.Sprintf("%x", sha256.Sum256([]byte("content")))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fi, err := fs.Stat(img.FS(), tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hdr, ok := fi.Sys().(*tar.Header)
+			if !ok {
+				t.Fatalf("Sys() = %T, want *tar.Header", fi.Sys())
+			}
+			if got := hdr.PAXRecords[ContentDigestRecord]; got != tt.digest {
+				t.Errorf("recorded digest = %q, want %q", got, tt.digest)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"errors"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// ErrWindowsImage is returned when pulling an image built for Windows
+// without WithWindowsLayers.
+var ErrWindowsImage = errors.New("windows images are not supported")
+
+// windowsFilesDir holds the filesystem in the layers of Windows images,
+// next to registry hives and the utility VM.
+const windowsFilesDir = "Files/"
+
+// windowsRecordPrefix prefixes the PAX records holding security
+// descriptors and attributes of entries of Windows layers.
+const windowsRecordPrefix = "MSWINDOWS."
+
+// isWindowsImage reports whether img is a container image built for
+// Windows. Artifacts with configs of other types are not.
+func isWindowsImage(img v1.Image) (bool, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return false, err
+	}
+	if m.Config.MediaType != types.OCIConfigJSON && m.Config.MediaType != types.DockerConfigJSON {
+		return false, nil
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(cfg.OS, "windows"), nil
+}
+
+// mapWindowsEntry maps the header of an entry of a Windows layer into the
+// image tree. It returns false for entries outside of the filesystem, such as
+// registry hives. The Windows specific PAX records, which have no meaning on
+// Linux and would bloat the index, are dropped.
+func mapWindowsEntry(h *tar.Header) bool {
+	var ok bool
+	if h.Name, ok = windowsName(h.Name); !ok {
+		return false
+	}
+	if h.Typeflag == tar.TypeLink {
+		if h.Linkname, ok = windowsName(h.Linkname); !ok {
+			return false
+		}
+	}
+	for k := range h.PAXRecords {
+		if strings.HasPrefix(k, windowsRecordPrefix) {
+			delete(h.PAXRecords, k)
+		}
+	}
+	return true
+}
+
+func windowsName(name string) (string, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimPrefix(name, "/"), windowsFilesDir)
+	if !ok || strings.Trim(rest, "/") == "" {
+		return "", false
+	}
+	return rest, true
+}